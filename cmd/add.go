@@ -0,0 +1,88 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+	"slices"
+
+	"github.com/spf13/cobra"
+)
+
+var addCmd = &cobra.Command{
+	Use:   "add IMAGE_FILE SRC DEST",
+	Short: "add files to FAT image",
+	Long: `
+Copy host file or directory SRC into an existing FAT image at path DEST,
+changing the image in place.  If DEST ends with '/' or is an existing
+directory, SRC is copied into it under its own name.  Directories are
+copied recursively and parent directories are created.
+
+Replacing existing files in the image asks for confirmation; --force
+replaces them without asking and --no-clobber keeps them.  --dry-run
+reports the files that would be written or replaced.
+
+ISO9660 images are read-only and are refused.  Use --partition or
+--partition-label to modify a partition of a disk image.
+`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		imageFile := args[0]
+		src := args[1]
+		dest := args[2]
+		checkOverwriteOptions("add")
+		selector, err := partitionSelector("add")
+		cobra.CheckErr(err)
+		files, existing, err := image.PlanAddImageFiles(imageFile, selector, src, dest)
+		cobra.CheckErr(err)
+		noClobber := ViperGetBool("add.no-clobber")
+		if ViperGetBool("add.dry-run") {
+			for _, file := range files {
+				reportWrite(file, slices.Contains(existing, file), noClobber)
+			}
+			return
+		}
+		if len(existing) > 0 && !noClobber {
+			if !confirmChange("add", fmt.Sprintf("Replace %d existing files in '%s'", len(existing), imageFile)) {
+				return
+			}
+		}
+		err = image.AddImageFiles(imageFile, selector, src, dest, noClobber)
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(addCmd)
+	OptionOverwrite(addCmd)
+	OptionPartition(addCmd)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+
+	"github.com/spf13/cobra"
+)
+
+var bootinfoCmd = &cobra.Command{
+	Use:   "bootinfo IMAGE_FILE",
+	Short: "report image boot structures",
+	Long: `
+Report the El Torito boot catalog entries, isohybrid MBR/GPT partition
+tables and EFI loaders of an ISO or FAT disk image.  Each EFI boot image
+is checked for valid /EFI/BOOT/*.EFI loaders.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := image.BootInfo(args[0])
+		cobra.CheckErr(err)
+		if ViperGetBool("bootinfo.json") {
+			fmt.Println(FormatJSON(report))
+			return
+		}
+		printBootReport(report)
+	},
+}
+
+func printBootReport(report *image.BootReport) {
+	fmt.Printf("image: %s\n", report.Image)
+	fmt.Printf("size: %d\n", report.Size)
+	fmt.Printf("format: %s\n", report.Format)
+	if report.Label != "" {
+		fmt.Printf("label: %s\n", report.Label)
+	}
+	if report.Format == "iso9660" {
+		fmt.Printf("isohybrid: %v\n", report.Isohybrid)
+		if report.CatalogSector == 0 {
+			fmt.Println("boot catalog: none")
+		} else {
+			fmt.Printf("boot catalog: sector %d\n", report.CatalogSector)
+		}
+	}
+	for i, entry := range report.Entries {
+		fmt.Printf("entry %d: platform=%s emulation=%s bootable=%v load_rba=%d sectors=%d size=%d",
+			i, entry.Platform, entry.Emulation, entry.Bootable, entry.LoadRBA, entry.SectorCount, entry.Size)
+		if entry.Path != "" {
+			fmt.Printf(" path=%s", entry.Path)
+		} else {
+			fmt.Printf(" hidden")
+		}
+		if entry.BootTable {
+			fmt.Printf(" boot_table")
+		}
+		fmt.Println()
+		printLoaders("  ", entry.Loaders, entry.LoaderError)
+	}
+	printPartitions("mbr", report.MBR)
+	printPartitions("gpt", report.GPT)
+	if report.Format != "iso9660" && report.Format != "unknown" {
+		printLoaders("", report.Loaders, report.LoaderError)
+	}
+}
+
+func printLoaders(indent string, loaders []*image.LoaderReport, loaderError string) {
+	if loaderError != "" {
+		fmt.Printf("%sloader: %s\n", indent, loaderError)
+	}
+	for _, loader := range loaders {
+		if loader.Valid {
+			fmt.Printf("%sloader: %s arch=%s valid\n", indent, loader.Path, loader.Arch)
+		} else {
+			fmt.Printf("%sloader: %s invalid: %s\n", indent, loader.Path, loader.Error)
+		}
+	}
+}
+
+func printPartitions(table string, partitions []*image.Partition) {
+	for _, p := range partitions {
+		fmt.Printf("%s partition %d: type=%s", table, p.Index, p.Type)
+		if p.TypeName != "" {
+			fmt.Printf(" (%s)", p.TypeName)
+		}
+		if p.Name != "" {
+			fmt.Printf(" name=%q", p.Name)
+		}
+		fmt.Printf(" start=%d size=%d", p.Start, p.Size)
+		if p.Bootable {
+			fmt.Printf(" bootable")
+		}
+		fmt.Println()
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(bootinfoCmd)
+	OptionSwitch(bootinfoCmd, "json", "j", "output JSON")
+}
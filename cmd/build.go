@@ -0,0 +1,112 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+
+	"github.com/spf13/cobra"
+)
+
+var buildCmd = &cobra.Command{
+	Use:   "build MANIFEST",
+	Short: "build an image described by a manifest file",
+	Long: `
+Build the FAT image, ISO or partitioned disk image described by MANIFEST,
+a YAML (.yaml, .yml) or TOML (.toml) file.  Relative paths in the manifest
+are relative to the directory holding it.
+
+    type: iso                   # fat, iso or disk
+    output: out/boot.iso
+    source: base.iso            # iso: the ISO to start from
+    label: BOOT                 # volume label (ESP label for disk)
+    size: auto                  # fat and disk: size with K/M/G suffix
+    fat: auto                   # fat and disk ESP: 12, 16, 32 or auto
+    boot:                       # EFI loaders by architecture
+      - {arch: x64, file: grubx64.efi}
+    files:                      # copied to the image, the ESP or the ISO
+      - {src: grub.cfg, dest: /boot/grub/}
+    efi_files:                  # iso: copied to the EFI boot image
+      - {src: grub.cfg, dest: /EFI/BOOT/grub.cfg}
+    delete: [/isolinux]         # iso: paths removed from the source
+    hybrid: true                # iso: isohybrid MBR, plus GPT with 'gpt'
+    gpt: true
+    timestamp: 1715949000       # fixed timestamp for reproducible output
+    serial: 1234-ABCD           # fixed FAT volume serial
+
+Disk manifests also accept table (gpt or mbr), protective_mbr, esp_size and
+partitions entries with name, source, size, label and fat keys.
+
+The manifest is checked before anything is written, and each problem is
+reported with its line number.  Use --check to validate without building.
+--timestamp and --serial override the manifest timestamp and serial keys.
+
+The image is written to a temporary file beside the output and renamed into
+place once complete.  Replacing an existing output asks for confirmation;
+--force replaces it without asking and --no-clobber keeps it.  --backup
+keeps the replaced file with a .bak suffix.  --dry-run reports what would
+be written.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		manifest, err := image.LoadManifest(args[0])
+		cobra.CheckErr(err)
+		if timestamp := ViperGetString("build.timestamp"); timestamp != "" {
+			manifest.Timestamp = timestamp
+		}
+		if serial := ViperGetString("build.serial"); serial != "" {
+			manifest.Serial = serial
+		}
+		err = manifest.Validate()
+		cobra.CheckErr(err)
+		if ViperGetBool("build.check") {
+			fmt.Printf("%s: ok\n", args[0])
+			return
+		}
+		var ok bool
+		manifest.OutputOptions, ok = prepareOutput("build", manifest.OutputPath())
+		if !ok {
+			return
+		}
+		manifest.Progress = progressFunc()
+		err = manifest.Build(cmd.Context())
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(buildCmd)
+	OptionOverwrite(buildCmd)
+	OptionSwitch(buildCmd, "check", "", "validate the manifest without building")
+	OptionBuildStamp(buildCmd)
+	OptionBackup(buildCmd)
+}
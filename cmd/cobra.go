@@ -38,6 +38,14 @@ func ViperGetInt64(key string) int64 {
 	return viper.GetInt64(viperKey(key))
 }
 
+func ViperGetStringSlice(key string) []string {
+	values := viper.GetStringSlice(viperKey(key))
+	for i, value := range values {
+		values[i] = ExpandPath(value)
+	}
+	return values
+}
+
 func ViperSet(key string, value any) {
 	viper.Set(viperKey(key), value)
 }
@@ -86,6 +94,27 @@ func OptionString(cmd *cobra.Command, name, flag, defaultValue, description stri
 	}
 }
 
+func OptionStringArray(cmd *cobra.Command, name, flag string, defaultValue []string, description string) {
+
+	if cmd == rootCmd {
+		if flag == "" {
+			rootCmd.PersistentFlags().StringArray(name, defaultValue, description)
+		} else {
+			rootCmd.PersistentFlags().StringArrayP(name, flag, defaultValue, description)
+		}
+
+		viper.BindPFlag(viperKey(name), rootCmd.PersistentFlags().Lookup(name))
+	} else {
+		if flag == "" {
+			cmd.PersistentFlags().StringArray(name, defaultValue, description)
+		} else {
+			cmd.PersistentFlags().StringArrayP(name, flag, defaultValue, description)
+		}
+		prefix := strings.ToLower(strings.ReplaceAll(cmd.Name(), "-", "_")) + "."
+		viper.BindPFlag(viperKey(prefix+name), cmd.PersistentFlags().Lookup(name))
+	}
+}
+
 func OpenLog() {
 	filename := ViperGetString("logfile")
 	LogFile = nil
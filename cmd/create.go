@@ -33,43 +33,144 @@ package cmd
 import (
 	"fmt"
 	"github.com/rstms/fdimage/image"
-	"os"
 
 	"github.com/spf13/cobra"
 )
 
 var createCmd = &cobra.Command{
-	Use:   "create IMAGE_FILE EFI_FILE EFI_NAME [EXTRA_FILE ...]",
+	Use:   "create IMAGE_FILE [EFI_FILE EFI_NAME] [EXTRA_FILE ...]",
 	Short: "create EFI floppy image for a bootable ISO",
 	Long: `
 Create a FAT formatted floppy disk image file in IMAGE_FILE.  Copy EFI_FILE
 into the boot image as /EFI/BOOT/{EFI_NAME}
 Copy files named by EXTRA_FILE arguments into the image root directory.
+
+Use --loader ARCH=FILE (repeatable) to install loaders for several UEFI
+architectures under their default names: x64, ia32, aa64 and riscv64 are
+written as BOOTX64.EFI, BOOTIA32.EFI, BOOTAA64.EFI and BOOTRISCV64.EFI.
+When --loader is given, EFI_FILE and EFI_NAME are omitted.  Each loader's
+PE/COFF machine type must match its name.
+
+The image size defaults to a 1.44MB floppy.  Use --size to set a size in
+bytes with an optional K, M or G suffix, or 'auto' to fit the contents with
+some free space.  The FAT type is chosen from the size unless --fat selects
+12, 16 or 32.
+
+Use --add SRC[:DEST] (repeatable) to copy a host file or directory tree to
+image path DEST, creating intermediate directories:
+
+    --add grub.cfg:/EFI/ubuntu/grub.cfg --add entries:/loader/entries
+
+DEST defaults to the root directory and a DEST ending with '/' receives SRC
+under its own name.
+
+File times and the volume serial come from the clock unless --timestamp or
+the SOURCE_DATE_EPOCH environment variable fixes them, so the same inputs
+build the same image.  --serial sets the volume serial explicitly.
+
+The image is written to a temporary file beside IMAGE_FILE and renamed into
+place once complete, so a failed build leaves no partial image.  Replacing
+an existing IMAGE_FILE asks for confirmation; --force replaces it without
+asking and --no-clobber keeps it.  --backup keeps the replaced file as
+IMAGE_FILE.bak.  --dry-run reports what would be written.
+
+IMAGE_FILE '-' writes the image to stdout.
 `,
-	Args: cobra.MinimumNArgs(3),
+	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		imageFile := args[0]
-		efiFile := args[1]
-		efiName := args[2]
-		force := ViperGetBool("create.force")
-		if force {
-			err := os.Remove(imageFile)
+		options := image.EFIImageOptions{}
+		for _, spec := range ViperGetStringSlice("create.loader") {
+			loader, err := image.ParseEFILoader(spec)
 			cobra.CheckErr(err)
+			options.Loaders = append(options.Loaders, loader)
+		}
+		extraFiles := args[1:]
+		if len(options.Loaders) == 0 {
+			if len(args) < 3 {
+				cobra.CheckErr(fmt.Errorf("EFI_FILE and EFI_NAME are required without --loader"))
+			}
+			options.BootFile = args[1]
+			options.BootName = args[2]
+			extraFiles = args[3:]
 		}
-		if IsFile(imageFile) {
-			cobra.CheckErr(fmt.Errorf("file exists: %s", imageFile))
+		options.ExtraFiles = extraFiles
+		options.Files = make(map[string]string)
+		for _, spec := range ViperGetStringSlice("create.add") {
+			imagePath, hostPath, err := image.ParseFileMapping(spec)
+			cobra.CheckErr(err)
+			options.Files[imagePath] = hostPath
 		}
-		count := len(args) - 3
-		extraFiles := make([]string, count)
-		for i := 0; i < count; i++ {
-			extraFiles[i] = args[3+i]
+		switch sizeArg := ViperGetString("create.size"); sizeArg {
+		case "":
+		case "auto":
+			options.Size = image.EFI_SIZE_AUTO
+		default:
+			size, err := image.ParseSize(sizeArg)
+			cobra.CheckErr(err)
+			options.Size = size
 		}
-		err := image.CreateEFIImage(imageFile, efiFile, efiName, extraFiles)
+		fatType, err := image.ParseFATType(ViperGetString("create.fat"))
+		cobra.CheckErr(err)
+		options.FATType = fatType
+		options.Stamp, err = buildStamp("create")
+		cobra.CheckErr(err)
+		options.Progress = progressFunc()
+		var ok bool
+		options.Output, ok = prepareOutput("create", imageFile)
+		if !ok {
+			return
+		}
+		if imageFile == STDIO {
+			w, err := stdoutImage()
+			cobra.CheckErr(err)
+			_, err = image.WriteEFIImage(cmd.Context(), w, options)
+			cobra.CheckErr(err)
+			return
+		}
+		err = image.BuildEFIImage(cmd.Context(), imageFile, options)
 		cobra.CheckErr(err)
 	},
 }
 
+// OptionBuildStamp adds the reproducible build options to cmd
+func OptionBuildStamp(cmd *cobra.Command) {
+	OptionString(cmd, "timestamp", "", "", "fixed timestamp as Unix seconds or RFC 3339 (default $SOURCE_DATE_EPOCH)")
+	OptionString(cmd, "serial", "", "", "fixed FAT volume serial as XXXX-XXXX hex")
+}
+
+// OptionBackup adds the option keeping a replaced output file to cmd
+func OptionBackup(cmd *cobra.Command) {
+	OptionSwitch(cmd, "backup", "", "keep a replaced output file with a "+image.BACKUP_SUFFIX+" suffix")
+}
+
+// buildStamp returns the stamp set by the OptionBuildStamp options of command name
+func buildStamp(name string) (image.BuildStamp, error) {
+	stamp := image.BuildStamp{}
+	if timestamp := ViperGetString(name + ".timestamp"); timestamp != "" {
+		var err error
+		stamp.Timestamp, err = image.ParseTimestamp(timestamp)
+		if err != nil {
+			return stamp, err
+		}
+	}
+	if serial := ViperGetString(name + ".serial"); serial != "" {
+		var err error
+		stamp.VolumeSerial, err = image.ParseVolumeSerial(serial)
+		if err != nil {
+			return stamp, err
+		}
+	}
+	return stamp, nil
+}
+
 func init() {
 	rootCmd.AddCommand(createCmd)
-	OptionSwitch(createCmd, "force", "f", "bypass confirmation prompt")
+	OptionOverwrite(createCmd)
+	OptionString(createCmd, "size", "s", "", "image size in bytes with optional K/M/G suffix, or 'auto'")
+	OptionString(createCmd, "fat", "", "auto", "FAT type: 12, 16, 32 or auto")
+	OptionStringArray(createCmd, "loader", "l", []string{}, "EFI loader as ARCH=FILE (repeatable)")
+	OptionStringArray(createCmd, "add", "a", []string{}, "copy host file or directory as SRC[:DEST] (repeatable)")
+	OptionBuildStamp(createCmd)
+	OptionBackup(createCmd)
 }
@@ -0,0 +1,121 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff A B",
+	Short: "compare the files of two images",
+	Long: `
+Compare the files of two images or directories and report each added,
+removed or modified file.  Either operand may be a FAT, ISO or disk image
+or a host directory, so an ISO can be compared with the directory it was
+extracted to.
+
+Each change is printed as CHANGE PATH followed by the size and SHA-256 of
+the file on each side.  Files are modified if their type, size, content or
+symlink target differ.  --text adds a unified diff of each modified text
+file, such as autoexec.ipxe, and --ignore-case matches paths regardless of
+case, as FAT and plain ISO9660 names are.
+
+For partitioned disk images, --partition-a and --partition-b select the
+partition of each operand by number or by name or filesystem label.
+
+The exit status is nonzero if the operands differ.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		options := image.DiffOptions{
+			PartitionA: diffSelector(ViperGetString("diff.partition-a")),
+			PartitionB: diffSelector(ViperGetString("diff.partition-b")),
+			IgnoreCase: ViperGetBool("diff.ignore-case"),
+			Text:       ViperGetBool("diff.text"),
+		}
+		report, err := image.DiffImages(args[0], args[1], options)
+		cobra.CheckErr(err)
+		if ViperGetBool("diff.json") {
+			fmt.Println(FormatJSON(report))
+		} else {
+			for _, change := range report.Changes {
+				fmt.Printf("%-8s %s\n", change.Change, change.Path)
+				if change.KindA != "" {
+					fmt.Println("  " + formatDiffSide(report.A, change.KindA, change.SizeA, change.SHA256A, change.TargetA))
+				}
+				if change.KindB != "" {
+					fmt.Println("  " + formatDiffSide(report.B, change.KindB, change.SizeB, change.SHA256B, change.TargetB))
+				}
+				if change.Diff != "" {
+					fmt.Print(change.Diff)
+				}
+			}
+			fmt.Printf("%d added, %d removed, %d modified, %d unchanged\n", report.Added, report.Removed, report.Modified, report.Unchanged)
+		}
+		if len(report.Changes) > 0 {
+			cobra.CheckErr(fmt.Errorf("%s and %s differ", args[0], args[1]))
+		}
+	},
+}
+
+// diffSelector returns a partition selector for a partition number or label
+func diffSelector(value string) image.PartitionSelector {
+	index, err := strconv.Atoi(value)
+	if err == nil && index > 0 {
+		return image.PartitionSelector{Index: index}
+	}
+	return image.PartitionSelector{Label: value}
+}
+
+// formatDiffSide describes one side of a change
+func formatDiffSide(name, kind string, size int64, hash, target string) string {
+	switch kind {
+	case image.FILE_KIND_FILE:
+		return fmt.Sprintf("%s: %d %s", name, size, hash)
+	case image.FILE_KIND_SYMLINK:
+		return fmt.Sprintf("%s: symlink -> %s", name, target)
+	}
+	return fmt.Sprintf("%s: %s", name, kind)
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	OptionSwitch(diffCmd, "json", "j", "output JSON")
+	OptionSwitch(diffCmd, "text", "u", "show unified diffs of modified text files")
+	OptionSwitch(diffCmd, "ignore-case", "i", "match paths case-insensitively")
+	OptionString(diffCmd, "partition-a", "", "", "select partition of A by number or label")
+	OptionString(diffCmd, "partition-b", "", "", "select partition of B by number or label")
+}
@@ -33,7 +33,10 @@ package cmd
 import (
 	"fmt"
 	"github.com/rstms/fdimage/image"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -43,29 +46,134 @@ var extractCmd = &cobra.Command{
 	Short: "extract files from image",
 	Long: `
 Extract all files from a disk image to directory DEST_DIR.
+
+Use --include to extract only files matching a glob pattern and --exclude
+to skip files or directories; both may be repeated.  A pattern without a
+'/' matches the file name, otherwise it matches the full image path and
+'**' matches any number of directories:
+
+    fdimage extract -i autoexec.ipxe -i '/EFI/**/*.EFI' netboot.iso out
+
+Entries that would be written outside DEST_DIR are refused.  Rock Ridge
+symlinks and device nodes are skipped unless --symlinks or --devices is
+set to 'error'.  With --symlinks=create the links are recreated as-is;
+later files are never written through a link that leaves DEST_DIR.
+
+By default extracted files get default permissions and the current time.
+--preserve-times, --preserve-mode and --preserve-owner carry over the
+Rock Ridge or FAT timestamps, permission bits and (as root) uid/gid;
+--preserve selects all three.
+
+For a partitioned disk image, --partition or --partition-label selects
+the filesystem to extract.
+
+Extracting over existing files asks for confirmation; --force replaces them
+without asking and --no-clobber keeps them.  --dry-run reports the files
+that would be written or replaced.  DEST_DIR is created if missing.
+
+IMAGE_FILE '-' reads the image from stdin.
 `,
 	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 		imageFile := args[0]
 		destDir := args[1]
-		force := ViperGetBool("extract.force")
-		if force {
-			if IsDir(destDir) {
-				err := os.RemoveAll(destDir)
-				cobra.CheckErr(err)
-			}
-			err := os.Mkdir(destDir, 0700)
+		checkOverwriteOptions("extract")
+		symlinks, err := image.ParseSpecialFilePolicy(ViperGetString("extract.symlinks"))
+		cobra.CheckErr(err)
+		devices, err := image.ParseSpecialFilePolicy(ViperGetString("extract.devices"))
+		cobra.CheckErr(err)
+		selector, err := partitionSelector("extract")
+		cobra.CheckErr(err)
+		preserve := ViperGetBool("extract.preserve")
+		options := image.ExtractOptions{
+			Symlinks:      symlinks,
+			Devices:       devices,
+			Include:       ViperGetStringSlice("extract.include"),
+			Exclude:       ViperGetStringSlice("extract.exclude"),
+			PreserveTimes: preserve || ViperGetBool("extract.preserve-times"),
+			PreserveMode:  preserve || ViperGetBool("extract.preserve-mode"),
+			PreserveOwner: preserve || ViperGetBool("extract.preserve-owner"),
+			Partition:     selector,
+			NoClobber:     ViperGetBool("extract.no-clobber"),
+			Progress:      progressFunc(),
+		}
+		var r io.ReaderAt
+		var size int64
+		var files []string
+		if imageFile == STDIO {
+			var close func()
+			r, size, close, err = stdinImage()
 			cobra.CheckErr(err)
+			defer close()
+			files, err = image.PlanExtractReader(r, size, options)
+		} else {
+			files, err = image.PlanExtract(imageFile, options)
 		}
-		if !IsDir(destDir) {
-			cobra.CheckErr(fmt.Errorf("not a directory: %s", destDir))
+		cobra.CheckErr(err)
+		if !prepareExtract(destDir, files) {
+			return
+		}
+		if imageFile == STDIO {
+			err = image.ExtractReader(cmd.Context(), r, size, destDir, options)
+			cobra.CheckErr(err)
+			return
 		}
-		err := image.ExtractImageFiles(imageFile, destDir)
+		err = image.ExtractImage(cmd.Context(), imageFile, destDir, options)
 		cobra.CheckErr(err)
 	},
 }
 
+// prepareExtract applies the OptionOverwrite options of the extract command to the host paths of the
+// image files planned for destDir, creating destDir if needed. It returns false if nothing is to be
+// extracted: --dry-run reports the files instead, and the prompt to replace existing files may be declined.
+func prepareExtract(destDir string, files []string) bool {
+	dryRun := ViperGetBool("extract.dry-run")
+	noClobber := ViperGetBool("extract.no-clobber")
+	stat, err := os.Stat(destDir)
+	switch {
+	case os.IsNotExist(err):
+		if dryRun {
+			fmt.Printf("would create directory %s\n", destDir)
+		} else {
+			err = os.Mkdir(destDir, 0700)
+			cobra.CheckErr(err)
+		}
+	case err != nil:
+		cobra.CheckErr(err)
+	case !stat.IsDir():
+		cobra.CheckErr(fmt.Errorf("not a directory: %s", destDir))
+	}
+	existing := 0
+	for _, file := range files {
+		hostPath := filepath.Join(destDir, filepath.FromSlash(strings.TrimPrefix(file, "/")))
+		_, err := os.Lstat(hostPath)
+		exists := err == nil
+		if exists {
+			existing++
+		}
+		if dryRun {
+			reportWrite(hostPath, exists, noClobber)
+		}
+	}
+	if dryRun {
+		return false
+	}
+	if existing == 0 || noClobber {
+		return true
+	}
+	return confirmChange("extract", fmt.Sprintf("Replace %d existing files in '%s'", existing, destDir))
+}
+
 func init() {
 	rootCmd.AddCommand(extractCmd)
-	OptionSwitch(extractCmd, "force", "f", "bypass confirmation prompt")
+	OptionOverwrite(extractCmd)
+	OptionString(extractCmd, "symlinks", "", "skip", "symlink policy: skip, error or create")
+	OptionString(extractCmd, "devices", "", "skip", "device node policy: skip or error")
+	OptionStringArray(extractCmd, "include", "i", []string{}, "extract only files matching glob pattern")
+	OptionStringArray(extractCmd, "exclude", "x", []string{}, "skip files matching glob pattern")
+	OptionSwitch(extractCmd, "preserve", "p", "preserve times, mode and owner")
+	OptionSwitch(extractCmd, "preserve-times", "", "preserve modification and access times")
+	OptionSwitch(extractCmd, "preserve-mode", "", "preserve permission bits")
+	OptionSwitch(extractCmd, "preserve-owner", "", "preserve uid and gid when running as root")
+	OptionPartition(extractCmd)
 }
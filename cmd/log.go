@@ -0,0 +1,71 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+	"log"
+	"log/slog"
+)
+
+// initImageLog sends the image package diagnostics to the log destination chosen by --logfile. Only
+// warnings are shown by default; --verbose adds each operation and --debug adds each file.
+func initImageLog() {
+	level := slog.LevelWarn
+	if ViperGetBool("verbose") {
+		level = slog.LevelInfo
+	}
+	if ViperGetBool("debug") {
+		level = slog.LevelDebug
+	}
+	handler := slog.NewTextHandler(log.Writer(), &slog.HandlerOptions{
+		Level:     level,
+		AddSource: ViperGetBool("debug"),
+	})
+	image.SetLogger(slog.New(handler))
+}
+
+// progressFunc returns a progress callback writing a line to the log for each file copied, or nil
+// unless --verbose is set
+func progressFunc() image.ProgressFunc {
+	if !ViperGetBool("verbose") {
+		return nil
+	}
+	files := 0
+	return func(p image.Progress) {
+		if p.Files == files {
+			return
+		}
+		files = p.Files
+		fmt.Fprintf(log.Writer(), "[%d/%d] %d/%d bytes %s\n", p.Files, p.TotalFiles, p.Bytes, p.TotalBytes, p.Path)
+	}
+}
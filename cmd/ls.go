@@ -33,6 +33,7 @@ package cmd
 import (
 	"fmt"
 	"github.com/rstms/fdimage/image"
+	"path"
 
 	"github.com/spf13/cobra"
 )
@@ -41,19 +42,123 @@ var lsCmd = &cobra.Command{
 	Use:   "ls IMAGE_FILE",
 	Short: "list files in image",
 	Long: `
-List all filenames in a disk image filesystem."
+List all filenames in a disk image filesystem.
+
+With --long each entry shows its mode, size and modification time, the
+FAT attributes and short name, or the ISO extent sector and Rock Ridge
+owner.  --json writes the entries as a JSON array and --tree draws the
+directory hierarchy.
+
+For a partitioned disk image, --partition selects a partition by number
+and --partition-label by GPT name or filesystem label; the label ESP
+selects the EFI System partition.
+
+IMAGE_FILE '-' reads the image from stdin.
 `,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		imageFile := args[0]
-		files, err := image.ListImageFiles(imageFile)
+		selector, err := partitionSelector("ls")
 		cobra.CheckErr(err)
-		for _, file := range files {
-			fmt.Println(file)
+		listEntries := func() ([]image.Entry, error) {
+			return image.ListPartitionEntries(imageFile, selector)
+		}
+		listFiles := func() ([]string, error) {
+			return image.ListPartitionFiles(imageFile, selector)
+		}
+		if imageFile == STDIO {
+			r, size, close, err := stdinImage()
+			cobra.CheckErr(err)
+			defer close()
+			listEntries = func() ([]image.Entry, error) {
+				return image.ListReaderEntries(r, size, selector)
+			}
+			listFiles = func() ([]string, error) {
+				return image.ListReaderFiles(r, size, selector)
+			}
+		}
+		switch {
+		case ViperGetBool("ls.json"), ViperGetBool("ls.long"), ViperGetBool("ls.tree"):
+			entries, err := listEntries()
+			cobra.CheckErr(err)
+			switch {
+			case ViperGetBool("ls.json"):
+				fmt.Println(FormatJSON(entries))
+			case ViperGetBool("ls.tree"):
+				printTree(entries)
+			default:
+				for _, entry := range entries {
+					fmt.Println(formatLong(&entry))
+				}
+			}
+		default:
+			files, err := listFiles()
+			cobra.CheckErr(err)
+			for _, file := range files {
+				fmt.Println(file)
+			}
 		}
 	},
 }
 
+// formatLong returns an ls -l style line for entry
+func formatLong(entry *image.Entry) string {
+	line := fmt.Sprintf("%s %10d %s", entry.Mode, entry.Size, entry.ModTime.Format("2006-01-02 15:04"))
+	switch {
+	case entry.ShortName != "":
+		line += fmt.Sprintf(" %s %-12s", entry.AttributeString(), entry.ShortName)
+	case entry.Location != 0:
+		line += fmt.Sprintf(" @%-8d", entry.Location)
+	}
+	if entry.UID != nil && entry.GID != nil {
+		line += fmt.Sprintf(" %5d %5d", *entry.UID, *entry.GID)
+	}
+	line += " " + entry.Path
+	if entry.IsDir {
+		line += "/"
+	}
+	if entry.Symlink != "" {
+		line += " -> " + entry.Symlink
+	}
+	return line
+}
+
+// printTree draws the entries as an indented directory tree
+func printTree(entries []image.Entry) {
+	children := make(map[string][]image.Entry)
+	for _, entry := range entries {
+		parent := path.Dir(entry.Path)
+		children[parent] = append(children[parent], entry)
+	}
+	fmt.Println("/")
+	printTreeLevel(children, "/", "")
+}
+
+func printTreeLevel(children map[string][]image.Entry, dir, prefix string) {
+	entries := children[dir]
+	for i, entry := range entries {
+		branch, indent := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, indent = "└── ", "    "
+		}
+		name := entry.Name
+		if entry.IsDir {
+			name += "/"
+		}
+		if entry.Symlink != "" {
+			name += " -> " + entry.Symlink
+		}
+		fmt.Println(prefix + branch + name)
+		if entry.IsDir {
+			printTreeLevel(children, entry.Path, prefix+indent)
+		}
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(lsCmd)
+	OptionSwitch(lsCmd, "long", "l", "long listing format")
+	OptionSwitch(lsCmd, "json", "j", "output JSON")
+	OptionSwitch(lsCmd, "tree", "t", "output directory tree")
+	OptionPartition(lsCmd)
 }
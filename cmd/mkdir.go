@@ -0,0 +1,71 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+
+	"github.com/spf13/cobra"
+)
+
+var mkdirCmd = &cobra.Command{
+	Use:   "mkdir IMAGE_FILE PATH",
+	Short: "create directory in FAT image",
+	Long: `
+Create directory PATH, and any missing parent directories, in an existing
+FAT image in place.  --dry-run lists the directories that would be created.
+
+ISO9660 images are read-only and are refused.  Use --partition or
+--partition-label to modify a partition of a disk image.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		selector, err := partitionSelector("mkdir")
+		cobra.CheckErr(err)
+		if ViperGetBool("mkdir.dry-run") {
+			dirs, err := image.PlanMakeImageDir(args[0], selector, args[1])
+			cobra.CheckErr(err)
+			for _, dir := range dirs {
+				fmt.Printf("would create directory %s\n", dir)
+			}
+			return
+		}
+		err = image.MakeImageDir(args[0], selector, args[1])
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mkdirCmd)
+	OptionDryRun(mkdirCmd)
+	OptionPartition(mkdirCmd)
+}
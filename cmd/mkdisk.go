@@ -0,0 +1,152 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+
+	"github.com/spf13/cobra"
+)
+
+var mkdiskCmd = &cobra.Command{
+	Use:   "mkdisk IMAGE_FILE [EFI_FILE EFI_NAME] [EXTRA_FILE ...]",
+	Short: "create partitioned disk image with an EFI System Partition",
+	Long: `
+Create a raw disk image for a VM or USB drive in IMAGE_FILE.  The first
+partition is a FAT EFI System Partition populated like the create command:
+EFI_FILE is copied to /EFI/BOOT/{EFI_NAME}, or each --loader ARCH=FILE to
+its default name, EXTRA_FILE arguments to the root directory and each
+--add SRC[:DEST] file or directory tree to DEST.
+
+The disk has a GPT with a protective MBR unless --no-protective-mbr is set;
+--table mbr writes an MBR instead.  Partitions are aligned to 1MB.
+
+--esp-size sets the ESP size with an optional K, M or G suffix, or 'auto'
+to fit its contents; the default is a 1.44MB filesystem.  --fat and --label
+set the ESP FAT type and volume label.
+
+Use --data (repeatable) to add a FAT data partition filled from a host
+directory:
+
+    --data DIR[,name=NAME][,label=LABEL][,size=SIZE][,fat=TYPE]
+
+Data partitions are sized to fit their contents unless size is given.  The
+disk size fits the partitions unless --size sets a larger one.
+
+--timestamp or SOURCE_DATE_EPOCH fixes the file times, volume serials and
+GPT GUIDs for reproducible output; --serial sets the ESP volume serial and
+data partitions use the following serials.
+
+The disk is written to a temporary file beside IMAGE_FILE and renamed into
+place once complete.  Replacing an existing IMAGE_FILE asks for confirmation;
+--force replaces it without asking and --no-clobber keeps it.  --backup
+keeps the replaced file as IMAGE_FILE.bak.  --dry-run reports what would be
+written.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		imageFile := args[0]
+		options := image.DiskImageOptions{
+			Table:           ViperGetString("mkdisk.table"),
+			NoProtectiveMBR: ViperGetBool("mkdisk.no-protective-mbr"),
+		}
+		for _, spec := range ViperGetStringSlice("mkdisk.loader") {
+			loader, err := image.ParseEFILoader(spec)
+			cobra.CheckErr(err)
+			options.ESP.Loaders = append(options.ESP.Loaders, loader)
+		}
+		extraFiles := args[1:]
+		if len(options.ESP.Loaders) == 0 {
+			if len(args) < 3 {
+				cobra.CheckErr(fmt.Errorf("EFI_FILE and EFI_NAME are required without --loader"))
+			}
+			options.ESP.BootFile = args[1]
+			options.ESP.BootName = args[2]
+			extraFiles = args[3:]
+		}
+		options.ESP.ExtraFiles = extraFiles
+		options.ESP.Files = make(map[string]string)
+		for _, spec := range ViperGetStringSlice("mkdisk.add") {
+			imagePath, hostPath, err := image.ParseFileMapping(spec)
+			cobra.CheckErr(err)
+			options.ESP.Files[imagePath] = hostPath
+		}
+		switch sizeArg := ViperGetString("mkdisk.esp-size"); sizeArg {
+		case "":
+		case "auto":
+			options.ESP.Size = image.EFI_SIZE_AUTO
+		default:
+			size, err := image.ParseSize(sizeArg)
+			cobra.CheckErr(err)
+			options.ESP.Size = size
+		}
+		fatType, err := image.ParseFATType(ViperGetString("mkdisk.fat"))
+		cobra.CheckErr(err)
+		options.ESP.FATType = fatType
+		options.ESP.VolumeLabel = ViperGetString("mkdisk.label")
+		for _, spec := range ViperGetStringSlice("mkdisk.data") {
+			partition, err := image.ParseDiskPartition(spec)
+			cobra.CheckErr(err)
+			options.Partitions = append(options.Partitions, partition)
+		}
+		if sizeArg := ViperGetString("mkdisk.size"); sizeArg != "" {
+			options.Size, err = image.ParseSize(sizeArg)
+			cobra.CheckErr(err)
+		}
+		options.Stamp, err = buildStamp("mkdisk")
+		cobra.CheckErr(err)
+		options.Progress = progressFunc()
+		var ok bool
+		options.Output, ok = prepareOutput("mkdisk", imageFile)
+		if !ok {
+			return
+		}
+		err = image.BuildDiskImage(cmd.Context(), imageFile, options)
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mkdiskCmd)
+	OptionOverwrite(mkdiskCmd)
+	OptionString(mkdiskCmd, "table", "t", "gpt", "partition table: gpt or mbr")
+	OptionSwitch(mkdiskCmd, "no-protective-mbr", "", "omit the protective MBR of a GPT disk")
+	OptionString(mkdiskCmd, "size", "s", "", "disk size in bytes with optional K/M/G suffix")
+	OptionString(mkdiskCmd, "esp-size", "", "", "ESP size in bytes with optional K/M/G suffix, or 'auto'")
+	OptionString(mkdiskCmd, "fat", "", "auto", "ESP FAT type: 12, 16, 32 or auto")
+	OptionString(mkdiskCmd, "label", "", "", "ESP volume label")
+	OptionStringArray(mkdiskCmd, "loader", "l", []string{}, "EFI loader as ARCH=FILE (repeatable)")
+	OptionStringArray(mkdiskCmd, "add", "a", []string{}, "copy host file or directory to the ESP as SRC[:DEST] (repeatable)")
+	OptionStringArray(mkdiskCmd, "data", "d", []string{}, "data partition as DIR[,name=NAME][,label=LABEL][,size=SIZE][,fat=TYPE] (repeatable)")
+	OptionBuildStamp(mkdiskCmd)
+	OptionBackup(mkdiskCmd)
+}
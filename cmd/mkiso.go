@@ -31,8 +31,8 @@ POSSIBILITY OF SUCH DAMAGE.
 package cmd
 
 import (
-	"fmt"
 	"github.com/rstms/fdimage/image"
+	"io"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -42,29 +42,91 @@ var mkisoCmd = &cobra.Command{
 	Use:   "mkiso OUTPUT_FILE SRC_ISO_FILE AUTOEXEC_FILE",
 	Short: "generate boot ISO with modified autoexec.ipxe",
 	Long: `
-    foo
+Write OUTPUT_FILE as a copy of SRC_ISO_FILE with /autoexec.ipxe replaced
+in both the ISO filesystem and its EFI boot image.
+
+With --hybrid an isohybrid MBR is written so the output can be copied
+directly to USB media; --gpt also writes a GPT with an EFI System
+Partition entry pointing at the El Torito EFI boot image.  BIOS boot from
+USB uses the isohybrid boot code of SRC_ISO_FILE; if it has none, the
+output boots from USB only through EFI.
+
+--timestamp or SOURCE_DATE_EPOCH fixes every ISO and EFI image timestamp,
+the EFI image volume serial and the GPT GUIDs for reproducible output.
+
+The ISO is written to a temporary file beside OUTPUT_FILE and renamed into
+place once complete.  Replacing an existing OUTPUT_FILE asks for
+confirmation; --force replaces it without asking and --no-clobber keeps it.
+--backup keeps the replaced file as OUTPUT_FILE.bak.  --dry-run reports
+what would be written.
+
+OUTPUT_FILE '-' writes the ISO to stdout and SRC_ISO_FILE '-' reads the
+source ISO from stdin.
 `,
 	Args: cobra.ExactArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
 		outputFile := args[0]
 		imageFile := args[1]
 		autoexecFile := args[2]
-		force := ViperGetBool("mkiso.force")
-		if force {
-			if IsFile(outputFile) {
-				err := os.Remove(outputFile)
-				cobra.CheckErr(err)
-			}
+		options := image.ISOBuildOptions{
+			Files:     map[string]string{"/autoexec.ipxe": autoexecFile},
+			EFIFiles:  map[string]string{"/autoexec.ipxe": autoexecFile},
+			Hybrid:    ViperGetBool("mkiso.hybrid"),
+			HybridGPT: ViperGetBool("mkiso.gpt"),
+		}
+		var err error
+		options.Stamp, err = buildStamp("mkiso")
+		cobra.CheckErr(err)
+		options.Progress = progressFunc()
+		var ok bool
+		options.Output, ok = prepareOutput("mkiso", outputFile)
+		if !ok {
+			return
+		}
+		if outputFile != STDIO && imageFile != STDIO {
+			err = image.BuildISOImage(cmd.Context(), outputFile, imageFile, options)
+			cobra.CheckErr(err)
+			return
+		}
+		var src io.ReaderAt
+		var srcSize int64
+		if imageFile == STDIO {
+			r, size, close, err := stdinImage()
+			cobra.CheckErr(err)
+			defer close()
+			src, srcSize = r, size
+		} else {
+			fp, err := os.Open(imageFile)
+			cobra.CheckErr(err)
+			defer fp.Close()
+			stat, err := fp.Stat()
+			cobra.CheckErr(err)
+			src, srcSize = fp, stat.Size()
 		}
-		if IsFile(outputFile) {
-			cobra.CheckErr(fmt.Errorf("file exists: %s", outputFile))
+		if outputFile == STDIO {
+			w, err := stdoutImage()
+			cobra.CheckErr(err)
+			_, err = image.WriteISOImage(cmd.Context(), w, src, srcSize, options)
+			cobra.CheckErr(err)
+			return
+		}
+		out, err := image.CreateOutputFile(outputFile, options.Output)
+		cobra.CheckErr(err)
+		_, err = image.WriteISOImage(cmd.Context(), out, src, srcSize, options)
+		if err == nil {
+			err = out.Commit()
 		}
-		err := image.CreateISOImage(outputFile, imageFile, autoexecFile)
+		// cobra.CheckErr exits without running defers
+		out.Abort()
 		cobra.CheckErr(err)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(mkisoCmd)
-	OptionSwitch(mkisoCmd, "force", "f", "bypass confirmation prompt")
+	OptionOverwrite(mkisoCmd)
+	OptionSwitch(mkisoCmd, "hybrid", "", "write isohybrid MBR for USB media")
+	OptionSwitch(mkisoCmd, "gpt", "", "write isohybrid GPT with EFI System Partition")
+	OptionBuildStamp(mkisoCmd)
+	OptionBackup(mkisoCmd)
 }
@@ -0,0 +1,134 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// OptionOverwrite adds the options choosing how cmd treats existing output to cmd
+func OptionOverwrite(cmd *cobra.Command) {
+	OptionSwitch(cmd, "force", "f", "replace existing output without a confirmation prompt")
+	OptionSwitch(cmd, "no-clobber", "n", "keep existing output without a confirmation prompt")
+	OptionDryRun(cmd)
+}
+
+// OptionDryRun adds the option reporting the changes cmd would make to cmd
+func OptionDryRun(cmd *cobra.Command) {
+	OptionSwitch(cmd, "dry-run", "", "report what would be written, replaced or removed without changing anything")
+}
+
+// checkOverwriteOptions refuses conflicting OptionOverwrite options of command name
+func checkOverwriteOptions(name string) {
+	if ViperGetBool(name+".force") && ViperGetBool(name+".no-clobber") {
+		cobra.CheckErr(fmt.Errorf("--force and --no-clobber are mutually exclusive"))
+	}
+}
+
+// confirmChange returns true if command name may replace or remove what prompt describes. --force and
+// --no-clobber answer without asking; the prompt needs stdin to be a terminal.
+func confirmChange(name, prompt string) bool {
+	if ViperGetBool(name + ".force") {
+		return true
+	}
+	if ViperGetBool(name + ".no-clobber") {
+		return false
+	}
+	// a character device such as /dev/null is not a terminal to answer the prompt
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		options := "--force"
+		if cmd, _, err := rootCmd.Find([]string{name}); err == nil && cmd.Flags().Lookup("no-clobber") != nil {
+			options += " or --no-clobber"
+		}
+		cobra.CheckErr(fmt.Errorf("%s: no terminal to confirm; use %s", prompt, options))
+	}
+	return Confirm(prompt)
+}
+
+// prepareOutput applies the OptionOverwrite and OptionBackup options of command name to the output file
+// target. It returns false if nothing is to be written: --dry-run reports the write instead, and an
+// existing target is kept with --no-clobber or when the prompt is declined.
+func prepareOutput(name, target string) (image.OutputOptions, bool) {
+	checkOverwriteOptions(name)
+	options := image.OutputOptions{
+		Overwrite: ViperGetBool(name + ".force"),
+		Backup:    ViperGetBool(name + ".backup"),
+	}
+	_, err := os.Lstat(target)
+	exists := err == nil
+	if target == STDIO {
+		exists = false
+	}
+	if ViperGetBool(name + ".dry-run") {
+		switch {
+		case target == STDIO:
+			fmt.Println("would write image to stdout")
+		case !exists:
+			fmt.Printf("would write %s\n", target)
+		case ViperGetBool(name + ".no-clobber"):
+			fmt.Printf("would keep existing %s\n", target)
+		case options.Backup:
+			fmt.Printf("would replace %s, keeping %s%s\n", target, target, image.BACKUP_SUFFIX)
+		default:
+			fmt.Printf("would replace %s\n", target)
+		}
+		return options, false
+	}
+	if !exists {
+		return options, true
+	}
+	if !confirmChange(name, fmt.Sprintf("Replace existing file '%s'", target)) {
+		if ViperGetBool("verbose") {
+			log.Printf("kept existing %s\n", target)
+		}
+		return options, false
+	}
+	options.Overwrite = true
+	return options, true
+}
+
+// reportWrite prints the --dry-run report for writing path, which is kept if it exists and noClobber is set
+func reportWrite(path string, exists, noClobber bool) {
+	switch {
+	case !exists:
+		fmt.Printf("would write %s\n", path)
+	case noClobber:
+		fmt.Printf("would keep existing %s\n", path)
+	default:
+		fmt.Printf("would replace %s\n", path)
+	}
+}
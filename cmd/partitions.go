@@ -0,0 +1,90 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var partitionsCmd = &cobra.Command{
+	Use:   "partitions IMAGE_FILE",
+	Short: "list image partitions",
+	Long: `
+List the GPT partitions of a disk image, or its MBR partitions if it has
+no GPT.  The number in the first column selects the partition for the
+--partition option of the ls, extract, cat, add, rm and mkdir commands.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		partitions, err := image.ReadPartitions(args[0])
+		cobra.CheckErr(err)
+		if ViperGetBool("partitions.json") {
+			fmt.Println(FormatJSON(partitions))
+			return
+		}
+		for _, p := range partitions {
+			typeName := p.TypeName
+			if typeName == "" {
+				typeName = p.Type
+			}
+			fmt.Printf("%2d %s %12d %12d %-16s %s\n", p.Index, p.Table, p.Start, p.Size, typeName, p.Name)
+		}
+	},
+}
+
+// OptionPartition adds the partition selector options to cmd
+func OptionPartition(cmd *cobra.Command) {
+	OptionString(cmd, "partition", "P", "", "select partition by number")
+	OptionString(cmd, "partition-label", "L", "", "select partition by name or filesystem label; ESP selects the EFI System partition")
+}
+
+// partitionSelector returns the partition chosen by the OptionPartition options of command name
+func partitionSelector(name string) (image.PartitionSelector, error) {
+	selector := image.PartitionSelector{Label: ViperGetString(name + ".partition-label")}
+	index := ViperGetString(name + ".partition")
+	if index != "" {
+		var err error
+		selector.Index, err = strconv.Atoi(index)
+		if err != nil || selector.Index < 1 {
+			return selector, fmt.Errorf("invalid partition number: %s", index)
+		}
+	}
+	return selector, nil
+}
+
+func init() {
+	rootCmd.AddCommand(partitionsCmd)
+	OptionSwitch(partitionsCmd, "json", "j", "output JSON")
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+
+	"github.com/spf13/cobra"
+)
+
+var rmCmd = &cobra.Command{
+	Use:   "rm IMAGE_FILE PATH",
+	Short: "remove file from FAT image",
+	Long: `
+Delete the file or empty directory PATH from an existing FAT image in
+place.  With --recursive, non-empty directories are deleted with their
+contents.
+
+Removal asks for confirmation unless --force is set.  --dry-run lists the
+files and directories that would be removed.
+
+ISO9660 images are read-only and are refused.  Use --partition or
+--partition-label to modify a partition of a disk image.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		imageFile := args[0]
+		imagePath := args[1]
+		selector, err := partitionSelector("rm")
+		cobra.CheckErr(err)
+		paths, err := image.PlanRemoveImageFile(imageFile, selector, imagePath, ViperGetBool("rm.recursive"))
+		cobra.CheckErr(err)
+		if ViperGetBool("rm.dry-run") {
+			for _, p := range paths {
+				fmt.Printf("would remove %s\n", p)
+			}
+			return
+		}
+		prompt := fmt.Sprintf("Remove '%s' from '%s'", imagePath, imageFile)
+		if len(paths) > 1 {
+			prompt = fmt.Sprintf("Remove '%s' and %d entries below it from '%s'", imagePath, len(paths)-1, imageFile)
+		}
+		if !confirmChange("rm", prompt) {
+			return
+		}
+		err = image.RemoveImageFile(imageFile, selector, imagePath, ViperGetBool("rm.recursive"))
+		cobra.CheckErr(err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rmCmd)
+	OptionSwitch(rmCmd, "recursive", "r", "remove directories and their contents")
+	OptionSwitch(rmCmd, "force", "f", "remove without a confirmation prompt")
+	OptionDryRun(rmCmd)
+	OptionPartition(rmCmd)
+}
@@ -31,7 +31,10 @@ POSSIBILITY OF SUCH DAMAGE.
 package cmd
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -50,13 +53,21 @@ to quickly create a Cobra application.`,
 }
 
 func Execute() {
-	err := rootCmd.Execute()
+	// an interrupt cancels the running command, which removes its partial output; a second one
+	// terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err := rootCmd.ExecuteContext(ctx)
 	if err != nil {
 		os.Exit(1)
 	}
 }
 func init() {
-	cobra.OnInitialize(InitConfig)
+	cobra.OnInitialize(InitConfig, initImageLog)
 	OptionString(rootCmd, "logfile", "", "", "log filename")
 	OptionString(rootCmd, "config", "c", "", "config file")
 	OptionSwitch(rootCmd, "debug", "", "produce debug output")
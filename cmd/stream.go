@@ -0,0 +1,107 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// STDIO is the IMAGE_FILE or OUTPUT_FILE argument naming stdin or stdout
+const STDIO = "-"
+
+// stdinImage returns stdin as a random access image and its size. A regular file redirected to stdin
+// is read in place; a pipe is spooled to an unlinked temporary file, which close releases.
+func stdinImage() (io.ReaderAt, int64, func(), error) {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if stat.Mode().IsRegular() {
+		return os.Stdin, stat.Size(), func() {}, nil
+	}
+	fp, err := os.CreateTemp("", "fdimage*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	// unlink now so the spool is reclaimed even when cobra.CheckErr exits without running defers
+	err = os.Remove(fp.Name())
+	if err != nil {
+		fp.Close()
+		return nil, 0, nil, err
+	}
+	close := func() {
+		fp.Close()
+	}
+	size, err := io.Copy(fp, os.Stdin)
+	if err != nil {
+		close()
+		return nil, 0, nil, fmt.Errorf("failed reading image from stdin: %v", err)
+	}
+	if ViperGetBool("verbose") {
+		log.Printf("spooled stdin: %d bytes\n", size)
+	}
+	return fp, size, close, nil
+}
+
+// stdoutImage returns stdout as the destination of an image writer, refusing a terminal or stdout
+// already taken by the log
+func stdoutImage() (io.WriterAt, error) {
+	stat, err := os.Stdout.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Mode()&os.ModeCharDevice != 0 {
+		return nil, fmt.Errorf("refusing to write image to a terminal")
+	}
+	if logfile := ViperGetString("logfile"); logfile == "stdout" || logfile == STDIO {
+		return nil, fmt.Errorf("cannot write image to stdout while logging to stdout")
+	}
+	return &streamWriter{w: os.Stdout}, nil
+}
+
+// streamWriter adapts a stream to io.WriterAt for writers that write their output in order; hiding
+// the ReadAt and Seek methods of stdout makes the image writers spool instead of building in place
+type streamWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (s *streamWriter) WriteAt(p []byte, offset int64) (int, error) {
+	if offset != s.offset {
+		return 0, fmt.Errorf("out of order write to stream at offset %d", offset)
+	}
+	n, err := s.w.Write(p)
+	s.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var sumCmd = &cobra.Command{
+	Use:   "sum IMAGE_FILE",
+	Short: "output checksums of image files",
+	Long: `
+Output a checksum for each file in an image in sha256sum format, with
+paths relative to the image root, so the list can also be checked against
+an extracted copy with sha256sum -c.
+
+--algorithm selects sha256 (the default), sha512 or blake2b; blake2b lines
+match the default output of b2sum.
+
+--check MANIFEST reads a saved checksum list and verifies the image
+against it.  Each file is reported as OK, FAILED, MISSING (listed but not
+in the image) or UNLISTED (in the image but not listed); with --quiet only
+problems are printed.  The exit status is nonzero unless every file is OK.
+
+For a partitioned disk image, --partition selects a partition by number
+and --partition-label by GPT name or filesystem label.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		imageFile := args[0]
+		selector, err := partitionSelector("sum")
+		cobra.CheckErr(err)
+		algorithm := ViperGetString("sum.algorithm")
+		manifestFile := ViperGetString("sum.check")
+		if manifestFile == "" {
+			hashes, err := image.HashPartitionContents(imageFile, selector, algorithm)
+			cobra.CheckErr(err)
+			for _, h := range hashes {
+				fmt.Println(h.String())
+			}
+			return
+		}
+		fp, err := os.Open(manifestFile)
+		cobra.CheckErr(err)
+		defer fp.Close()
+		manifest, err := image.ReadHashManifest(fp, algorithm)
+		if err != nil {
+			cobra.CheckErr(fmt.Errorf("%s: %v", manifestFile, err))
+		}
+		results, err := image.CheckContents(imageFile, selector, manifest, algorithm)
+		cobra.CheckErr(err)
+		failed := 0
+		for _, result := range results {
+			if result.Status != image.CHECK_OK {
+				failed++
+			} else if ViperGetBool("sum.quiet") {
+				continue
+			}
+			fmt.Printf("%s: %s\n", result.Path[1:], result.Status)
+		}
+		if failed > 0 {
+			cobra.CheckErr(fmt.Errorf("%s: %d of %d files failed check", imageFile, failed, len(results)))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sumCmd)
+	OptionString(sumCmd, "algorithm", "a", image.HASH_SHA256, "hash algorithm: sha256, sha512 or blake2b")
+	OptionString(sumCmd, "check", "", "", "verify image against checksum manifest")
+	OptionSwitch(sumCmd, "quiet", "q", "with --check, print only files that fail")
+	OptionPartition(sumCmd)
+}
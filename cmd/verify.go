@@ -0,0 +1,80 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/fdimage/image"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify IMAGE_FILE",
+	Short: "check image filesystem structures",
+	Long: `
+Check the structure of a FAT image, an ISO9660 image or the FAT partitions
+of a disk image and report each problem found.
+
+FAT checks cover the BIOS parameter block, the cluster count and FAT size,
+agreement between the FAT copies, cluster chains (invalid links, loops and
+cross-linked clusters), file sizes against their chains and lost clusters.
+
+ISO checks cover the volume descriptor set and its terminator, the primary
+volume descriptor, directory records and file extents within the image,
+the El Torito catalog checksum and that each boot image can be read.  EFI
+boot images are checked as FAT filesystems.
+
+Findings are printed as SEVERITY: VOLUME: CHECK: [PATH:] MESSAGE.  The exit
+status is nonzero if any error is found; warnings alone do not fail.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := image.VerifyImage(args[0])
+		cobra.CheckErr(err)
+		if ViperGetBool("verify.json") {
+			fmt.Println(FormatJSON(report))
+		} else {
+			for _, finding := range report.Findings {
+				fmt.Println(finding.String())
+			}
+			fmt.Printf("%s: %s: %d errors, %d warnings\n", report.Image, report.Format, report.Errors, report.Warnings)
+		}
+		if !report.OK() {
+			cobra.CheckErr(fmt.Errorf("%s failed verification", args[0]))
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	OptionSwitch(verifyCmd, "json", "j", "output JSON")
+}
@@ -0,0 +1,186 @@
+package image
+
+import (
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem"
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// BootReport describes the boot structures of an image file
+type BootReport struct {
+	Image string `json:"image"`
+	Size  int64  `json:"size"`
+	// Format is iso9660, FAT12, FAT16, FAT32 or unknown
+	Format string `json:"format"`
+	Label  string `json:"label,omitempty"`
+	// CatalogSector is the ISO sector of the El Torito boot catalog
+	CatalogSector uint32             `json:"catalog_sector,omitempty"`
+	Entries       []*BootReportEntry `json:"entries,omitempty"`
+	// Isohybrid is true if an ISO image also carries an MBR or GPT partition table
+	Isohybrid bool         `json:"isohybrid"`
+	MBR       []*Partition `json:"mbr,omitempty"`
+	GPT       []*Partition `json:"gpt,omitempty"`
+	// Loaders are the EFI loaders of a FAT image
+	Loaders     []*LoaderReport `json:"loaders,omitempty"`
+	LoaderError string          `json:"loader_error,omitempty"`
+}
+
+// BootReportEntry describes one El Torito boot catalog entry
+type BootReportEntry struct {
+	Platform    string `json:"platform"`
+	Emulation   string `json:"emulation"`
+	Bootable    bool   `json:"bootable"`
+	LoadSegment uint16 `json:"load_segment"`
+	SystemType  uint8  `json:"system_type"`
+	SectorCount uint16 `json:"sector_count"`
+	LoadRBA     uint32 `json:"load_rba"`
+	Size        int64  `json:"size"`
+	Path        string `json:"path,omitempty"`
+	BootTable   bool   `json:"boot_table"`
+	// Loaders are the EFI loaders found in an EFI boot image
+	Loaders     []*LoaderReport `json:"loaders,omitempty"`
+	LoaderError string          `json:"loader_error,omitempty"`
+}
+
+// LoaderReport describes an EFI loader found in /EFI/BOOT
+type LoaderReport struct {
+	Path  string `json:"path"`
+	Arch  string `json:"arch,omitempty"`
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// BootInfo reports the El Torito entries, partition tables and EFI loaders of an image file
+func BootInfo(imageFilename string) (*BootReport, error) {
+	fp, err := os.Open(imageFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	stat, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	report := BootReport{
+		Image:  imageFilename,
+		Size:   stat.Size(),
+		Format: "unknown",
+	}
+
+	fat, err := readFAT(readOnlyDevice{fp}, 0, report.Size)
+	if err == nil {
+		report.Format = fat.FATType().String()
+		report.Label = fat.Label()
+		report.Loaders, err = efiLoaderReports(fat)
+		if err != nil {
+			report.LoaderError = err.Error()
+		}
+		return &report, nil
+	}
+
+	report.MBR, err = readMBRPartitions(fp)
+	if err != nil {
+		return nil, err
+	}
+	report.GPT, err = readGPTPartitions(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isISO9660(fp) {
+		return &report, nil
+	}
+	report.Format = "iso9660"
+	report.Isohybrid = report.MBR != nil || report.GPT != nil
+	fs, err := iso9660.Read(fp, report.Size, 0, ISO_LOGICAL_BLOCK_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	report.Label = strings.TrimSpace(strings.Trim(fs.Label(), "\x00"))
+	catalog, err := readBootCatalog(fp, fs)
+	if err != nil {
+		return nil, err
+	}
+	if catalog == nil {
+		return &report, nil
+	}
+	report.CatalogSector = catalog.Location
+	for _, entry := range catalog.Entries {
+		reportEntry := BootReportEntry{
+			Platform:    PlatformName(entry.Platform),
+			Emulation:   EmulationName(entry.Emulation),
+			Bootable:    entry.Bootable,
+			LoadSegment: entry.LoadSegment,
+			SystemType:  entry.SystemType,
+			SectorCount: entry.SectorCount,
+			LoadRBA:     entry.LoadRBA,
+			Size:        entry.Size,
+			Path:        entry.Path,
+			BootTable:   entry.BootTable,
+		}
+		if entry.Platform == iso9660.EFI {
+			offset := int64(entry.LoadRBA) * ISO_LOGICAL_BLOCK_SIZE
+			section := io.NewSectionReader(fp, offset, entry.Size)
+			fat, err := readFAT(readOnlyDevice{section}, 0, entry.Size)
+			if err == nil {
+				reportEntry.Loaders, err = efiLoaderReports(fat)
+			}
+			if err != nil {
+				reportEntry.LoaderError = err.Error()
+			}
+		}
+		report.Entries = append(report.Entries, &reportEntry)
+	}
+	return &report, nil
+}
+
+// isISO9660 returns true if r holds an ISO9660 primary volume descriptor
+func isISO9660(r io.ReaderAt) bool {
+	descriptor := make([]byte, 8)
+	_, err := r.ReadAt(descriptor, ISO_SYSTEM_AREA_SECTORS*ISO_LOGICAL_BLOCK_SIZE)
+	return err == nil && string(descriptor[1:6]) == "CD001"
+}
+
+// efiLoaderReports validates each /EFI/BOOT/*.EFI loader in fs
+func efiLoaderReports(fs filesystem.FileSystem) ([]*LoaderReport, error) {
+	entries, err := fs.ReadDir(EFI_BOOT_DIR)
+	if err != nil {
+		return nil, fmt.Errorf("no %s directory", EFI_BOOT_DIR)
+	}
+	reports := []*LoaderReport{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.ToUpper(path.Ext(entry.Name())) != ".EFI" {
+			continue
+		}
+		report := LoaderReport{Path: path.Join(EFI_BOOT_DIR, entry.Name())}
+		fp, err := fs.OpenFile(report.Path, os.O_RDONLY)
+		if err == nil {
+			report.Arch, _ = EFILoaderArch(fp)
+			err = ValidateEFILoader(fp, report.Path)
+			fp.Close()
+		}
+		if err != nil {
+			report.Error = err.Error()
+		} else {
+			report.Valid = true
+		}
+		reports = append(reports, &report)
+	}
+	if len(reports) == 0 {
+		return nil, fmt.Errorf("no EFI loader in %s", EFI_BOOT_DIR)
+	}
+	return reports, nil
+}
+
+// readOnlyDevice adapts an io.ReaderAt to a fatDevice that refuses writes
+type readOnlyDevice struct {
+	io.ReaderAt
+}
+
+func (d readOnlyDevice) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, fmt.Errorf("image is read-only")
+}
@@ -0,0 +1,98 @@
+package image
+
+import (
+	"github.com/rstms/go-diskfs/partition/mbr"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBootInfo(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+	report, err := BootInfo(isoImage)
+	require.Nil(t, err)
+	require.Equal(t, "iso9660", report.Format)
+	require.Equal(t, "NETBOOT", report.Label)
+	require.False(t, report.Isohybrid)
+	require.Nil(t, report.MBR)
+	require.Nil(t, report.GPT)
+	require.Len(t, report.Entries, 2)
+
+	bios := report.Entries[0]
+	require.Equal(t, "BIOS", bios.Platform)
+	require.Equal(t, "none", bios.Emulation)
+	require.True(t, bios.Bootable)
+	require.Equal(t, int64(4096), bios.Size)
+	require.Nil(t, bios.Loaders)
+
+	efi := report.Entries[1]
+	require.Equal(t, "EFI", efi.Platform)
+	require.Equal(t, "/esp.img", efi.Path)
+	require.NotZero(t, efi.LoadRBA)
+	require.Equal(t, "", efi.LoaderError)
+	require.Len(t, efi.Loaders, 1)
+	require.Equal(t, &LoaderReport{Path: "/EFI/BOOT/BOOTX64.EFI", Arch: "x64", Valid: true}, efi.Loaders[0])
+
+	// an MBR in the system area makes the ISO a hybrid image
+	fp, err := os.OpenFile(isoImage, os.O_RDWR, 0)
+	require.Nil(t, err)
+	table := mbr.Table{
+		LogicalSectorSize:  512,
+		PhysicalSectorSize: 512,
+		Partitions:         []*mbr.Partition{{Bootable: true, Type: mbr.Iso9660, Start: 0, Size: 8 * 2048}},
+	}
+	err = table.Write(fp, 8*1024*1024)
+	require.Nil(t, err)
+	fp.Close()
+	report, err = BootInfo(isoImage)
+	require.Nil(t, err)
+	require.True(t, report.Isohybrid)
+	require.Len(t, report.MBR, 1)
+	require.Equal(t, "0x96", report.MBR[0].Type)
+	require.Equal(t, int64(8*1024*1024), report.MBR[0].Size)
+	require.True(t, report.MBR[0].Bootable)
+	require.Len(t, report.Entries, 2)
+}
+
+func TestBootInfoFAT(t *testing.T) {
+	dir := t.TempDir()
+	efiImage := filepath.Join(dir, "efi.img")
+	err := BuildEFIImage(t.Context(), efiImage, EFIImageOptions{
+		Loaders:     []EFILoader{{Arch: "aa64", File: mkTestPE(t, dir, "aa64.efi", 0xaa64, 4096)}},
+		VolumeLabel: "ESP",
+	})
+	require.Nil(t, err)
+	report, err := BootInfo(efiImage)
+	require.Nil(t, err)
+	require.Equal(t, "FAT12", report.Format)
+	require.Equal(t, "ESP", report.Label)
+	require.False(t, report.Isohybrid)
+	require.Nil(t, report.MBR)
+	require.Len(t, report.Loaders, 1)
+	require.True(t, report.Loaders[0].Valid)
+	require.Equal(t, "aa64", report.Loaders[0].Arch)
+
+	// a loader that is not a PE image is reported invalid
+	fs, v, err := openWritableFAT(efiImage, PartitionSelector{})
+	require.Nil(t, err)
+	defer v.Close()
+	err = copyFileToImage(t.Context(), fs, "/EFI/BOOT/BOOTX64.EFI", mkTestFile(t, dir, "text.efi", "not a loader"), nil)
+	require.Nil(t, err)
+	report, err = BootInfo(efiImage)
+	require.Nil(t, err)
+	require.Len(t, report.Loaders, 2)
+	require.True(t, report.Loaders[0].Valid)
+	require.False(t, report.Loaders[1].Valid)
+	require.Contains(t, report.Loaders[1].Error, "MZ header not found")
+
+	// an empty FAT image has no loaders
+	emptyImage := filepath.Join(dir, "empty.img")
+	err = BuildEFIImage(t.Context(), emptyImage, EFIImageOptions{})
+	require.Nil(t, err)
+	report, err = BootInfo(emptyImage)
+	require.Nil(t, err)
+	require.Nil(t, report.Loaders)
+	require.Equal(t, "no /EFI/BOOT directory", report.LoaderError)
+}
@@ -0,0 +1,330 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DIFF_ADDED    = "added"
+	DIFF_REMOVED  = "removed"
+	DIFF_MODIFIED = "modified"
+	// DIFF_TEXT_MAX is the largest file shown as a unified diff
+	DIFF_TEXT_MAX = 1024 * 1024
+	// DIFF_CONTEXT is the default number of unified diff context lines
+	DIFF_CONTEXT = 3
+)
+
+// Kinds of files compared by DiffImages
+const (
+	FILE_KIND_FILE    = "file"
+	FILE_KIND_DIR     = "dir"
+	FILE_KIND_SYMLINK = "symlink"
+	FILE_KIND_SPECIAL = "special"
+)
+
+// DiffOptions selects how DiffImages compares two file trees
+type DiffOptions struct {
+	// PartitionA and PartitionB select the partitions of image operands
+	PartitionA PartitionSelector
+	PartitionB PartitionSelector
+	// IgnoreCase matches paths case-insensitively, as FAT and plain ISO9660 names are
+	IgnoreCase bool
+	// Text adds a unified diff to each modified text file
+	Text bool
+	// Context is the number of unified diff context lines; 0 selects DIFF_CONTEXT
+	Context int
+}
+
+// FileChange is a file or directory that differs between two trees
+type FileChange struct {
+	// Change is DIFF_ADDED, DIFF_REMOVED or DIFF_MODIFIED
+	Change string `json:"change"`
+	Path   string `json:"path"`
+	// KindA and KindB are the FILE_KIND of each side, empty where the path is missing
+	KindA string `json:"kind_a,omitempty"`
+	KindB string `json:"kind_b,omitempty"`
+	SizeA int64  `json:"size_a"`
+	SizeB int64  `json:"size_b"`
+	// SHA256A and SHA256B are the content hashes of regular files
+	SHA256A string `json:"sha256_a,omitempty"`
+	SHA256B string `json:"sha256_b,omitempty"`
+	// TargetA and TargetB are symlink targets
+	TargetA string `json:"target_a,omitempty"`
+	TargetB string `json:"target_b,omitempty"`
+	// Diff is the unified diff of a modified text file
+	Diff string `json:"diff,omitempty"`
+}
+
+// DiffReport lists the differences between two images or directories
+type DiffReport struct {
+	A         string        `json:"a"`
+	B         string        `json:"b"`
+	Changes   []*FileChange `json:"changes"`
+	Added     int           `json:"added"`
+	Removed   int           `json:"removed"`
+	Modified  int           `json:"modified"`
+	Unchanged int           `json:"unchanged"`
+}
+
+// diffEntry is a file or directory of a compared tree
+type diffEntry struct {
+	path   string
+	kind   string
+	size   int64
+	target string
+}
+
+// diffTree is an image filesystem or host directory being compared
+type diffTree struct {
+	name    string
+	entries []*diffEntry
+	open    func(p string) (io.ReadCloser, error)
+	close   func()
+}
+
+// DiffImages compares the files of a and b, each an image file or a host directory. Paths present in
+// only one tree are added or removed; files are modified if their kind, size, content or symlink
+// target differ.
+func DiffImages(a, b string, options DiffOptions) (*DiffReport, error) {
+	treeA, err := openDiffTree(a, options.PartitionA)
+	if err != nil {
+		return nil, err
+	}
+	defer treeA.close()
+	treeB, err := openDiffTree(b, options.PartitionB)
+	if err != nil {
+		return nil, err
+	}
+	defer treeB.close()
+	if options.Context == 0 {
+		options.Context = DIFF_CONTEXT
+	}
+
+	key := func(p string) string {
+		if options.IgnoreCase {
+			return strings.ToUpper(p)
+		}
+		return p
+	}
+	entriesA := make(map[string]*diffEntry)
+	for _, entry := range treeA.entries {
+		entriesA[key(entry.path)] = entry
+	}
+	entriesB := make(map[string]*diffEntry)
+	for _, entry := range treeB.entries {
+		entriesB[key(entry.path)] = entry
+	}
+	keys := sortedKeys(entriesA)
+	for k := range entriesB {
+		if entriesA[k] == nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	report := DiffReport{A: a, B: b, Changes: []*FileChange{}}
+	for _, k := range keys {
+		entryA, entryB := entriesA[k], entriesB[k]
+		change := FileChange{}
+		if entryA != nil {
+			change.Path = entryA.path
+			change.KindA, change.SizeA, change.TargetA = entryA.kind, entryA.size, entryA.target
+		}
+		if entryB != nil {
+			change.Path = entryB.path
+			change.KindB, change.SizeB, change.TargetB = entryB.kind, entryB.size, entryB.target
+		}
+		var dataA, dataB []byte
+		readText := options.Text && change.KindA == FILE_KIND_FILE && change.KindB == FILE_KIND_FILE &&
+			change.SizeA <= DIFF_TEXT_MAX && change.SizeB <= DIFF_TEXT_MAX
+		if change.KindA == FILE_KIND_FILE {
+			change.SHA256A, dataA, err = treeA.hash(entryA.path, readText)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if change.KindB == FILE_KIND_FILE {
+			change.SHA256B, dataB, err = treeB.hash(entryB.path, readText)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case entryA == nil:
+			change.Change = DIFF_ADDED
+			report.Added++
+		case entryB == nil:
+			change.Change = DIFF_REMOVED
+			report.Removed++
+		case change.KindA != change.KindB || change.SizeA != change.SizeB ||
+			change.SHA256A != change.SHA256B || change.TargetA != change.TargetB:
+			change.Change = DIFF_MODIFIED
+			report.Modified++
+			if readText && isText(dataA) && isText(dataB) {
+				change.Diff, err = unifiedDiff(treeA.name, treeB.name, change.Path, dataA, dataB, options.Context)
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			report.Unchanged++
+			continue
+		}
+		report.Changes = append(report.Changes, &change)
+	}
+	return &report, nil
+}
+
+// openDiffTree lists the files of a host directory or of the image partition chosen by selector
+func openDiffTree(name string, selector PartitionSelector) (*diffTree, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return openDirDiffTree(name)
+	}
+	v, err := openVolume(name, selector)
+	if err != nil {
+		return nil, err
+	}
+	isoEntries, err := v.isoEntries()
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+	entries, err := walkEntries(v.fs, "/", isoEntries)
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+	tree := diffTree{
+		name: name,
+		open: func(p string) (io.ReadCloser, error) {
+			return v.fs.OpenFile(p, os.O_RDONLY)
+		},
+		close: func() { v.Close() },
+	}
+	for _, entry := range entries {
+		e := diffEntry{path: entry.Path, kind: FILE_KIND_FILE, size: entry.Size, target: entry.Symlink}
+		switch {
+		case entry.IsDir:
+			e.kind = FILE_KIND_DIR
+		case entry.Symlink != "":
+			e.kind = FILE_KIND_SYMLINK
+			e.size = 0
+		case isSpecialFile(isoEntries[entry.Path]):
+			e.kind = FILE_KIND_SPECIAL
+		}
+		tree.entries = append(tree.entries, &e)
+	}
+	return &tree, nil
+}
+
+// openDirDiffTree lists the files below a host directory
+func openDirDiffTree(dir string) (*diffTree, error) {
+	tree := diffTree{
+		name: dir,
+		open: func(p string) (io.ReadCloser, error) {
+			return os.Open(filepath.Join(dir, filepath.FromSlash(p)))
+		},
+		close: func() {},
+	}
+	err := filepath.WalkDir(dir, func(hostPath string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if hostPath == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, hostPath)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := diffEntry{path: path.Join("/", filepath.ToSlash(rel)), kind: FILE_KIND_FILE}
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			e.kind = FILE_KIND_DIR
+		case mode&os.ModeSymlink != 0:
+			e.kind = FILE_KIND_SYMLINK
+			e.target, err = os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			e.size = info.Size()
+		default:
+			e.kind = FILE_KIND_SPECIAL
+		}
+		tree.entries = append(tree.entries, &e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tree, nil
+}
+
+// hash returns the SHA-256 of a file in the tree, and its content if keep is set
+func (t *diffTree) hash(p string, keep bool) (string, []byte, error) {
+	r, err := t.open(p)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %s: %v", t.name, p, err)
+	}
+	defer r.Close()
+	h := sha256.New()
+	var data bytes.Buffer
+	w := io.Writer(h)
+	if keep {
+		w = io.MultiWriter(h, &data)
+	}
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %s: %v", t.name, p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), data.Bytes(), nil
+}
+
+// isText returns true if data is UTF-8 without NUL bytes
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// unifiedDiff returns the unified diff of two versions of a text file
+func unifiedDiff(nameA, nameB, p string, a, b []byte, context int) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        diffLines(a),
+		B:        diffLines(b),
+		FromFile: nameA + ":" + p,
+		ToFile:   nameB + ":" + p,
+		Context:  context,
+	})
+}
+
+// diffLines splits text into newline terminated lines for a unified diff, marking a last line without a
+// newline the way diff -u does. difflib.SplitLines adds an empty last line to text ending in a newline.
+func diffLines(text []byte) []string {
+	lines := strings.SplitAfter(string(text), "\n")
+	last := len(lines) - 1
+	if lines[last] == "" {
+		return lines[:last]
+	}
+	lines[last] += "\n\\ No newline at end of file\n"
+	return lines
+}
@@ -0,0 +1,110 @@
+package image
+
+import (
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// findChange returns the change reported for p, or nil
+func findChange(report *DiffReport, p string) *FileChange {
+	for _, change := range report.Changes {
+		if change.Path == p {
+			return change
+		}
+	}
+	return nil
+}
+
+func TestDiffISO(t *testing.T) {
+	dir := t.TempDir()
+	sourceISO := mkTestISO(t, dir)
+	extractDir := filepath.Join(dir, "extract")
+	err := os.Mkdir(extractDir, 0700)
+	require.Nil(t, err)
+	err = ExtractImageFiles(t.Context(), sourceISO, extractDir)
+	require.Nil(t, err)
+
+	report, err := DiffImages(sourceISO, extractDir, DiffOptions{})
+	require.Nil(t, err)
+	require.Empty(t, report.Changes)
+	require.Equal(t, 5, report.Unchanged)
+
+	// change the iPXE script, drop the readme and add a file to the extracted tree
+	mkTestFile(t, extractDir, "autoexec.ipxe", "#!ipxe\necho modified\n")
+	err = os.Remove(filepath.Join(extractDir, "docs", "readme.txt"))
+	require.Nil(t, err)
+	mkTestFile(t, extractDir, "added.txt", "new file\n")
+
+	report, err = DiffImages(sourceISO, extractDir, DiffOptions{Text: true})
+	require.Nil(t, err)
+	require.Equal(t, 1, report.Added)
+	require.Equal(t, 1, report.Removed)
+	require.Equal(t, 1, report.Modified)
+
+	added := findChange(report, "/added.txt")
+	require.NotNil(t, added)
+	require.Equal(t, DIFF_ADDED, added.Change)
+	require.Equal(t, int64(9), added.SizeB)
+	require.Len(t, added.SHA256B, 64)
+	require.Empty(t, added.KindA)
+
+	removed := findChange(report, "/docs/readme.txt")
+	require.NotNil(t, removed)
+	require.Equal(t, DIFF_REMOVED, removed.Change)
+	require.Equal(t, int64(19), removed.SizeA)
+
+	modified := findChange(report, "/autoexec.ipxe")
+	require.NotNil(t, modified)
+	require.Equal(t, DIFF_MODIFIED, modified.Change)
+	require.NotEqual(t, modified.SHA256A, modified.SHA256B)
+	expected := "--- " + sourceISO + ":/autoexec.ipxe\n" +
+		"+++ " + extractDir + ":/autoexec.ipxe\n" +
+		"@@ -1,2 +1,2 @@\n" +
+		" #!ipxe\n" +
+		"-echo source\n" +
+		"+echo modified\n"
+	require.Equal(t, expected, modified.Diff)
+
+	// a last line without a newline is marked as diff -u marks it
+	diff, err := unifiedDiff("a", "b", "/x", []byte("one\ntwo\n"), []byte("one\ntwo"), DIFF_CONTEXT)
+	require.Nil(t, err)
+	require.Equal(t, "--- a:/x\n+++ b:/x\n@@ -1,2 +1,2 @@\n one\n-two\n+two\n\\ No newline at end of file\n", diff)
+
+	// binary files are compared by hash only
+	mkTestFile(t, extractDir, "isolinux.bin", strings.Repeat("L", 4095)+"\x00")
+	report, err = DiffImages(sourceISO, extractDir, DiffOptions{Text: true})
+	require.Nil(t, err)
+	modified = findChange(report, "/isolinux.bin")
+	require.NotNil(t, modified)
+	require.Equal(t, DIFF_MODIFIED, modified.Change)
+	require.Empty(t, modified.Diff)
+}
+
+func TestDiffFAT(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"/autoexec.ipxe": mkTestFile(t, dir, "autoexec.ipxe", "#!ipxe\nchain boot.ipxe\n"),
+	}
+	efiImage := filepath.Join(dir, "efi.img")
+	err := BuildEFIImage(t.Context(), efiImage, EFIImageOptions{Files: files})
+	require.Nil(t, err)
+
+	isoImage := buildTestISO(t, dir, "files.iso", map[string]string{"/AUTOEXEC.IPXE": files["/autoexec.ipxe"]}, []*iso9660.ElToritoEntry{})
+
+	report, err := DiffImages(efiImage, isoImage, DiffOptions{})
+	require.Nil(t, err)
+	require.Equal(t, 1, report.Added)
+	require.Equal(t, 1, report.Removed)
+
+	report, err = DiffImages(efiImage, isoImage, DiffOptions{IgnoreCase: true})
+	require.Nil(t, err)
+	require.Empty(t, report.Changes)
+	require.Equal(t, 1, report.Unchanged)
+
+	_, err = DiffImages(efiImage, filepath.Join(dir, "missing.img"), DiffOptions{})
+	require.NotNil(t, err)
+}
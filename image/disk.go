@@ -0,0 +1,297 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"github.com/rstms/go-diskfs/partition/gpt"
+	"github.com/rstms/go-diskfs/partition/mbr"
+	"os"
+	"strings"
+)
+
+const (
+	// DISK_ALIGN is the alignment of partitions in a disk image
+	DISK_ALIGN         = 1024 * 1024
+	DISK_TABLE_GPT     = "gpt"
+	DISK_TABLE_MBR     = "mbr"
+	MBR_MAX_PARTITIONS = 4
+	ESP_PARTITION_NAME = "EFI System"
+)
+
+// DiskPartition describes a FAT data partition of a disk image
+type DiskPartition struct {
+	// Name is the GPT partition name
+	Name string
+	// SourceDir is a host directory copied to the partition root
+	SourceDir string
+	// Size is the partition size in bytes; 0 or EFI_SIZE_AUTO fits the contents plus EFI_AUTO_SLACK
+	Size int64
+	// FATType selects the FAT variant; FATAuto picks the smallest variant valid for the size
+	FATType FATType
+	// VolumeLabel is the FAT volume label
+	VolumeLabel string
+}
+
+// DiskImageOptions describes a partitioned disk image with an EFI System Partition
+type DiskImageOptions struct {
+	// Table is DISK_TABLE_GPT or DISK_TABLE_MBR; the default is GPT
+	Table string
+	// NoProtectiveMBR omits the protective MBR ahead of a GPT
+	NoProtectiveMBR bool
+	// ESP describes the contents, size and format of the EFI System Partition
+	ESP EFIImageOptions
+	// Partitions are data partitions following the ESP
+	Partitions []DiskPartition
+	// Size is the disk size in bytes; 0 fits the partitions
+	Size int64
+	// Stamp fixes the timestamps, volume serials and GUIDs for reproducible output; ESP.Stamp is not used
+	Stamp BuildStamp
+	// Progress receives the files and bytes copied into all partitions; ESP.Progress is not used
+	Progress ProgressFunc
+	// Output selects whether BuildDiskImage replaces an existing image file; ESP.Output is not used
+	Output OutputOptions
+}
+
+// ParseDiskPartition converts a DIR[,name=NAME][,label=LABEL][,size=SIZE][,fat=TYPE] specification
+// to a DiskPartition
+func ParseDiskPartition(spec string) (DiskPartition, error) {
+	fields := strings.Split(spec, ",")
+	p := DiskPartition{SourceDir: fields[0]}
+	if p.SourceDir == "" {
+		return p, fmt.Errorf("missing partition directory: %s", spec)
+	}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return p, fmt.Errorf("invalid partition option (expected KEY=VALUE): %s", field)
+		}
+		var err error
+		switch strings.ToLower(key) {
+		case "name":
+			p.Name = value
+		case "label":
+			p.VolumeLabel = value
+		case "size":
+			if value != "auto" {
+				p.Size, err = ParseSize(value)
+			}
+		case "fat":
+			p.FATType, err = ParseFATType(value)
+		default:
+			err = fmt.Errorf("unknown partition option: %s", key)
+		}
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// diskVolume is a FAT filesystem planned for a disk image partition
+type diskVolume struct {
+	name    string
+	label   string
+	esp     bool
+	tree    *imageTree
+	fatType FATType
+	start   int64
+	size    int64
+}
+
+// BuildDiskImage writes a GPT or MBR partitioned disk image to imageFilename holding a FAT EFI System
+// Partition populated like BuildEFIImage, followed by optional FAT data partitions
+func BuildDiskImage(ctx context.Context, imageFilename string, options DiskImageOptions) error {
+	logger().Info("building disk image", "image", imageFilename, "table", options.Table)
+
+	switch options.Table {
+	case "":
+		options.Table = DISK_TABLE_GPT
+	case DISK_TABLE_GPT, DISK_TABLE_MBR:
+	default:
+		return fmt.Errorf("unknown partition table type: %s", options.Table)
+	}
+	if options.Table == DISK_TABLE_MBR && len(options.Partitions)+1 > MBR_MAX_PARTITIONS {
+		return fmt.Errorf("an MBR holds at most %d partitions", MBR_MAX_PARTITIONS)
+	}
+	stamp, err := options.Stamp.resolve()
+	if err != nil {
+		return err
+	}
+
+	espTree, err := efiImageTree(options.ESP)
+	if err != nil {
+		return err
+	}
+	esp, err := planDiskVolume(espTree, options.ESP.Size, options.ESP.FATType)
+	if err != nil {
+		return fmt.Errorf("EFI System Partition: %v", err)
+	}
+	esp.name = ESP_PARTITION_NAME
+	esp.label = options.ESP.VolumeLabel
+	esp.esp = true
+	volumes := []*diskVolume{esp}
+	for _, p := range options.Partitions {
+		tree := newImageTree()
+		err := tree.add("/", p.SourceDir)
+		if err != nil {
+			return err
+		}
+		size := p.Size
+		if size == 0 {
+			size = EFI_SIZE_AUTO
+		}
+		v, err := planDiskVolume(tree, size, p.FATType)
+		if err != nil {
+			return fmt.Errorf("partition %s: %v", p.SourceDir, err)
+		}
+		v.name = p.Name
+		v.label = p.VolumeLabel
+		volumes = append(volumes, v)
+	}
+
+	start := int64(DISK_ALIGN)
+	for _, v := range volumes {
+		if v.size%PARTITION_SECTOR_SIZE != 0 {
+			return fmt.Errorf("partition size must be a multiple of %d: %d", PARTITION_SECTOR_SIZE, v.size)
+		}
+		v.start = start
+		start = alignUp(start+v.size, DISK_ALIGN)
+	}
+	required := start
+	if options.Table == DISK_TABLE_GPT {
+		required = alignUp(start+GPT_BACKUP_SIZE, DISK_ALIGN)
+	}
+	size := options.Size
+	switch {
+	case size == 0:
+		size = required
+	case size%PARTITION_SECTOR_SIZE != 0:
+		return fmt.Errorf("size must be a multiple of %d: %d", PARTITION_SECTOR_SIZE, size)
+	case size < required:
+		return fmt.Errorf("partitions need a %d byte disk: %d", required, size)
+	}
+
+	trees := make([]*imageTree, len(volumes))
+	for i, v := range volumes {
+		trees[i] = v.tree
+	}
+	p, err := treeProgress(options.Progress, trees...)
+	if err != nil {
+		return err
+	}
+
+	out, err := CreateOutputFile(imageFilename, options.Output)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+	fp := out.File
+	err = fp.Truncate(size)
+	if err != nil {
+		return err
+	}
+	if options.Table == DISK_TABLE_GPT {
+		err = writeDiskGPT(fp, size, volumes, !options.NoProtectiveMBR, stamp)
+	} else {
+		err = writeDiskMBR(fp, size, volumes)
+	}
+	if err != nil {
+		return err
+	}
+
+	// each partition gets its own serial, skipping 0, which formatFAT takes as unset
+	serial := stamp.serial()
+	for _, v := range volumes {
+		if serial == 0 {
+			serial++
+		}
+		volumeStamp := stamp
+		volumeStamp.VolumeSerial = serial
+		serial++
+		fat, err := formatFAT(fp, v.start, v.size, v.fatType, v.label, volumeStamp)
+		if err != nil {
+			return err
+		}
+		logger().Info("created partition", "fat", fat.FATType(), "start", v.start, "size", v.size)
+		err = v.tree.copyTo(ctx, fat, p)
+		if err != nil {
+			return err
+		}
+	}
+	return out.Commit()
+}
+
+// planDiskVolume sizes a FAT partition for tree and resolves its FAT type
+func planDiskVolume(tree *imageTree, size int64, fatType FATType) (*diskVolume, error) {
+	contents, err := tree.sizes()
+	if err != nil {
+		return nil, err
+	}
+	size, err = resolveFATImageSize(size, fatType, contents)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := newFATLayout(size, fatType)
+	if err != nil {
+		return nil, err
+	}
+	return &diskVolume{tree: tree, size: size, fatType: layout.fatType}, nil
+}
+
+// writeDiskGPT writes a GPT with an entry for each volume
+func writeDiskGPT(fp *os.File, size int64, volumes []*diskVolume, protectiveMBR bool, stamp BuildStamp) error {
+	table := gpt.Table{
+		LogicalSectorSize:  PARTITION_SECTOR_SIZE,
+		PhysicalSectorSize: PARTITION_SECTOR_SIZE,
+		ProtectiveMBR:      protectiveMBR,
+		GUID:               stamp.guid("disk"),
+	}
+	for i, v := range volumes {
+		partitionType := gpt.MicrosoftBasicData
+		if v.esp {
+			partitionType = gpt.EFISystemPartition
+		}
+		start := uint64(v.start / PARTITION_SECTOR_SIZE)
+		table.Partitions = append(table.Partitions, &gpt.Partition{
+			Start: start,
+			End:   start + uint64(v.size/PARTITION_SECTOR_SIZE) - 1,
+			Size:  uint64(v.size),
+			Type:  partitionType,
+			Name:  v.name,
+			GUID:  stamp.guid(fmt.Sprintf("partition %d", i+1)),
+		})
+	}
+	return table.Write(fp, size)
+}
+
+// writeDiskMBR writes an MBR with an entry for each volume, marking the ESP bootable
+func writeDiskMBR(fp *os.File, size int64, volumes []*diskVolume) error {
+	table := mbr.Table{
+		LogicalSectorSize:  PARTITION_SECTOR_SIZE,
+		PhysicalSectorSize: PARTITION_SECTOR_SIZE,
+	}
+	for _, v := range volumes {
+		partitionType := mbr.EFISystem
+		if !v.esp {
+			partitionType = mbrFATType(v.fatType)
+		}
+		table.Partitions = append(table.Partitions,
+			mbrPartition(v.esp, partitionType, v.start/PARTITION_SECTOR_SIZE, v.size/PARTITION_SECTOR_SIZE))
+	}
+	return table.Write(fp, size)
+}
+
+// mbrFATType returns the MBR partition type for a FAT variant
+func mbrFATType(fatType FATType) mbr.Type {
+	switch fatType {
+	case FAT12:
+		return mbr.Fat12
+	case FAT16:
+		return mbr.Fat16bLBA
+	}
+	return mbr.Fat32LBA
+}
+
+func alignUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
@@ -0,0 +1,128 @@
+package image
+
+import (
+	"encoding/binary"
+	"github.com/rstms/go-diskfs/partition/gpt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskImage(t *testing.T) {
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	require.Nil(t, os.MkdirAll(filepath.Join(dataDir, "docs", "empty"), 0700))
+	mkTestFile(t, dataDir, "readme.txt", "data partition\n")
+	mkTestFile(t, filepath.Join(dataDir, "docs"), "notes.txt", "notes\n")
+	options := DiskImageOptions{
+		ESP: EFIImageOptions{
+			Loaders:     []EFILoader{{Arch: "x64", File: mkTestPE(t, dir, "x64.efi", 0x8664, 4096)}},
+			ExtraFiles:  []string{mkTestFile(t, dir, "autoexec.ipxe", "#!ipxe\n")},
+			Size:        EFI_SIZE_AUTO,
+			VolumeLabel: "ESP",
+		},
+		Partitions: []DiskPartition{{Name: "data", SourceDir: dataDir, VolumeLabel: "DATA"}},
+	}
+
+	gptImage := filepath.Join(dir, "gpt.img")
+	require.Nil(t, BuildDiskImage(t.Context(), gptImage, options))
+	require.Equal(t, int64(0), hostFileSize(gptImage)%DISK_ALIGN)
+	partitions, err := ReadPartitions(gptImage)
+	require.Nil(t, err)
+	require.Len(t, partitions, 2)
+	require.Equal(t, strings.ToUpper(string(gpt.EFISystemPartition)), partitions[0].Type)
+	require.Equal(t, ESP_PARTITION_NAME, partitions[0].Name)
+	require.Equal(t, int64(DISK_ALIGN), partitions[0].Start)
+	require.Equal(t, "Basic data", partitions[1].TypeName)
+	require.Equal(t, int64(0), partitions[1].Start%DISK_ALIGN)
+
+	// the protective MBR covers the disk
+	fp, err := os.Open(gptImage)
+	require.Nil(t, err)
+	mbrPartitions, err := readMBRPartitions(fp)
+	fp.Close()
+	require.Nil(t, err)
+	require.Len(t, mbrPartitions, 1)
+	require.Equal(t, "0xee", mbrPartitions[0].Type)
+
+	files, err := ListPartitionFiles(gptImage, PartitionSelector{Label: "ESP"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"/EFI/", "/EFI/BOOT/", "/EFI/BOOT/BOOTX64.EFI", "/autoexec.ipxe"}, files)
+	files, err = ListPartitionFiles(gptImage, PartitionSelector{Label: "data"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"/docs/", "/docs/empty/", "/docs/notes.txt", "/readme.txt"}, files)
+
+	// partitioned FAT filesystems record their offset as hidden sectors
+	fs, closer, err := OpenPartition(gptImage, PartitionSelector{Index: 2})
+	require.Nil(t, err)
+	defer closer.Close()
+	fat := fs.(*fatFS)
+	sector := make([]byte, FAT_SECTOR_SIZE)
+	_, err = fat.device.ReadAt(sector, fat.start)
+	require.Nil(t, err)
+	require.Equal(t, uint32(partitions[1].Start/PARTITION_SECTOR_SIZE), binary.LittleEndian.Uint32(sector[28:32]))
+
+	options.NoProtectiveMBR = true
+	bareImage := filepath.Join(dir, "bare.img")
+	require.Nil(t, BuildDiskImage(t.Context(), bareImage, options))
+	fp, err = os.Open(bareImage)
+	require.Nil(t, err)
+	mbrPartitions, err = readMBRPartitions(fp)
+	fp.Close()
+	require.Nil(t, err)
+	require.Nil(t, mbrPartitions)
+	partitions, err = ReadPartitions(bareImage)
+	require.Nil(t, err)
+	require.Len(t, partitions, 2)
+
+	options.Table = DISK_TABLE_MBR
+	mbrImage := filepath.Join(dir, "mbr.img")
+	require.Nil(t, BuildDiskImage(t.Context(), mbrImage, options))
+	partitions, err = ReadPartitions(mbrImage)
+	require.Nil(t, err)
+	require.Len(t, partitions, 2)
+	require.Equal(t, "0xef", partitions[0].Type)
+	require.True(t, partitions[0].Bootable)
+	require.Equal(t, "0x01", partitions[1].Type)
+	var readme strings.Builder
+	err = ExtractPartitionFile(mbrImage, PartitionSelector{Label: "DATA"}, "/readme.txt", &readme)
+	require.Nil(t, err)
+	require.Equal(t, "data partition\n", readme.String())
+
+	// partition serials follow the stamp serial and skip 0, which would mean unset
+	options.Stamp = BuildStamp{VolumeSerial: 0xffffffff}
+	serialImage := filepath.Join(dir, "serial.img")
+	require.Nil(t, BuildDiskImage(t.Context(), serialImage, options))
+	for index, serial := range map[int]uint32{1: 0xffffffff, 2: 1} {
+		fs, closer, err := OpenPartition(serialImage, PartitionSelector{Index: index})
+		require.Nil(t, err)
+		require.Equal(t, serial, fs.(*fatFS).serial, index)
+		require.Nil(t, closer.Close())
+	}
+	options.Stamp = BuildStamp{}
+
+	options.Size = DISK_ALIGN
+	err = BuildDiskImage(t.Context(), filepath.Join(dir, "small.img"), options)
+	require.ErrorContains(t, err, "partitions need")
+	options.Size = 0
+	options.Partitions = append(options.Partitions, options.Partitions[0], options.Partitions[0], options.Partitions[0])
+	err = BuildDiskImage(t.Context(), filepath.Join(dir, "many.img"), options)
+	require.ErrorContains(t, err, "at most 4 partitions")
+}
+
+func TestParseDiskPartition(t *testing.T) {
+	p, err := ParseDiskPartition("data,name=stuff,label=STUFF,size=8M,fat=16")
+	require.Nil(t, err)
+	require.Equal(t, DiskPartition{Name: "stuff", SourceDir: "data", Size: 8 * 1024 * 1024, FATType: FAT16, VolumeLabel: "STUFF"}, p)
+	p, err = ParseDiskPartition("data")
+	require.Nil(t, err)
+	require.Equal(t, DiskPartition{SourceDir: "data"}, p)
+	_, err = ParseDiskPartition(",name=x")
+	require.NotNil(t, err)
+	_, err = ParseDiskPartition("data,color=red")
+	require.NotNil(t, err)
+	_, err = ParseDiskPartition("data,size")
+	require.NotNil(t, err)
+}
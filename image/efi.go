@@ -0,0 +1,590 @@
+package image
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem"
+	"github.com/rstms/go-diskfs/util"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	EFI_SIZE_AUTO  = -1
+	EFI_AUTO_SLACK = 256 * 1024
+	EFI_SIZE_ALIGN = 32 * 1024
+	EFI_SIZE_MAX   = 1 << 41
+	EFI_BOOT_DIR   = "/EFI/BOOT"
+)
+
+// efiArchitectures lists the UEFI architectures with their PE machine types and default loader names
+var efiArchitectures = []struct {
+	arch     string
+	machine  uint16
+	bootName string
+}{
+	{"x64", 0x8664, "BOOTX64.EFI"},
+	{"ia32", 0x014c, "BOOTIA32.EFI"},
+	{"aa64", 0xaa64, "BOOTAA64.EFI"},
+	{"riscv64", 0x5064, "BOOTRISCV64.EFI"},
+}
+
+// EFILoader is a boot loader for one UEFI architecture
+type EFILoader struct {
+	// Arch is the UEFI architecture: x64, ia32, aa64 or riscv64
+	Arch string
+	// File is the host loader file
+	File string
+}
+
+// ParseEFILoader converts an ARCH=FILE specification to an EFILoader
+func ParseEFILoader(spec string) (EFILoader, error) {
+	arch, file, ok := strings.Cut(spec, "=")
+	if !ok || arch == "" || file == "" {
+		return EFILoader{}, fmt.Errorf("invalid loader (expected ARCH=FILE): %s", spec)
+	}
+	_, err := EFIBootName(arch)
+	if err != nil {
+		return EFILoader{}, err
+	}
+	return EFILoader{Arch: strings.ToLower(arch), File: file}, nil
+}
+
+// EFIBootName returns the default removable media loader name for a UEFI architecture
+func EFIBootName(arch string) (string, error) {
+	for _, a := range efiArchitectures {
+		if strings.EqualFold(arch, a.arch) {
+			return a.bootName, nil
+		}
+	}
+	return "", fmt.Errorf("unknown EFI architecture: %s", arch)
+}
+
+// EFILoaderArch returns the UEFI architecture of a PE/COFF loader
+func EFILoaderArch(r io.ReadSeeker) (string, error) {
+	machine, err := peMachine(r)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range efiArchitectures {
+		if a.machine == machine {
+			return a.arch, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported PE machine type: 0x%04x", machine)
+}
+
+// ValidateEFILoader returns an error if the loader is not a PE/COFF image or its machine type does not match name
+func ValidateEFILoader(r io.ReadSeeker, name string) error {
+	arch, err := EFILoaderArch(r)
+	if err != nil {
+		return fmt.Errorf("invalid EFI loader %s: %v", name, err)
+	}
+	base := strings.ToUpper(path.Base(name))
+	for _, a := range efiArchitectures {
+		if base == a.bootName && arch != a.arch {
+			return fmt.Errorf("EFI loader %s is built for %s, expected %s", name, arch, a.arch)
+		}
+	}
+	return nil
+}
+
+// validateEFILoaderFile validates a host loader file against its image name
+func validateEFILoaderFile(filename, name string) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return ValidateEFILoader(fp, name)
+}
+
+// peMachine returns the COFF machine type of a PE image
+func peMachine(r io.ReadSeeker) (uint16, error) {
+	header := make([]byte, 64)
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return 0, fmt.Errorf("MZ header not found")
+	}
+	if string(header[0:2]) != "MZ" {
+		return 0, fmt.Errorf("MZ header not found")
+	}
+	offset := int64(binary.LittleEndian.Uint32(header[0x3c:0x40]))
+	_, err = r.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	coff := make([]byte, 6)
+	_, err = io.ReadFull(r, coff)
+	if err != nil || string(coff[0:4]) != "PE\x00\x00" {
+		return 0, fmt.Errorf("PE signature not found")
+	}
+	return binary.LittleEndian.Uint16(coff[4:6]), nil
+}
+
+// EFIImageOptions describes the content and format of an EFI boot image
+type EFIImageOptions struct {
+	// BootFile is the host EFI loader written to /EFI/BOOT/<BootName>
+	BootFile string
+	// BootName is the loader filename in /EFI/BOOT, such as BOOTX64.EFI
+	BootName string
+	// Loaders are written to /EFI/BOOT under the default name for each architecture
+	Loaders []EFILoader
+	// ExtraFiles are host files or directories copied to the image root directory under their basenames
+	ExtraFiles []string
+	// Files maps image paths to host files or directories; directories are copied recursively
+	Files map[string]string
+	// Size is the image size in bytes; 0 selects EFI_IMAGE_SIZE and EFI_SIZE_AUTO fits the contents plus EFI_AUTO_SLACK
+	Size int64
+	// FATType selects the FAT variant; FATAuto picks the smallest variant valid for the size
+	FATType FATType
+	// VolumeLabel is the FAT volume label
+	VolumeLabel string
+	// Stamp fixes the timestamps and volume serial for reproducible output
+	Stamp BuildStamp
+	// Progress receives the files and bytes copied into the image
+	Progress ProgressFunc
+	// Output selects whether BuildEFIImage replaces an existing image file
+	Output OutputOptions
+}
+
+// ParseFileMapping converts a SRC[:DEST] specification to an image path and host path. DEST defaults
+// to the root directory; a DEST ending with a slash is a directory receiving SRC under its basename.
+// Since image paths never contain a colon, SRC may; a Windows drive letter is always part of SRC.
+func ParseFileMapping(spec string) (string, string, error) {
+	volume := filepath.VolumeName(spec)
+	src, dest, ok := spec, "", false
+	if i := strings.LastIndex(spec[len(volume):], ":"); i >= 0 {
+		src, dest, ok = spec[:len(volume)+i], spec[len(volume)+i+1:], true
+	}
+	if src == "" || (ok && dest == "") {
+		return "", "", fmt.Errorf("invalid file mapping (expected SRC[:DEST]): %s", spec)
+	}
+	if !ok || strings.HasSuffix(dest, "/") {
+		dest = path.Join("/", dest, filepath.Base(src))
+	}
+	return cleanImagePath(dest), src, nil
+}
+
+// BuildEFIImage writes a FAT formatted EFI boot image described by options to imageFilename
+func BuildEFIImage(ctx context.Context, imageFilename string, options EFIImageOptions) error {
+	logger().Info("building EFI image", "image", imageFilename)
+
+	tree, size, stamp, err := planEFIImage(options)
+	if err != nil {
+		return err
+	}
+	out, err := CreateOutputFile(imageFilename, options.Output)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+	fs, err := formatFATImage(out.File, size, options.FATType, options.VolumeLabel, stamp)
+	if err != nil {
+		return err
+	}
+	logger().Info("created EFI image", "fat", fs.FATType(), "size", size)
+
+	p, err := treeProgress(options.Progress, tree)
+	if err != nil {
+		return err
+	}
+	err = tree.copyTo(ctx, fs, p)
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// WriteEFIImage writes the EFI boot image described by options to w and returns its size. The image is
+// formatted in place if w also implements io.ReaderAt, with unwritten areas of w assumed to be zero;
+// otherwise it is spooled to a temporary file and copied to w.
+func WriteEFIImage(ctx context.Context, w io.WriterAt, options EFIImageOptions) (int64, error) {
+	logger().Info("writing EFI image")
+
+	tree, size, stamp, err := planEFIImage(options)
+	if err != nil {
+		return 0, err
+	}
+	p, err := treeProgress(options.Progress, tree)
+	if err != nil {
+		return 0, err
+	}
+	write := func(device fatDevice) (int64, error) {
+		err := setFileSize(device, size)
+		if err != nil {
+			return 0, err
+		}
+		fs, err := formatFAT(device, 0, size, options.FATType, options.VolumeLabel, stamp)
+		if err != nil {
+			return 0, err
+		}
+		logger().Info("created EFI image", "fat", fs.FATType(), "size", size)
+		return size, tree.copyTo(ctx, fs, p)
+	}
+	if device, ok := w.(fatDevice); ok {
+		return write(device)
+	}
+	return spoolOutput(ctx, w, func(f util.File) (int64, error) {
+		return write(f)
+	})
+}
+
+// planEFIImage returns the contents, size and resolved stamp of the EFI boot image described by options
+func planEFIImage(options EFIImageOptions) (*imageTree, int64, BuildStamp, error) {
+	tree, err := efiImageTree(options)
+	if err != nil {
+		return nil, 0, BuildStamp{}, err
+	}
+	contents, err := tree.sizes()
+	if err != nil {
+		return nil, 0, BuildStamp{}, err
+	}
+	size, err := resolveFATImageSize(options.Size, options.FATType, contents)
+	if err != nil {
+		return nil, 0, BuildStamp{}, err
+	}
+	stamp, err := options.Stamp.resolve()
+	if err != nil {
+		return nil, 0, BuildStamp{}, err
+	}
+	return tree, size, stamp, nil
+}
+
+// efiImageTree collects the contents of an EFI boot image, validating the loaders
+func efiImageTree(options EFIImageOptions) (*imageTree, error) {
+	loaders := make(map[string]string)
+	if options.BootFile != "" {
+		if options.BootName == "" {
+			return nil, fmt.Errorf("missing EFI boot file name")
+		}
+		loaders[EFI_BOOT_DIR+"/"+options.BootName] = options.BootFile
+	}
+	for _, loader := range options.Loaders {
+		bootName, err := EFIBootName(loader.Arch)
+		if err != nil {
+			return nil, err
+		}
+		name := EFI_BOOT_DIR + "/" + bootName
+		if loaders[name] != "" {
+			return nil, fmt.Errorf("duplicate EFI loader: %s", bootName)
+		}
+		loaders[name] = loader.File
+	}
+	tree := newImageTree()
+	for _, name := range sortedKeys(loaders) {
+		err := validateEFILoaderFile(loaders[name], name)
+		if err != nil {
+			return nil, err
+		}
+		err = tree.addFile(name, loaders[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, extraFile := range options.ExtraFiles {
+		err := tree.add("/"+filepath.Base(extraFile), extraFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range sortedKeys(options.Files) {
+		err := tree.add(name, options.Files[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+// imageTree collects host files and directories to be copied into a FAT image
+type imageTree struct {
+	// files maps image paths to host files
+	files map[string]string
+	// dirs lists image directories to create, including empty ones
+	dirs []string
+	// paths holds the upper case image paths, since FAT names are case insensitive
+	paths map[string]bool
+}
+
+func newImageTree() *imageTree {
+	return &imageTree{files: make(map[string]string), paths: make(map[string]bool)}
+}
+
+// add maps the host file or directory src to imagePath; directories are added recursively and
+// symlinks to regular files are followed
+func (t *imageTree) add(imagePath, src string) error {
+	imagePath = cleanImagePath(imagePath)
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return t.addFile(imagePath, src)
+	}
+	return filepath.WalkDir(src, func(hostPath string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, hostPath)
+		if err != nil {
+			return err
+		}
+		name := path.Join(imagePath, filepath.ToSlash(rel))
+		if d.IsDir() {
+			if name != "/" {
+				t.dirs = append(t.dirs, name)
+			}
+			return nil
+		}
+		return t.addFile(name, hostPath)
+	})
+}
+
+// addFile maps the host file src to imagePath
+func (t *imageTree) addFile(imagePath, src string) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return fmt.Errorf("unsupported file type: %s", src)
+	}
+	key := strings.ToUpper(imagePath)
+	if t.paths[key] {
+		return fmt.Errorf("duplicate image path: %s", imagePath)
+	}
+	t.paths[key] = true
+	t.files[imagePath] = src
+	return nil
+}
+
+// sizes returns the size of each host file keyed by image path
+func (t *imageTree) sizes() (map[string]int64, error) {
+	contents := make(map[string]int64)
+	for name, src := range t.files {
+		stat, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		contents[name] = stat.Size()
+	}
+	return contents, nil
+}
+
+// treeProgress returns a progress totalling the files of trees, or nil if fn is nil
+func treeProgress(fn ProgressFunc, trees ...*imageTree) (*progress, error) {
+	p := newProgress(fn)
+	if p == nil {
+		return nil, nil
+	}
+	for _, t := range trees {
+		contents, err := t.sizes()
+		if err != nil {
+			return nil, err
+		}
+		p.add(contents)
+	}
+	return p, nil
+}
+
+// copyTo creates the directories and copies the files of the tree into fs in path order
+func (t *imageTree) copyTo(ctx context.Context, fs filesystem.FileSystem, p *progress) error {
+	names := make(map[string]string)
+	for _, dir := range t.dirs {
+		names[dir] = ""
+	}
+	for name, src := range t.files {
+		names[name] = src
+	}
+	for _, name := range sortedKeys(names) {
+		if names[name] == "" {
+			err := fs.Mkdir(name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := fs.Mkdir(path.Dir(name))
+		if err != nil {
+			return err
+		}
+		err = copyFileToImage(ctx, fs, name, names[name], p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createFATImage creates imageFilename and formats it as an empty FAT filesystem of size bytes
+func createFATImage(imageFilename string, size int64, fatType FATType, label string, stamp BuildStamp) (*fatFS, *os.File, error) {
+	fp, err := os.OpenFile(imageFilename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+	fs, err := formatFATImage(fp, size, fatType, label, stamp)
+	if err != nil {
+		fp.Close()
+		return nil, nil, err
+	}
+	return fs, fp, nil
+}
+
+// formatFATImage sizes the empty file fp to size bytes and formats it as a FAT filesystem
+func formatFATImage(fp *os.File, size int64, fatType FATType, label string, stamp BuildStamp) (*fatFS, error) {
+	if size%FAT_SECTOR_SIZE != 0 {
+		return nil, fmt.Errorf("size must be a multiple of %d: %d", FAT_SECTOR_SIZE, size)
+	}
+	err := fp.Truncate(size)
+	if err != nil {
+		return nil, err
+	}
+	return formatFAT(fp, 0, size, fatType, label, stamp)
+}
+
+// resolveFATImageSize returns the image size for a requested size, computing it when size is EFI_SIZE_AUTO
+func resolveFATImageSize(size int64, fatType FATType, contents map[string]int64) (int64, error) {
+	switch {
+	case size == 0:
+		size = EFI_IMAGE_SIZE
+	case size == EFI_SIZE_AUTO:
+		return autoFATImageSize(fatType, contents, EFI_AUTO_SLACK)
+	case size < 0:
+		return 0, fmt.Errorf("invalid size: %d", size)
+	}
+	layout, err := newFATLayout(size, fatType)
+	if err != nil {
+		return 0, err
+	}
+	if entries := fatRootEntries(layout, contents); entries > layout.rootEntries {
+		return 0, fmt.Errorf("contents need %d root directory entries; a %d byte %s image has %d", entries, size, layout.fatType, layout.rootEntries)
+	}
+	if !fatImageFits(size, fatType, contents, 0) {
+		return 0, fmt.Errorf("contents do not fit in a %d byte %s image", size, fatType)
+	}
+	return size, nil
+}
+
+// autoFATImageSize returns the smallest aligned image size holding contents plus slack free bytes
+func autoFATImageSize(fatType FATType, contents map[string]int64, slack int64) (int64, error) {
+	total := slack
+	for _, size := range contents {
+		total += size
+	}
+	size := (total/EFI_SIZE_ALIGN + 1) * EFI_SIZE_ALIGN
+	for ; size <= EFI_SIZE_MAX; size += EFI_SIZE_ALIGN {
+		if fatImageFits(size, fatType, contents, slack) {
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("no valid %s image size for contents", fatType)
+}
+
+// fatImageFits returns true if a size byte image of fatType can hold contents with slack bytes to spare
+func fatImageFits(size int64, fatType FATType, contents map[string]int64, slack int64) bool {
+	layout, err := newFATLayout(size, fatType)
+	if err != nil {
+		return false
+	}
+	if fatRootEntries(layout, contents) > layout.rootEntries {
+		return false
+	}
+	return layout.clusterCount*layout.clusterSize() >= fatContentSize(layout, contents)+slack
+}
+
+// fatContentSize returns the data area bytes used by contents, including directories, for layout
+func fatContentSize(layout *fatLayout, contents map[string]int64) int64 {
+	clusterSize := layout.clusterSize()
+	roundUp := func(n int64) int64 {
+		return (n + clusterSize - 1) / clusterSize * clusterSize
+	}
+	total := int64(0)
+	for _, size := range contents {
+		total += roundUp(size)
+	}
+	for dir, names := range fatDirectoryNames(contents) {
+		if dir == "/" && layout.fatType != FAT32 {
+			// the FAT12/16 root directory is outside the data area
+			continue
+		}
+		// dot entries in subdirectories, the volume label in the root
+		total += roundUp((2 + fatDirEntries(names)) * FAT_DIR_ENTRY_SIZE)
+	}
+	return total
+}
+
+// fatRootEntries returns the FAT12/16 root directory entries used by contents, including the volume
+// label, or 0 for FAT32, whose root directory is in the data area
+func fatRootEntries(layout *fatLayout, contents map[string]int64) int64 {
+	if layout.fatType == FAT32 {
+		return 0
+	}
+	return 1 + fatDirEntries(fatDirectoryNames(contents)["/"])
+}
+
+// fatDirectoryNames returns the entry names of each directory holding contents
+func fatDirectoryNames(contents map[string]int64) map[string]map[string]bool {
+	children := make(map[string]map[string]bool)
+	for name := range contents {
+		for name != "/" {
+			dir := path.Dir(name)
+			if children[dir] == nil {
+				children[dir] = make(map[string]bool)
+			}
+			children[dir][path.Base(name)] = true
+			name = dir
+		}
+	}
+	return children
+}
+
+// fatDirEntries returns the directory entries used by names, counting long name entries for names
+// that are not valid short names
+func fatDirEntries(names map[string]bool) int64 {
+	count := int64(0)
+	for name := range names {
+		count++
+		if _, _, ok := fatSplitShortName(name); !ok {
+			count += int64((len(utf16.Encode([]rune(name))) + 12) / 13)
+		}
+	}
+	return count
+}
+
+// imageContentSizes returns the size of each file in fs keyed by image path
+func imageContentSizes(fs filesystem.FileSystem, dir string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if entry.Name() == "." || entry.Name() == ".." || entry.Name() == "NO NAME" {
+			continue
+		}
+		if entry.IsDir() {
+			children, err := imageContentSizes(fs, name)
+			if err != nil {
+				return nil, err
+			}
+			for child, size := range children {
+				sizes[child] = size
+			}
+		} else {
+			sizes[name] = entry.Size()
+		}
+	}
+	return sizes, nil
+}
@@ -0,0 +1,188 @@
+package image
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEFIImageSize(t *testing.T) {
+	dir := t.TempDir()
+	efiBootFile := mkTestPE(t, dir, "bootx64.efi", 0x8664, 3*1024*1024)
+	autoexec := mkTestFile(t, dir, "autoexec.ipxe", "#!ipxe\n")
+
+	// the default floppy size is too small for a 3 MB loader
+	options := EFIImageOptions{BootFile: efiBootFile, BootName: "BOOTX64.EFI", ExtraFiles: []string{autoexec}}
+	err := BuildEFIImage(t.Context(), filepath.Join(dir, "default.img"), options)
+	require.NotNil(t, err)
+
+	options.Size = EFI_SIZE_AUTO
+	autoImage := filepath.Join(dir, "auto.img")
+	err = BuildEFIImage(t.Context(), autoImage, options)
+	require.Nil(t, err)
+	size := hostFileSize(autoImage)
+	require.Less(t, size, int64(4*1024*1024))
+	require.Equal(t, int64(0), size%EFI_SIZE_ALIGN)
+	v, err := openImageFS(autoImage)
+	require.Nil(t, err)
+	require.Equal(t, FAT12, v.fs.(*fatFS).FATType())
+	require.Nil(t, v.Close())
+	require.Equal(t, "#!ipxe\n", readTestImageFile(t, autoImage, "/autoexec.ipxe"))
+
+	options.Size = 8 * 1024 * 1024
+	options.FATType = FAT16
+	fat16Image := filepath.Join(dir, "fat16.img")
+	err = BuildEFIImage(t.Context(), fat16Image, options)
+	require.Nil(t, err)
+	require.Equal(t, options.Size, hostFileSize(fat16Image))
+	v, err = openImageFS(fat16Image)
+	require.Nil(t, err)
+	require.Equal(t, FAT16, v.fs.(*fatFS).FATType())
+	require.Nil(t, v.Close())
+	require.Equal(t, 3*1024*1024, len(readTestImageFile(t, fat16Image, "/EFI/BOOT/BOOTX64.EFI")))
+
+	options.FATType = FAT32
+	err = BuildEFIImage(t.Context(), filepath.Join(dir, "fat32.img"), options)
+	require.NotNil(t, err)
+
+	options.Size = EFI_SIZE_AUTO
+	fat32Image := filepath.Join(dir, "fat32.img")
+	err = BuildEFIImage(t.Context(), fat32Image, options)
+	require.Nil(t, err)
+	v, err = openImageFS(fat32Image)
+	require.Nil(t, err)
+	require.Equal(t, FAT32, v.fs.(*fatFS).FATType())
+	require.Nil(t, v.Close())
+
+	// the 224 entry floppy root directory holds 200 short names but not 60 long ones
+	small := mkTestPE(t, dir, "small.efi", 0x8664, 4096)
+	shortDir := filepath.Join(dir, "short")
+	longDir := filepath.Join(dir, "long")
+	require.Nil(t, os.Mkdir(shortDir, 0700))
+	require.Nil(t, os.Mkdir(longDir, 0700))
+	options = EFIImageOptions{BootFile: small, BootName: "BOOTX64.EFI"}
+	for i := 0; i < 200; i++ {
+		options.ExtraFiles = append(options.ExtraFiles, mkTestFile(t, shortDir, fmt.Sprintf("F%03d.TXT", i), "x"))
+	}
+	require.Nil(t, BuildEFIImage(t.Context(), filepath.Join(dir, "short.img"), options))
+	options.ExtraFiles = nil
+	for i := 0; i < 60; i++ {
+		options.ExtraFiles = append(options.ExtraFiles, mkTestFile(t, longDir, fmt.Sprintf("long file name number %03d.txt", i), "x"))
+	}
+	longImage := filepath.Join(dir, "long.img")
+	err = BuildEFIImage(t.Context(), longImage, options)
+	require.ErrorContains(t, err, "root directory entries")
+	require.NoFileExists(t, longImage)
+}
+
+func TestEFIMultiArch(t *testing.T) {
+	dir := t.TempDir()
+	loaders := []EFILoader{
+		{Arch: "x64", File: mkTestPE(t, dir, "x64.efi", 0x8664, 4096)},
+		{Arch: "ia32", File: mkTestPE(t, dir, "ia32.efi", 0x014c, 4096)},
+		{Arch: "aa64", File: mkTestPE(t, dir, "aa64.efi", 0xaa64, 4096)},
+		{Arch: "riscv64", File: mkTestPE(t, dir, "riscv64.efi", 0x5064, 4096)},
+	}
+	imageFile := filepath.Join(dir, "multi.img")
+	err := BuildEFIImage(t.Context(), imageFile, EFIImageOptions{Loaders: loaders})
+	require.Nil(t, err)
+	files, err := ListImageFiles(imageFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"/EFI/",
+		"/EFI/BOOT/",
+		"/EFI/BOOT/BOOTAA64.EFI",
+		"/EFI/BOOT/BOOTIA32.EFI",
+		"/EFI/BOOT/BOOTRISCV64.EFI",
+		"/EFI/BOOT/BOOTX64.EFI",
+	}, files)
+
+	v, err := openImageFS(imageFile)
+	require.Nil(t, err)
+	defer v.Close()
+	fp, err := v.fs.OpenFile("/EFI/BOOT/BOOTAA64.EFI", os.O_RDONLY)
+	require.Nil(t, err)
+	arch, err := EFILoaderArch(fp)
+	require.Nil(t, err)
+	require.Equal(t, "aa64", arch)
+
+	// an aa64 loader under the x64 name is rejected
+	err = BuildEFIImage(t.Context(), filepath.Join(dir, "wrong.img"), EFIImageOptions{Loaders: []EFILoader{{Arch: "x64", File: loaders[2].File}}})
+	require.ErrorContains(t, err, "expected x64")
+	err = CreateEFIImage(t.Context(), filepath.Join(dir, "legacy.img"), loaders[1].File, "BOOTX64.EFI", nil)
+	require.ErrorContains(t, err, "expected x64")
+
+	// non-PE loaders and unknown architectures are rejected
+	err = CreateEFIImage(t.Context(), filepath.Join(dir, "text.img"), mkTestFile(t, dir, "text.efi", "not a loader"), "BOOTX64.EFI", nil)
+	require.ErrorContains(t, err, "MZ header not found")
+	_, err = ParseEFILoader("arm=file.efi")
+	require.NotNil(t, err)
+	loader, err := ParseEFILoader("AA64=file.efi")
+	require.Nil(t, err)
+	require.Equal(t, EFILoader{Arch: "aa64", File: "file.efi"}, loader)
+}
+
+func TestEFIImageTree(t *testing.T) {
+	dir := t.TempDir()
+	entries := filepath.Join(dir, "entries")
+	require.Nil(t, os.MkdirAll(filepath.Join(entries, "empty"), 0700))
+	mkTestFile(t, entries, "arch.conf", "title Arch\n")
+	extras := filepath.Join(dir, "extras")
+	require.Nil(t, os.Mkdir(extras, 0700))
+	mkTestFile(t, extras, "readme.txt", "extras\n")
+	grubCfg := mkTestFile(t, dir, "grub.cfg", "set timeout=1\n")
+
+	imageFile := filepath.Join(dir, "tree.img")
+	options := EFIImageOptions{
+		BootFile:   mkTestPE(t, dir, "x64.efi", 0x8664, 4096),
+		BootName:   "BOOTX64.EFI",
+		ExtraFiles: []string{extras},
+		Files: map[string]string{
+			"/EFI/ubuntu/grub.cfg": grubCfg,
+			"/loader/entries":      entries,
+		},
+	}
+	require.Nil(t, BuildEFIImage(t.Context(), imageFile, options))
+	files, err := ListImageFiles(imageFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"/EFI/",
+		"/EFI/BOOT/",
+		"/EFI/BOOT/BOOTX64.EFI",
+		"/EFI/ubuntu/",
+		"/EFI/ubuntu/grub.cfg",
+		"/extras/",
+		"/extras/readme.txt",
+		"/loader/",
+		"/loader/entries/",
+		"/loader/entries/arch.conf",
+		"/loader/entries/empty/",
+	}, files)
+	require.Equal(t, "title Arch\n", readTestImageFile(t, imageFile, "/loader/entries/arch.conf"))
+
+	// FAT names are case insensitive
+	options.Files["/efi/boot/bootx64.efi"] = grubCfg
+	err = BuildEFIImage(t.Context(), filepath.Join(dir, "duplicate.img"), options)
+	require.ErrorContains(t, err, "duplicate image path")
+}
+
+func TestParseFileMapping(t *testing.T) {
+	for spec, expected := range map[string][2]string{
+		"grub.cfg":                            {"/grub.cfg", "grub.cfg"},
+		"cfg/grub.cfg:/EFI/ubuntu/":           {"/EFI/ubuntu/grub.cfg", "cfg/grub.cfg"},
+		"cfg/grub.cfg:EFI/ubuntu/a.cfg":       {"/EFI/ubuntu/a.cfg", "cfg/grub.cfg"},
+		"entries:/loader/entries":             {"/loader/entries", "entries"},
+		`C:\boot\x.efi:/EFI/BOOT/BOOTX64.EFI`: {"/EFI/BOOT/BOOTX64.EFI", `C:\boot\x.efi`},
+		"a:b.cfg:/EFI/b.cfg":                  {"/EFI/b.cfg", "a:b.cfg"},
+	} {
+		imagePath, hostPath, err := ParseFileMapping(spec)
+		require.Nil(t, err)
+		require.Equal(t, expected, [2]string{imagePath, hostPath}, spec)
+	}
+	for _, spec := range []string{"", ":/x", "grub.cfg:"} {
+		_, _, err := ParseFileMapping(spec)
+		require.NotNil(t, err, spec)
+	}
+}
@@ -0,0 +1,306 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem"
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	ISO_SYSTEM_AREA_SECTORS = 16
+	EL_TORITO_ENTRY_SIZE    = 32
+	EL_TORITO_SECTOR_SIZE   = 512
+	EL_TORITO_MAX_SECTORS   = 0xffff
+	EL_TORITO_MAX_ENTRIES   = ISO_LOGICAL_BLOCK_SIZE / EL_TORITO_ENTRY_SIZE
+)
+
+const elToritoID = "EL TORITO SPECIFICATION"
+
+// BootCatalog is the El Torito boot catalog of an ISO image
+type BootCatalog struct {
+	// Location is the sector holding the catalog
+	Location uint32
+	// Path is the ISO path of the catalog, empty if the catalog is hidden
+	Path string
+	// Platform is the platform ID of the validation entry
+	Platform iso9660.Platform
+	// ID is the manufacturer ID string of the validation entry
+	ID string
+	// Entries are the default entry followed by the section entries
+	Entries []*BootEntry
+}
+
+// BootEntry is one El Torito boot catalog entry
+type BootEntry struct {
+	Platform    iso9660.Platform
+	Bootable    bool
+	Emulation   iso9660.Emulation
+	LoadSegment uint16
+	SystemType  uint8
+	// SectorCount is the number of 512 byte virtual sectors loaded by the BIOS
+	SectorCount uint16
+	// LoadRBA is the ISO sector of the boot image
+	LoadRBA uint32
+	// Path is the ISO path of the boot image, empty if the image is hidden
+	Path string
+	// Size is the boot image size in bytes
+	Size int64
+	// BootTable is true if the boot image contains a boot info table
+	BootTable bool
+}
+
+// PlatformName returns a display name for an El Torito platform ID
+func PlatformName(platform iso9660.Platform) string {
+	switch platform {
+	case iso9660.BIOS:
+		return "BIOS"
+	case iso9660.PPC:
+		return "PPC"
+	case iso9660.Mac:
+		return "Mac"
+	case iso9660.EFI:
+		return "EFI"
+	}
+	return fmt.Sprintf("0x%02x", uint8(platform))
+}
+
+// EmulationName returns a display name for an El Torito emulation type
+func EmulationName(emulation iso9660.Emulation) string {
+	switch emulation {
+	case iso9660.NoEmulation:
+		return "none"
+	case iso9660.Floppy12Emulation:
+		return "1.2M floppy"
+	case iso9660.Floppy144Emulation:
+		return "1.44M floppy"
+	case iso9660.Floppy288Emulation:
+		return "2.88M floppy"
+	case iso9660.HardDiskEmulation:
+		return "hard disk"
+	}
+	return fmt.Sprintf("0x%02x", uint8(emulation))
+}
+
+// ReadBootCatalog returns the El Torito boot catalog of an ISO image, or nil if the image has no boot record
+func ReadBootCatalog(imageFilename string) (*BootCatalog, error) {
+	v, err := openVolume(imageFilename, PartitionSelector{})
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+	return readBootCatalog(v.file, v.fs)
+}
+
+// readBootCatalog parses the boot record and catalog from r, resolving boot image paths through fs
+func readBootCatalog(r io.ReaderAt, fs filesystem.FileSystem) (*BootCatalog, error) {
+	location, err := bootCatalogLocation(r)
+	if err != nil || location == 0 {
+		return nil, err
+	}
+	data := make([]byte, ISO_LOGICAL_BLOCK_SIZE)
+	_, err = r.ReadAt(data, int64(location)*ISO_LOGICAL_BLOCK_SIZE)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading boot catalog: %v", err)
+	}
+	catalog, err := parseBootCatalog(data)
+	if err != nil {
+		return nil, err
+	}
+	catalog.Location = location
+
+	locations, err := isoFileLocations(fs)
+	if err != nil {
+		return nil, err
+	}
+	catalog.Path = locations[location].name
+	for _, entry := range catalog.Entries {
+		file, ok := locations[entry.LoadRBA]
+		if ok {
+			entry.Path = file.name
+			entry.Size = file.size
+		} else {
+			entry.Size, err = hiddenBootImageSize(r, entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entry.BootTable, err = hasBootTable(r, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return catalog, nil
+}
+
+// bootCatalogLocation returns the catalog sector from the El Torito boot record volume descriptor, or 0 if there is none
+func bootCatalogLocation(r io.ReaderAt) (uint32, error) {
+	descriptor := make([]byte, ISO_LOGICAL_BLOCK_SIZE)
+	for sector := int64(ISO_SYSTEM_AREA_SECTORS); ; sector++ {
+		_, err := r.ReadAt(descriptor, sector*ISO_LOGICAL_BLOCK_SIZE)
+		if err != nil {
+			return 0, fmt.Errorf("failed reading volume descriptor %d: %v", sector, err)
+		}
+		if string(descriptor[1:6]) != "CD001" {
+			return 0, fmt.Errorf("invalid volume descriptor at sector %d", sector)
+		}
+		switch descriptor[0] {
+		case 0:
+			if strings.TrimRight(string(descriptor[7:39]), "\x00") == elToritoID {
+				return binary.LittleEndian.Uint32(descriptor[0x47:0x4b]), nil
+			}
+		case 0xff:
+			return 0, nil
+		}
+	}
+}
+
+// parseBootCatalog decodes the validation entry and the boot entries of a catalog sector
+func parseBootCatalog(data []byte) (*BootCatalog, error) {
+	validation := data[0:EL_TORITO_ENTRY_SIZE]
+	if validation[0] != 1 || validation[0x1e] != 0x55 || validation[0x1f] != 0xaa {
+		return nil, fmt.Errorf("invalid boot catalog validation entry")
+	}
+	checksum := uint16(0)
+	for i := 0; i < EL_TORITO_ENTRY_SIZE; i += 2 {
+		checksum += binary.LittleEndian.Uint16(validation[i : i+2])
+	}
+	if checksum != 0 {
+		return nil, fmt.Errorf("invalid boot catalog checksum")
+	}
+	platform := iso9660.Platform(validation[1])
+	catalog := BootCatalog{
+		Platform: platform,
+		ID:       strings.TrimRight(string(validation[4:0x1c]), "\x00 "),
+		Entries:  []*BootEntry{parseBootEntry(data[EL_TORITO_ENTRY_SIZE:2*EL_TORITO_ENTRY_SIZE], platform)},
+	}
+
+	// section headers follow the default entry, 0x90 for more sections or 0x91 for the last
+	index := 2
+	for index < EL_TORITO_MAX_ENTRIES {
+		header := data[index*EL_TORITO_ENTRY_SIZE : (index+1)*EL_TORITO_ENTRY_SIZE]
+		if header[0] != 0x90 && header[0] != 0x91 {
+			break
+		}
+		platform = iso9660.Platform(header[1])
+		count := int(binary.LittleEndian.Uint16(header[2:4]))
+		index++
+		for i := 0; i < count && index < EL_TORITO_MAX_ENTRIES; index++ {
+			b := data[index*EL_TORITO_ENTRY_SIZE : (index+1)*EL_TORITO_ENTRY_SIZE]
+			if b[0] == 0x44 {
+				// selection criteria extension of the previous entry
+				continue
+			}
+			catalog.Entries = append(catalog.Entries, parseBootEntry(b, platform))
+			i++
+		}
+		if header[0] == 0x91 {
+			break
+		}
+	}
+	return &catalog, nil
+}
+
+func parseBootEntry(b []byte, platform iso9660.Platform) *BootEntry {
+	return &BootEntry{
+		Platform:    platform,
+		Bootable:    b[0] == 0x88,
+		Emulation:   iso9660.Emulation(b[1] & 0x0f),
+		LoadSegment: binary.LittleEndian.Uint16(b[2:4]),
+		SystemType:  b[4],
+		SectorCount: binary.LittleEndian.Uint16(b[6:8]),
+		LoadRBA:     binary.LittleEndian.Uint32(b[8:12]),
+	}
+}
+
+// isoFileInfo is the path and size of a file found at an ISO extent
+type isoFileInfo struct {
+	name string
+	size int64
+}
+
+// isoFileLocations maps the starting sector of each file in an ISO filesystem to its path and size
+func isoFileLocations(fs filesystem.FileSystem) (map[uint32]isoFileInfo, error) {
+	locations := make(map[uint32]isoFileInfo)
+	files, err := walkFS(fs, "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		if strings.HasSuffix(name, "/") {
+			continue
+		}
+		fp, err := fs.OpenFile(name, os.O_RDONLY)
+		if err != nil {
+			return nil, err
+		}
+		isoFile, ok := fp.(*iso9660.File)
+		if ok && isoFile.Location() != 0 {
+			locations[isoFile.Location()] = isoFileInfo{name: name, size: isoFile.Size()}
+		}
+		fp.Close()
+	}
+	return locations, nil
+}
+
+// hiddenBootImageSize returns the size of a boot image that has no directory entry
+func hiddenBootImageSize(r io.ReaderAt, entry *BootEntry) (int64, error) {
+	switch entry.Emulation {
+	case iso9660.Floppy12Emulation:
+		return 1200 * 1024, nil
+	case iso9660.Floppy144Emulation:
+		return 1440 * 1024, nil
+	case iso9660.Floppy288Emulation:
+		return 2880 * 1024, nil
+	}
+	sector := make([]byte, EL_TORITO_SECTOR_SIZE)
+	_, err := r.ReadAt(sector, int64(entry.LoadRBA)*ISO_LOGICAL_BLOCK_SIZE)
+	if err != nil {
+		return 0, fmt.Errorf("failed reading boot image at sector %d: %v", entry.LoadRBA, err)
+	}
+	// a FAT boot image records its own size in the BIOS parameter block
+	layout, err := parseFATBootSector(sector)
+	if err == nil {
+		return layout.totalSectors * layout.bytesPerSector, nil
+	}
+	return int64(entry.SectorCount) * EL_TORITO_SECTOR_SIZE, nil
+}
+
+// hasBootTable returns true if the boot image holds a boot info table matching its location and size
+func hasBootTable(r io.ReaderAt, entry *BootEntry) (bool, error) {
+	if entry.Emulation != iso9660.NoEmulation || entry.Size < 64 {
+		return false, nil
+	}
+	table := make([]byte, 16)
+	_, err := r.ReadAt(table, int64(entry.LoadRBA)*ISO_LOGICAL_BLOCK_SIZE+8)
+	if err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint32(table[0:4]) == ISO_SYSTEM_AREA_SECTORS &&
+		binary.LittleEndian.Uint32(table[4:8]) == entry.LoadRBA &&
+		int64(binary.LittleEndian.Uint32(table[8:12])) == entry.Size, nil
+}
+
+// loadSectors returns the El Torito sector count covering size bytes
+func loadSectors(size int64) uint16 {
+	sectors := (size + EL_TORITO_SECTOR_SIZE - 1) / EL_TORITO_SECTOR_SIZE
+	if sectors > EL_TORITO_MAX_SECTORS {
+		return EL_TORITO_MAX_SECTORS
+	}
+	return uint16(sectors)
+}
+
+// extractBootImage copies the boot image of entry from the raw ISO r to the host file dstPath
+func extractBootImage(r io.ReaderAt, dstPath string, entry *BootEntry) error {
+	ofp, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer ofp.Close()
+	section := io.NewSectionReader(r, int64(entry.LoadRBA)*ISO_LOGICAL_BLOCK_SIZE, entry.Size)
+	_, err = io.Copy(ofp, section)
+	return err
+}
@@ -0,0 +1,122 @@
+package image
+
+import (
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBootCatalog(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+	catalog, err := ReadBootCatalog(isoImage)
+	require.Nil(t, err)
+	require.NotNil(t, catalog)
+	require.Equal(t, "", catalog.Path)
+	require.Len(t, catalog.Entries, 2)
+
+	bios := catalog.Entries[0]
+	require.Equal(t, iso9660.BIOS, bios.Platform)
+	require.Equal(t, iso9660.NoEmulation, bios.Emulation)
+	require.True(t, bios.Bootable)
+	require.Equal(t, "/isolinux.bin", bios.Path)
+	require.Equal(t, uint16(4), bios.SectorCount)
+	require.Equal(t, int64(4096), bios.Size)
+	require.True(t, bios.BootTable)
+
+	efi := catalog.Entries[1]
+	require.Equal(t, iso9660.EFI, efi.Platform)
+	require.Equal(t, "/esp.img", efi.Path)
+	require.Equal(t, uint16(EFI_IMAGE_SIZE/512), efi.SectorCount)
+	require.Equal(t, int64(EFI_IMAGE_SIZE), efi.Size)
+	require.False(t, efi.BootTable)
+
+	// an ISO without a boot record has no catalog
+	plain := buildTestISO(t, dir, "plain.iso", map[string]string{"/readme.txt": mkTestFile(t, dir, "plain.txt", "plain\n")}, nil)
+	catalog, err = ReadBootCatalog(plain)
+	require.Nil(t, err)
+	require.Nil(t, catalog)
+}
+
+func TestISOBuildBootCatalog(t *testing.T) {
+	dir := t.TempDir()
+
+	// a GRUB style layout with several .img files and no isolinux.bin
+	efiImage := filepath.Join(dir, "efiboot.img")
+	err := BuildEFIImage(t.Context(), efiImage, EFIImageOptions{
+		Loaders: []EFILoader{{Arch: "x64", File: mkTestPE(t, dir, "grubx64.efi", 0x8664, 8000)}},
+		Size:    2880 * 1024,
+	})
+	require.Nil(t, err)
+	files := map[string]string{
+		"/boot/grub/i386-pc/eltorito.img": mkTestFile(t, dir, "eltorito.img", strings.Repeat("G", 6000)),
+		"/images/efiboot.img":             efiImage,
+		"/zzz/extra.img":                  mkTestFile(t, dir, "extra.img", "not a boot image\n"),
+	}
+	entries := []*iso9660.ElToritoEntry{
+		{Platform: iso9660.BIOS, Emulation: iso9660.NoEmulation, BootFile: "/boot/grub/i386-pc/eltorito.img", BootTable: true, LoadSize: 4},
+		{Platform: iso9660.EFI, Emulation: iso9660.NoEmulation, BootFile: "/images/efiboot.img", LoadSize: 2880 * 2},
+	}
+	srcImage := buildTestISO(t, dir, "grub.iso", files, entries)
+
+	grubCfg := mkTestFile(t, dir, "grub.cfg", "set timeout=5\n")
+	dstImage := filepath.Join(dir, "output.iso")
+	err = BuildISOImage(t.Context(), dstImage, srcImage, ISOBuildOptions{EFIFiles: map[string]string{"/EFI/BOOT/grub.cfg": grubCfg}})
+	require.Nil(t, err)
+
+	catalog, err := ReadBootCatalog(dstImage)
+	require.Nil(t, err)
+	require.Len(t, catalog.Entries, 2)
+	require.Equal(t, iso9660.BIOS, catalog.Platform)
+	require.Equal(t, "/boot/grub/i386-pc/eltorito.img", catalog.Entries[0].Path)
+	require.Equal(t, uint16(4), catalog.Entries[0].SectorCount)
+	require.True(t, catalog.Entries[0].BootTable)
+	require.Equal(t, "/images/efiboot.img", catalog.Entries[1].Path)
+	require.Equal(t, loadSectors(catalog.Entries[1].Size), catalog.Entries[1].SectorCount)
+
+	outputEFI := filepath.Join(dir, "output-efiboot.img")
+	v, err := openImageFS(dstImage)
+	require.Nil(t, err)
+	defer v.Close()
+	fs := v.fs
+	err = copyFileFromImage(t.Context(), fs, outputEFI, "/images/efiboot.img", nil)
+	require.Nil(t, err)
+	require.Equal(t, "set timeout=5\n", readTestImageFile(t, outputEFI, "/EFI/BOOT/grub.cfg"))
+	require.Equal(t, "not a boot image\n", readTestImageFile(t, dstImage, "/zzz/extra.img"))
+}
+
+func TestISOBuildHiddenBootImage(t *testing.T) {
+	dir := t.TempDir()
+	efiImage := filepath.Join(dir, "efi.img")
+	err := CreateEFIImage(t.Context(), efiImage, mkTestPE(t, dir, "bootx64.efi", 0x8664, 4000), "BOOTX64.EFI", nil)
+	require.Nil(t, err)
+	files := map[string]string{
+		"/efi.img":    efiImage,
+		"/readme.txt": mkTestFile(t, dir, "readme.txt", "hidden boot image\n"),
+	}
+	entries := []*iso9660.ElToritoEntry{
+		{Platform: iso9660.EFI, Emulation: iso9660.NoEmulation, BootFile: "/efi.img", HideBootFile: true, LoadSize: EFI_IMAGE_SIZE / 512},
+	}
+	srcImage := buildTestISO(t, dir, "hidden.iso", files, entries)
+
+	catalog, err := ReadBootCatalog(srcImage)
+	require.Nil(t, err)
+	require.Len(t, catalog.Entries, 1)
+	require.Equal(t, "", catalog.Entries[0].Path)
+	require.Equal(t, int64(EFI_IMAGE_SIZE), catalog.Entries[0].Size)
+
+	dstImage := filepath.Join(dir, "output.iso")
+	err = BuildISOImage(t.Context(), dstImage, srcImage, ISOBuildOptions{VolumeLabel: "HIDDEN"})
+	require.Nil(t, err)
+	catalog, err = ReadBootCatalog(dstImage)
+	require.Nil(t, err)
+	require.Len(t, catalog.Entries, 1)
+	require.Equal(t, iso9660.EFI, catalog.Entries[0].Platform)
+	require.Equal(t, "", catalog.Entries[0].Path)
+	require.Equal(t, int64(EFI_IMAGE_SIZE), catalog.Entries[0].Size)
+	files2, err := ListImageFiles(dstImage)
+	require.Nil(t, err)
+	require.Equal(t, []string{"/readme.txt"}, files2)
+}
@@ -0,0 +1,125 @@
+package image
+
+import (
+	"encoding/json"
+	"github.com/rstms/go-diskfs/filesystem"
+	"os"
+	"path"
+	"time"
+)
+
+// Entry describes a file or directory in an image filesystem
+type Entry struct {
+	// Path is the absolute image path, without a trailing slash for directories
+	Path    string      `json:"path"`
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	IsDir   bool        `json:"is_dir"`
+	// ShortName is the FAT 8.3 name
+	ShortName string `json:"short_name,omitempty"`
+	// Attributes are the FAT attribute bits
+	Attributes uint8 `json:"attributes,omitempty"`
+	// Location is the ISO9660 sector of the file extent
+	Location uint32 `json:"location,omitempty"`
+	// UID and GID are the Rock Ridge owner, nil if the image has none
+	UID *uint32 `json:"uid,omitempty"`
+	GID *uint32 `json:"gid,omitempty"`
+	// Symlink is the Rock Ridge symlink target
+	Symlink string `json:"symlink,omitempty"`
+}
+
+// MarshalJSON encodes Mode in ls style, such as "-rw-r--r--"
+func (e Entry) MarshalJSON() ([]byte, error) {
+	type entry Entry
+	return json.Marshal(struct {
+		entry
+		Mode string `json:"mode"`
+	}{entry(e), e.Mode.String()})
+}
+
+// AttributeString returns the FAT attributes as "RHSA" flags, with '-' for each unset flag
+func (e *Entry) AttributeString() string {
+	flags := []byte("RHSA")
+	for i, bit := range []uint8{fatAttrReadOnly, fatAttrHidden, fatAttrSystem, fatAttrArchive} {
+		if e.Attributes&bit == 0 {
+			flags[i] = '-'
+		}
+	}
+	return string(flags)
+}
+
+// ListImageEntries returns the files and directories of an image in ListImageFiles order
+func ListImageEntries(imageFilename string) ([]Entry, error) {
+	return ListPartitionEntries(imageFilename, PartitionSelector{})
+}
+
+// ListPartitionEntries returns the files and directories of the image partition chosen by selector
+func ListPartitionEntries(imageFilename string, selector PartitionSelector) ([]Entry, error) {
+	v, err := openVolume(imageFilename, selector)
+	if err != nil {
+		return []Entry{}, err
+	}
+	defer v.Close()
+	return v.entries()
+}
+
+// entries returns the files and directories of the volume
+func (v *volume) entries() ([]Entry, error) {
+	isoEntries, err := v.isoEntries()
+	if err != nil {
+		return []Entry{}, err
+	}
+	return walkEntries(v.fs, "/", isoEntries)
+}
+
+// walkEntries returns the entries below dir, with each directory followed by its contents
+func walkEntries(fs filesystem.FileSystem, dir string, isoEntries map[string]*isoEntry) ([]Entry, error) {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return []Entry{}, err
+	}
+	entries := []Entry{}
+	for _, info := range infos {
+		if info.Name() == "NO NAME" || (info.IsDir() && (info.Name() == "." || info.Name() == "..")) {
+			continue
+		}
+		entry := Entry{
+			Path:    path.Join(dir, info.Name()),
+			Name:    info.Name(),
+			Size:    info.Size(),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			IsDir:   info.IsDir(),
+		}
+		if fi, ok := info.(fatFileInfo); ok {
+			entry.ShortName = fi.entry.shortName
+			entry.Attributes = fi.entry.attr
+		}
+		if isoEntry := isoEntries[entry.Path]; isoEntry != nil {
+			entry.Size = isoEntry.size
+			entry.Mode = isoEntry.mode
+			entry.ModTime = isoEntry.modTime
+			entry.Location = isoEntry.location
+			entry.Symlink = isoEntry.symlink
+			if isoEntry.rockRidge {
+				uid, gid := isoEntry.uid, isoEntry.gid
+				entry.UID = &uid
+				entry.GID = &gid
+			}
+		}
+		if entry.IsDir {
+			entry.Size = 0
+		}
+		entries = append(entries, entry)
+		if entry.IsDir {
+			children, err := walkEntries(fs, entry.Path, isoEntries)
+			if err != nil {
+				return []Entry{}, err
+			}
+			entries = append(entries, children...)
+		}
+	}
+	return entries, nil
+}
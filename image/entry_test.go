@@ -0,0 +1,71 @@
+package image
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImageEntries(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+	entries, err := ListImageEntries(isoImage)
+	require.Nil(t, err)
+	files, err := ListImageFiles(isoImage)
+	require.Nil(t, err)
+	require.Len(t, entries, len(files))
+	for i, entry := range entries {
+		name := entry.Path
+		if entry.IsDir {
+			name += "/"
+		}
+		require.Equal(t, files[i], name)
+	}
+
+	catalog, err := ReadBootCatalog(isoImage)
+	require.Nil(t, err)
+	byPath := make(map[string]Entry)
+	for _, entry := range entries {
+		byPath[entry.Path] = entry
+	}
+	esp := byPath["/esp.img"]
+	require.Equal(t, "esp.img", esp.Name)
+	require.Equal(t, int64(EFI_IMAGE_SIZE), esp.Size)
+	require.Equal(t, catalog.Entries[1].LoadRBA, esp.Location)
+	require.True(t, esp.Mode.IsRegular())
+	require.NotNil(t, esp.UID)
+	require.Equal(t, "", esp.ShortName)
+	docs := byPath["/docs"]
+	require.True(t, docs.IsDir)
+	require.Equal(t, os.ModeDir, docs.Mode.Type())
+	require.Equal(t, int64(0), docs.Size)
+
+	data, err := json.Marshal(esp)
+	require.Nil(t, err)
+	var decoded map[string]any
+	require.Nil(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, esp.Mode.String(), decoded["mode"])
+	require.Equal(t, "/esp.img", decoded["path"])
+
+	fatEntries, err := ListImageEntries(filepath.Join(dir, "esp.img"))
+	require.Nil(t, err)
+	require.Len(t, fatEntries, 4)
+	var loader Entry
+	for _, entry := range fatEntries {
+		if strings.HasSuffix(entry.Path, ".EFI") {
+			loader = entry
+		}
+	}
+	require.Equal(t, "/EFI/BOOT/BOOTX64.EFI", loader.Path)
+	require.Equal(t, "BOOTX64.EFI", loader.ShortName)
+	require.Equal(t, int64(6000), loader.Size)
+	require.Zero(t, loader.Location)
+	require.Nil(t, loader.UID)
+	require.False(t, loader.ModTime.IsZero())
+
+	loader.Attributes = fatAttrReadOnly | fatAttrArchive
+	require.Equal(t, "R--A", loader.AttributeString())
+}
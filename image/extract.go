@@ -0,0 +1,557 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnsafePath is returned for image entries that would be written outside the destination directory
+	ErrUnsafePath = errors.New("unsafe path")
+	// ErrSpecialFile is returned for symlinks and device nodes refused by the extract policy
+	ErrSpecialFile = errors.New("special file refused")
+)
+
+// SpecialFilePolicy selects how extraction handles symlinks and device nodes
+type SpecialFilePolicy int
+
+const (
+	// SpecialSkip leaves the entry out of the extracted tree
+	SpecialSkip SpecialFilePolicy = iota
+	// SpecialError fails the extraction naming the entry
+	SpecialError
+	// SpecialCreate creates the entry on the host; only symlinks can be created
+	SpecialCreate
+)
+
+func (p SpecialFilePolicy) String() string {
+	switch p {
+	case SpecialSkip:
+		return "skip"
+	case SpecialError:
+		return "error"
+	case SpecialCreate:
+		return "create"
+	}
+	return fmt.Sprintf("SpecialFilePolicy(%d)", int(p))
+}
+
+// ParseSpecialFilePolicy returns the policy for a name such as "skip", "error" or "create"
+func ParseSpecialFilePolicy(name string) (SpecialFilePolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "skip":
+		return SpecialSkip, nil
+	case "error":
+		return SpecialError, nil
+	case "create":
+		return SpecialCreate, nil
+	}
+	return SpecialSkip, fmt.Errorf("unknown special file policy: %s", name)
+}
+
+// ExtractOptions selects the entries ExtractImage writes and how it handles symlinks and device nodes
+type ExtractOptions struct {
+	// Symlinks is the policy for Rock Ridge symbolic links
+	Symlinks SpecialFilePolicy
+	// Devices is the policy for Rock Ridge device nodes, fifos and sockets
+	Devices SpecialFilePolicy
+	// Include limits extraction to files matching any of these glob patterns
+	Include []string
+	// Exclude skips files and directories matching any of these glob patterns
+	Exclude []string
+	// PreserveTimes sets the modification and access times of extracted files and directories
+	PreserveTimes bool
+	// PreserveMode sets the permission bits from the Rock Ridge mode or the FAT read-only attribute
+	PreserveMode bool
+	// PreserveOwner sets the Rock Ridge uid and gid; it is ignored unless running as root
+	PreserveOwner bool
+	// Partition chooses the filesystem of a partitioned disk image
+	Partition PartitionSelector
+	// Progress receives the files and bytes extracted
+	Progress ProgressFunc
+	// NoClobber keeps files that already exist below the destination directory
+	NoClobber bool
+}
+
+// ExtractImage writes the files of an image below destDir, refusing entries that would land outside it.
+// If ctx is cancelled, the file being written is removed and the files already extracted are kept.
+func ExtractImage(ctx context.Context, imageFilename, destDir string, options ExtractOptions) error {
+	err := checkExtractOptions(options)
+	if err != nil {
+		return err
+	}
+	v, err := openVolume(imageFilename, options.Partition)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+	return v.extract(ctx, destDir, options)
+}
+
+// PlanExtract returns the image paths of the files ExtractImage would write with options, sorted by path
+func PlanExtract(imageFilename string, options ExtractOptions) ([]string, error) {
+	err := checkExtractOptions(options)
+	if err != nil {
+		return []string{}, err
+	}
+	v, err := openVolume(imageFilename, options.Partition)
+	if err != nil {
+		return []string{}, err
+	}
+	defer v.Close()
+	return v.plan(options)
+}
+
+// checkExtractOptions returns an error for invalid glob patterns or policies
+func checkExtractOptions(options ExtractOptions) error {
+	for _, patterns := range [][]string{options.Include, options.Exclude} {
+		for _, pattern := range patterns {
+			err := checkGlob(pattern)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if options.Devices == SpecialCreate {
+		return fmt.Errorf("device nodes cannot be created")
+	}
+	return nil
+}
+
+// plan returns the image paths of the files extract would write, sorted by path
+func (v *volume) plan(options ExtractOptions) ([]string, error) {
+	isoEntries, err := v.isoEntries()
+	if err != nil {
+		return []string{}, err
+	}
+	x := extractor{fs: v.fs, isoEntries: isoEntries, options: options}
+	contents := make(map[string]int64)
+	err = x.plan("/", contents)
+	if err != nil {
+		return []string{}, err
+	}
+	return sortedKeys(contents), nil
+}
+
+// extract writes the files of the volume below destDir
+func (v *volume) extract(ctx context.Context, destDir string, options ExtractOptions) error {
+	isoEntries, err := v.isoEntries()
+	if err != nil {
+		return err
+	}
+	// writes through root cannot follow symlinks or .. out of destDir
+	root, err := os.OpenRoot(destDir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	x := extractor{fs: v.fs, root: root, isoEntries: isoEntries, options: options}
+	x.progress = newProgress(options.Progress)
+	if x.progress != nil {
+		contents := make(map[string]int64)
+		err = x.plan("/", contents)
+		if err != nil {
+			return err
+		}
+		x.progress.add(contents)
+	}
+	logger().Info("extracting", "destination", destDir)
+	return x.extractDir(ctx, "/")
+}
+
+// extractor copies an image filesystem into a host directory
+type extractor struct {
+	fs   filesystem.FileSystem
+	root *os.Root
+	// isoEntries maps image paths to Rock Ridge entries for ISO images
+	isoEntries map[string]*isoEntry
+	options    ExtractOptions
+	progress   *progress
+}
+
+// plan adds the size of each regular file extractDir would extract below dir to contents. Without a
+// destination root, files kept by NoClobber are included.
+func (x *extractor) plan(dir string, contents map[string]int64) error {
+	entries, err := x.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "NO NAME" || (entry.IsDir() && (name == "." || name == "..")) {
+			continue
+		}
+		imagePath := path.Join(dir, name)
+		switch {
+		case matchAnyGlob(x.options.Exclude, imagePath) || isSpecialFile(x.isoEntries[imagePath]):
+		case entry.IsDir():
+			err = x.plan(imagePath, contents)
+			if err != nil {
+				return err
+			}
+		case len(x.options.Include) == 0 || matchAnyGlob(x.options.Include, imagePath):
+			if x.root == nil || !x.keepExisting(imagePath) {
+				contents[imagePath] = entry.Size()
+			}
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractDir(ctx context.Context, dir string) error {
+	entries, err := x.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "NO NAME" || (entry.IsDir() && (name == "." || name == "..")) {
+			continue
+		}
+		err := checkEntryName(name)
+		if err != nil {
+			return fmt.Errorf("refusing to extract %q from %s: %w", name, dir, err)
+		}
+		imagePath := path.Join(dir, name)
+		hostPath := filepath.FromSlash(strings.TrimPrefix(imagePath, "/"))
+		if !filepath.IsLocal(hostPath) {
+			return fmt.Errorf("refusing to extract %s: %w", imagePath, ErrUnsafePath)
+		}
+		if matchAnyGlob(x.options.Exclude, imagePath) {
+			logger().Debug("excluding", "path", imagePath)
+			continue
+		}
+		included := len(x.options.Include) == 0 || matchAnyGlob(x.options.Include, imagePath)
+		isoEntry := x.isoEntries[imagePath]
+		switch {
+		case isSpecialFile(isoEntry):
+			if included {
+				err = x.extractSpecial(imagePath, hostPath, isoEntry)
+			}
+		case entry.IsDir():
+			if included {
+				err = x.makeDirs(hostPath)
+			}
+			if err == nil {
+				err = x.extractDir(ctx, imagePath)
+			}
+			if err == nil && included {
+				// after the contents, so a read-only mode or the mtime is not disturbed
+				err = x.setMetadata(hostPath, entry, isoEntry)
+			}
+		case included && x.keepExisting(imagePath):
+			logger().Debug("keeping existing file", "path", imagePath)
+		case included:
+			err = x.makeDirs(filepath.Dir(hostPath))
+			if err == nil {
+				err = x.extractFile(ctx, imagePath, hostPath)
+			}
+			if err == nil {
+				err = x.setMetadata(hostPath, entry, isoEntry)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepExisting returns true if NoClobber is set and the host file for imagePath exists
+func (x *extractor) keepExisting(imagePath string) bool {
+	if !x.options.NoClobber {
+		return false
+	}
+	_, err := x.root.Lstat(filepath.FromSlash(strings.TrimPrefix(imagePath, "/")))
+	return err == nil
+}
+
+// makeDirs creates hostPath and its missing parents below the destination directory
+func (x *extractor) makeDirs(hostPath string) error {
+	if hostPath == "." {
+		return nil
+	}
+	dir := ""
+	for _, component := range strings.Split(hostPath, string(filepath.Separator)) {
+		dir = filepath.Join(dir, component)
+		err := x.root.Mkdir(dir, 0700)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		stat, err := x.root.Lstat(dir)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("not a directory: %s", filepath.Join(x.root.Name(), dir))
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractFile(ctx context.Context, imagePath, hostPath string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	logger().Debug("extracting", "path", imagePath)
+	ifp, err := x.fs.OpenFile(imagePath, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer ifp.Close()
+	ofp, err := x.root.OpenFile(hostPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("refusing to extract %s: %w", imagePath, err)
+	}
+	defer ofp.Close()
+	err = copyData(ctx, ofp, ifp, imagePath, x.progress)
+	if err != nil {
+		if ctx.Err() != nil {
+			ofp.Close()
+			x.root.Remove(hostPath)
+		}
+		return err
+	}
+	x.progress.fileDone()
+	return nil
+}
+
+// extractSpecial applies the extract policy to a symlink or device node
+func (x *extractor) extractSpecial(imagePath, hostPath string, entry *isoEntry) error {
+	policy := x.options.Devices
+	if entry.mode&os.ModeSymlink != 0 {
+		policy = x.options.Symlinks
+	}
+	description := specialFileDescription(entry)
+	switch policy {
+	case SpecialError:
+		return fmt.Errorf("refusing to extract %s: %s: %w", imagePath, description, ErrSpecialFile)
+	case SpecialCreate:
+		logger().Debug("creating", "path", imagePath, "type", description)
+		err := x.makeDirs(filepath.Dir(hostPath))
+		if err != nil {
+			return err
+		}
+		// later writes through root refuse to follow a link that leaves the destination directory
+		linkPath := filepath.Join(x.root.Name(), hostPath)
+		err = os.Symlink(entry.symlink, linkPath)
+		if err != nil {
+			return err
+		}
+		if x.options.PreserveOwner && entry.rockRidge && os.Geteuid() == 0 {
+			return os.Lchown(linkPath, int(entry.uid), int(entry.gid))
+		}
+		return nil
+	}
+	logger().Debug("skipping", "path", imagePath, "type", description)
+	return nil
+}
+
+// setMetadata applies the preserved owner, mode and times of an image entry to the extracted host path
+func (x *extractor) setMetadata(hostPath string, info os.FileInfo, entry *isoEntry) error {
+	options := x.options
+	if !options.PreserveOwner && !options.PreserveMode && !options.PreserveTimes {
+		return nil
+	}
+	// the host calls below follow symlinks, so they only go ahead if the host path still names the
+	// file root reaches, and never through a symlink in the destination
+	contained, err := x.root.Lstat(hostPath)
+	if err != nil {
+		return err
+	}
+	if contained.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	fullPath := filepath.Join(x.root.Name(), hostPath)
+	host, err := os.Lstat(fullPath)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(contained, host) {
+		return fmt.Errorf("refusing to set metadata on %s: %w", hostPath, ErrUnsafePath)
+	}
+	mode := info.Mode()
+	modTime := info.ModTime()
+	accessTime := modTime
+	if fi, ok := info.(interface{ AccessTime() time.Time }); ok && !fi.AccessTime().IsZero() {
+		accessTime = fi.AccessTime()
+	}
+	if entry != nil {
+		mode = entry.mode
+		modTime = entry.modTime
+		accessTime = entry.accessTime
+	}
+	if options.PreserveOwner && entry != nil && entry.rockRidge && os.Geteuid() == 0 {
+		err := os.Lchown(fullPath, int(entry.uid), int(entry.gid))
+		if err != nil {
+			return err
+		}
+	}
+	if options.PreserveMode {
+		// set after chown, which clears the setuid and setgid bits
+		err := os.Chmod(fullPath, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if err != nil {
+			return err
+		}
+	}
+	if options.PreserveTimes && !modTime.IsZero() {
+		err := os.Chtimes(fullPath, accessTime, modTime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// specialFileDescription names the type of a symlink or device node entry
+func specialFileDescription(entry *isoEntry) string {
+	switch {
+	case entry.mode&os.ModeSymlink != 0:
+		return fmt.Sprintf("symlink to %q", entry.symlink)
+	case entry.mode&os.ModeCharDevice != 0:
+		return "character device"
+	case entry.mode&os.ModeDevice != 0:
+		return "block device"
+	case entry.mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case entry.mode&os.ModeSocket != 0:
+		return "socket"
+	}
+	return entry.mode.Type().String()
+}
+
+// checkEntryName returns an error if an image directory entry name is not a single path component
+func checkEntryName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: empty name", ErrUnsafePath)
+	case name == "." || name == "..":
+		return fmt.Errorf("%w: relative name", ErrUnsafePath)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("%w: name contains a path separator", ErrUnsafePath)
+	}
+	return nil
+}
+
+// isSpecialFile returns true if entry is a Rock Ridge symlink, device node, fifo or socket
+func isSpecialFile(entry *isoEntry) bool {
+	return entry != nil && entry.mode.Type()&^os.ModeDir != 0
+}
+
+// ExtractFile copies the image file at imagePath to w
+func ExtractFile(imageFilename, imagePath string, w io.Writer) error {
+	return ExtractPartitionFile(imageFilename, PartitionSelector{}, imagePath, w)
+}
+
+// ExtractPartitionFile copies the file at imagePath in the image partition chosen by selector to w
+func ExtractPartitionFile(imageFilename string, selector PartitionSelector, imagePath string, w io.Writer) error {
+	v, err := openVolume(imageFilename, selector)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+	return v.extractFile(imageFilename, imagePath, w)
+}
+
+// extractFile copies the file at imagePath in the volume to w; imageFilename names the image in errors
+func (v *volume) extractFile(imageFilename, imagePath string, w io.Writer) error {
+	fs := v.fs
+	imagePath = cleanImagePath(imagePath)
+	isoEntries, err := v.isoEntries()
+	if err != nil {
+		return err
+	}
+	if entry := isoEntries[imagePath]; isSpecialFile(entry) {
+		return fmt.Errorf("%s: %s: %w", imagePath, specialFileDescription(entry), ErrSpecialFile)
+	}
+	dir, name := path.Split(imagePath)
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("not found in %s: %s", imageFilename, imagePath)
+	}
+	found := false
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Name(), name) {
+			if entry.IsDir() {
+				return fmt.Errorf("is a directory: %s", imagePath)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("not found in %s: %s", imageFilename, imagePath)
+	}
+	fp, err := fs.OpenFile(imagePath, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = io.Copy(w, fp)
+	return err
+}
+
+// checkGlob returns an error if pattern is not a valid glob
+func checkGlob(pattern string) error {
+	_, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), "")
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// matchAnyGlob returns true if imagePath matches one of patterns
+func matchAnyGlob(patterns []string, imagePath string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, imagePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches an image path against a glob pattern. A pattern without a slash matches the base
+// name; otherwise it matches the whole path, with ** matching any number of directories.
+func matchGlob(pattern, imagePath string) bool {
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(imagePath))
+		return matched
+	}
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(imagePath, "/"), "/")
+	return matchGlobParts(patternParts, pathParts)
+}
+
+func matchGlobParts(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchGlobParts(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		matched, _ := path.Match(pattern[0], parts[0])
+		if !matched {
+			return false
+		}
+		pattern = pattern[1:]
+		parts = parts[1:]
+	}
+	return len(parts) == 0
+}
@@ -0,0 +1,348 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mkMaliciousISO returns a test ISO with files named for later patching
+func mkMaliciousISO(t *testing.T, dir string) string {
+	files := map[string]string{
+		"/readme.txt":                 mkTestFile(t, dir, "readme.txt", "harmless\n"),
+		"/docs/escape-12345":          mkTestFile(t, dir, "escape.src", "escaped\n"),
+		"/ab":                         mkTestFile(t, dir, "ab", "dotdot\n"),
+		"/link-to-passwd-padding.txt": mkTestFile(t, dir, "link", ""),
+		"/dev-console":                mkTestFile(t, dir, "console", ""),
+	}
+	return buildTestISO(t, dir, "malicious.iso", files, nil)
+}
+
+// isoRecord returns the image offset and bytes of the directory record for name in isoImage
+func isoRecord(t *testing.T, isoImage, name string) (int64, []byte) {
+	fp, err := os.Open(isoImage)
+	require.Nil(t, err)
+	defer fp.Close()
+	entries, err := readISOEntries(fp)
+	require.Nil(t, err)
+	for _, entry := range entries {
+		if entry.path == name {
+			length := make([]byte, 1)
+			_, err = fp.ReadAt(length, entry.offset)
+			require.Nil(t, err)
+			record := make([]byte, length[0])
+			_, err = fp.ReadAt(record, entry.offset)
+			require.Nil(t, err)
+			return entry.offset, record
+		}
+	}
+	require.Fail(t, "ISO entry not found", name)
+	return 0, nil
+}
+
+// patchISORecord rewrites the directory record for name with patch applied
+func patchISORecord(t *testing.T, isoImage, name string, patch func(record []byte)) {
+	offset, record := isoRecord(t, isoImage, name)
+	patch(record)
+	fp, err := os.OpenFile(isoImage, os.O_RDWR, 0)
+	require.Nil(t, err)
+	defer fp.Close()
+	_, err = fp.WriteAt(record, offset)
+	require.Nil(t, err)
+}
+
+// susp returns the system use entry with signature in record
+func susp(t *testing.T, record []byte, signature string) []byte {
+	index := bytes.Index(record[systemUseOffset(record):], []byte(signature))
+	require.GreaterOrEqual(t, index, 0, signature)
+	start := systemUseOffset(record) + index
+	return record[start : start+int(record[start+2])]
+}
+
+// setRockRidgeName replaces the NM entry of a record with a name of the same length
+func setRockRidgeName(t *testing.T, name string) func([]byte) {
+	return func(record []byte) {
+		nm := susp(t, record, "NM")
+		require.Equal(t, len(nm)-5, len(name))
+		copy(nm[5:], name)
+	}
+}
+
+// setRockRidgeMode replaces the PX mode of a record
+func setRockRidgeMode(t *testing.T, mode uint32) func([]byte) {
+	return func(record []byte) {
+		px := susp(t, record, "PX")
+		binary.LittleEndian.PutUint32(px[4:8], mode)
+		binary.BigEndian.PutUint32(px[8:12], mode)
+	}
+}
+
+// setRockRidgeSymlink turns a record into a symlink to /etc/passwd, replacing its NM entry with SL and PD entries
+func setRockRidgeSymlink(t *testing.T) func([]byte) {
+	return func(record []byte) {
+		setRockRidgeMode(t, posixSymlink|0777)(record)
+		nm := susp(t, record, "NM")
+		components := []byte{0x08, 0, 0, 3, 'e', 't', 'c', 0, 6, 'p', 'a', 's', 's', 'w', 'd'}
+		sl := append([]byte{'S', 'L', byte(5 + len(components)), 1, 0}, components...)
+		pd := []byte{'P', 'D', byte(len(nm) - len(sl)), 1}
+		require.GreaterOrEqual(t, len(nm)-len(sl), 4)
+		copy(nm, sl)
+		copy(nm[len(sl):], pd)
+	}
+}
+
+// isoPathAt returns the image path of the entry whose record is at offset
+func isoPathAt(t *testing.T, isoImage string, offset int64) *isoEntry {
+	fp, err := os.Open(isoImage)
+	require.Nil(t, err)
+	defer fp.Close()
+	entries, err := readISOEntries(fp)
+	require.Nil(t, err)
+	for _, entry := range entries {
+		if entry.offset == offset {
+			return entry
+		}
+	}
+	require.Fail(t, "no ISO entry at offset", offset)
+	return nil
+}
+
+func TestExtractTraversal(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkMaliciousISO(t, dir)
+	patchISORecord(t, isoImage, "/docs/escape-12345", setRockRidgeName(t, "../../escape"))
+
+	destDir := filepath.Join(dir, "a", "b", "dest")
+	require.Nil(t, os.MkdirAll(destDir, 0700))
+	err := ExtractImageFiles(t.Context(), isoImage, destDir)
+	require.ErrorIs(t, err, ErrUnsafePath)
+	require.ErrorContains(t, err, `/../escape" from /docs`)
+	require.NoFileExists(t, filepath.Join(dir, "a", "escape"))
+	require.NoFileExists(t, filepath.Join(dir, "escape"))
+
+	dotdotImage := mkMaliciousISO(t, t.TempDir())
+	patchISORecord(t, dotdotImage, "/ab", setRockRidgeName(t, ".."))
+	err = ExtractImageFiles(t.Context(), dotdotImage, t.TempDir())
+	require.ErrorIs(t, err, ErrUnsafePath)
+	require.ErrorContains(t, err, "from /:")
+}
+
+func TestExtractPreexistingSymlink(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkMaliciousISO(t, dir)
+	outside := mkTestFile(t, dir, "outside.txt", "outside\n")
+	destDir := filepath.Join(dir, "dest")
+	require.Nil(t, os.Mkdir(destDir, 0700))
+	require.Nil(t, os.Symlink(outside, filepath.Join(destDir, "readme.txt")))
+
+	err := ExtractImageFiles(t.Context(), isoImage, destDir)
+	require.ErrorContains(t, err, "/readme.txt")
+	data, err := os.ReadFile(outside)
+	require.Nil(t, err)
+	require.Equal(t, "outside\n", string(data))
+}
+
+func TestExtractSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkMaliciousISO(t, dir)
+	linkOffset, _ := isoRecord(t, isoImage, "/link-to-passwd-padding.txt")
+	patchISORecord(t, isoImage, "/link-to-passwd-padding.txt", setRockRidgeSymlink(t))
+	patchISORecord(t, isoImage, "/dev-console", setRockRidgeMode(t, posixChar|0600))
+
+	link := isoPathAt(t, isoImage, linkOffset)
+	require.Equal(t, os.ModeSymlink, link.mode.Type())
+	require.Equal(t, "/etc/passwd", link.symlink)
+
+	// by default symlinks and devices are skipped
+	destDir := filepath.Join(dir, "skip")
+	require.Nil(t, os.Mkdir(destDir, 0700))
+	err := ExtractImageFiles(t.Context(), isoImage, destDir)
+	require.Nil(t, err)
+	require.FileExists(t, filepath.Join(destDir, "readme.txt"))
+	require.NoFileExists(t, filepath.Join(destDir, "dev-console"))
+	_, err = os.Lstat(filepath.Join(destDir, filepath.FromSlash(link.path)))
+	require.True(t, os.IsNotExist(err))
+
+	err = ExtractImage(t.Context(), isoImage, t.TempDir(), ExtractOptions{Symlinks: SpecialError})
+	require.ErrorIs(t, err, ErrSpecialFile)
+	require.ErrorContains(t, err, link.path)
+	require.ErrorContains(t, err, `symlink to "/etc/passwd"`)
+
+	err = ExtractImage(t.Context(), isoImage, t.TempDir(), ExtractOptions{Devices: SpecialError})
+	require.ErrorIs(t, err, ErrSpecialFile)
+	require.ErrorContains(t, err, "/dev-console: character device")
+
+	_, err = ParseSpecialFilePolicy("follow")
+	require.NotNil(t, err)
+	policy, err := ParseSpecialFilePolicy("ERROR")
+	require.Nil(t, err)
+	require.Equal(t, SpecialError, policy)
+}
+
+func TestExtractGlob(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+
+	destDir := filepath.Join(dir, "include")
+	require.Nil(t, os.Mkdir(destDir, 0700))
+	err := ExtractImage(t.Context(), isoImage, destDir, ExtractOptions{Include: []string{"autoexec.ipxe"}})
+	require.Nil(t, err)
+	require.FileExists(t, filepath.Join(destDir, "autoexec.ipxe"))
+	require.NoFileExists(t, filepath.Join(destDir, "esp.img"))
+	require.NoDirExists(t, filepath.Join(destDir, "docs"))
+
+	// extracting again over existing directories succeeds
+	err = ExtractImage(t.Context(), isoImage, destDir, ExtractOptions{Include: []string{"/docs/**"}})
+	require.Nil(t, err)
+	err = ExtractImage(t.Context(), isoImage, destDir, ExtractOptions{Include: []string{"/docs/*.txt"}})
+	require.Nil(t, err)
+	require.FileExists(t, filepath.Join(destDir, "docs", "readme.txt"))
+
+	destDir = filepath.Join(dir, "exclude")
+	require.Nil(t, os.Mkdir(destDir, 0700))
+	err = ExtractImage(t.Context(), isoImage, destDir, ExtractOptions{Exclude: []string{"/docs", "*.img"}})
+	require.Nil(t, err)
+	require.FileExists(t, filepath.Join(destDir, "isolinux.bin"))
+	require.NoFileExists(t, filepath.Join(destDir, "esp.img"))
+	require.NoDirExists(t, filepath.Join(destDir, "docs"))
+
+	err = ExtractImage(t.Context(), isoImage, destDir, ExtractOptions{Include: []string{"[bad"}})
+	require.ErrorContains(t, err, "invalid pattern")
+
+	require.True(t, matchGlob("*.EFI", "/EFI/BOOT/BOOTX64.EFI"))
+	require.True(t, matchGlob("/EFI/**/*.EFI", "/EFI/BOOT/BOOTX64.EFI"))
+	require.True(t, matchGlob("**/BOOTX64.EFI", "/EFI/BOOT/BOOTX64.EFI"))
+	require.True(t, matchGlob("EFI/BOOT", "/EFI/BOOT"))
+	require.False(t, matchGlob("/EFI/*.EFI", "/EFI/BOOT/BOOTX64.EFI"))
+	require.False(t, matchGlob("/EFI", "/EFI/BOOT"))
+}
+
+func TestExtractNoClobber(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+
+	files, err := PlanExtract(isoImage, ExtractOptions{Exclude: []string{"*.img"}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"/autoexec.ipxe", "/docs/readme.txt", "/isolinux.bin"}, files)
+
+	destDir := filepath.Join(dir, "out")
+	require.Nil(t, os.MkdirAll(filepath.Join(destDir, "docs"), 0700))
+	readme := filepath.Join(destDir, "docs", "readme.txt")
+	require.Nil(t, os.WriteFile(readme, []byte("local\n"), 0600))
+	err = ExtractImage(t.Context(), isoImage, destDir, ExtractOptions{Exclude: []string{"*.img"}, NoClobber: true})
+	require.Nil(t, err)
+	data, err := os.ReadFile(readme)
+	require.Nil(t, err)
+	require.Equal(t, "local\n", string(data))
+	require.FileExists(t, filepath.Join(destDir, "autoexec.ipxe"))
+
+	err = ExtractImage(t.Context(), isoImage, destDir, ExtractOptions{Exclude: []string{"*.img"}})
+	require.Nil(t, err)
+	data, err = os.ReadFile(readme)
+	require.Nil(t, err)
+	require.Equal(t, "netboot test image\n", string(data))
+}
+
+func TestExtractFile(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+	var buf bytes.Buffer
+	err := ExtractFile(isoImage, "autoexec.ipxe", &buf)
+	require.Nil(t, err)
+	require.Equal(t, "#!ipxe\necho source\n", buf.String())
+
+	err = ExtractFile(isoImage, "/docs", &buf)
+	require.ErrorContains(t, err, "is a directory")
+	err = ExtractFile(isoImage, "/missing.txt", &buf)
+	require.ErrorContains(t, err, "not found")
+
+	// FAT lookups ignore case
+	buf.Reset()
+	err = ExtractFile(filepath.Join(dir, "esp.img"), "/efi/boot/bootx64.efi", &buf)
+	require.Nil(t, err)
+	require.Equal(t, 6000, buf.Len())
+}
+
+// setRockRidgeTimes replaces the record date and the TF timestamps of a record
+func setRockRidgeTimes(t *testing.T, stamp time.Time) func([]byte) {
+	return func(record []byte) {
+		date := []byte{byte(stamp.Year() - 1900), byte(stamp.Month()), byte(stamp.Day()), byte(stamp.Hour()), byte(stamp.Minute()), byte(stamp.Second()), 0}
+		copy(record[18:25], date)
+		tf := susp(t, record, "TF")
+		require.Zero(t, tf[4]&0x80)
+		for i := 5; i+7 <= len(tf); i += 7 {
+			copy(tf[i:i+7], date)
+		}
+	}
+}
+
+func TestExtractPreserve(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkMaliciousISO(t, dir)
+	stamp := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	patchISORecord(t, isoImage, "/readme.txt", setRockRidgeMode(t, posixRegular|0640))
+	patchISORecord(t, isoImage, "/readme.txt", setRockRidgeTimes(t, stamp))
+	patchISORecord(t, isoImage, "/docs", setRockRidgeMode(t, posixDirectory|0750))
+	patchISORecord(t, isoImage, "/docs", setRockRidgeTimes(t, stamp))
+	linkOffset, _ := isoRecord(t, isoImage, "/link-to-passwd-padding.txt")
+	patchISORecord(t, isoImage, "/link-to-passwd-padding.txt", setRockRidgeSymlink(t))
+	link := isoPathAt(t, isoImage, linkOffset)
+
+	// without the preserve options files get default modes and the current time
+	destDir := filepath.Join(dir, "default")
+	require.Nil(t, os.Mkdir(destDir, 0700))
+	err := ExtractImageFiles(t.Context(), isoImage, destDir)
+	require.Nil(t, err)
+	stat, err := os.Stat(filepath.Join(destDir, "readme.txt"))
+	require.Nil(t, err)
+	require.NotEqual(t, stamp, stat.ModTime().UTC())
+
+	destDir = filepath.Join(dir, "preserve")
+	require.Nil(t, os.Mkdir(destDir, 0700))
+	options := ExtractOptions{PreserveTimes: true, PreserveMode: true, Symlinks: SpecialCreate}
+	err = ExtractImage(t.Context(), isoImage, destDir, options)
+	require.Nil(t, err)
+	stat, err = os.Stat(filepath.Join(destDir, "readme.txt"))
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0640), stat.Mode())
+	require.Equal(t, stamp, stat.ModTime().UTC())
+	stat, err = os.Stat(filepath.Join(destDir, "docs"))
+	require.Nil(t, err)
+	require.Equal(t, os.ModeDir|0750, stat.Mode())
+	require.Equal(t, stamp, stat.ModTime().UTC())
+	target, err := os.Readlink(filepath.Join(destDir, filepath.FromSlash(link.path)))
+	require.Nil(t, err)
+	require.Equal(t, "/etc/passwd", target)
+
+	err = ExtractImage(t.Context(), isoImage, t.TempDir(), ExtractOptions{Devices: SpecialCreate})
+	require.ErrorContains(t, err, "device nodes cannot be created")
+}
+
+func TestExtractPreserveFAT(t *testing.T) {
+	dir := t.TempDir()
+	fatImage := filepath.Join(dir, "fat.img")
+	fs, fp, err := createFATImage(fatImage, EFI_IMAGE_SIZE, FATAuto, "", BuildStamp{})
+	require.Nil(t, err)
+	stamp := time.Date(2010, 6, 7, 8, 9, 10, 0, time.Local)
+	fs.now = func() time.Time { return stamp }
+	require.Nil(t, fs.Mkdir("/EFI/BOOT"))
+	require.Nil(t, copyFileToImage(t.Context(), fs, "/EFI/BOOT/grub.cfg", mkTestFile(t, dir, "grub.cfg", "set timeout=1\n"), nil))
+	require.Nil(t, fp.Close())
+
+	destDir := filepath.Join(dir, "dest")
+	require.Nil(t, os.Mkdir(destDir, 0700))
+	err = ExtractImage(t.Context(), fatImage, destDir, ExtractOptions{PreserveTimes: true, PreserveMode: true})
+	require.Nil(t, err)
+	stat, err := os.Stat(filepath.Join(destDir, "EFI", "BOOT", "grub.cfg"))
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), stat.Mode())
+	require.True(t, stamp.Equal(stat.ModTime()), stat.ModTime())
+	stat, err = os.Stat(filepath.Join(destDir, "EFI"))
+	require.Nil(t, err)
+	require.Equal(t, os.ModeDir|0755, stat.Mode())
+	require.True(t, stamp.Equal(stat.ModTime()), stat.ModTime())
+}
@@ -0,0 +1,69 @@
+//go:build unix
+
+package image
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExtractPreserveOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir := t.TempDir()
+	isoImage := mkMaliciousISO(t, dir)
+	patchISORecord(t, isoImage, "/readme.txt", func(record []byte) {
+		px := susp(t, record, "PX")
+		binary.LittleEndian.PutUint32(px[20:24], 1234)
+		binary.BigEndian.PutUint32(px[24:28], 1234)
+		binary.LittleEndian.PutUint32(px[28:32], 5678)
+		binary.BigEndian.PutUint32(px[32:36], 5678)
+	})
+
+	destDir := filepath.Join(dir, "dest")
+	require.Nil(t, os.Mkdir(destDir, 0700))
+	err := ExtractImage(t.Context(), isoImage, destDir, ExtractOptions{PreserveOwner: true})
+	require.Nil(t, err)
+	stat, err := os.Stat(filepath.Join(destDir, "readme.txt"))
+	require.Nil(t, err)
+	sys := stat.Sys().(*syscall.Stat_t)
+	require.Equal(t, uint32(1234), sys.Uid)
+	require.Equal(t, uint32(5678), sys.Gid)
+}
+
+func TestExtractMetadataSymlink(t *testing.T) {
+	dir := t.TempDir()
+	outside := mkTestFile(t, dir, "outside.txt", "outside\n")
+	require.Nil(t, os.Chmod(outside, 0600))
+	destDir := filepath.Join(dir, "dest")
+	require.Nil(t, os.Mkdir(destDir, 0700))
+	require.Nil(t, os.Symlink(outside, filepath.Join(destDir, "link.txt")))
+	root, err := os.OpenRoot(destDir)
+	require.Nil(t, err)
+	defer root.Close()
+
+	// preserved metadata is never applied through a symlink in the destination
+	x := extractor{root: root, options: ExtractOptions{PreserveMode: true, PreserveTimes: true}}
+	info, err := os.Stat(outside)
+	require.Nil(t, err)
+	entry := &isoEntry{mode: 0777, modTime: time.Unix(1700000000, 0), rockRidge: true}
+	require.Nil(t, x.setMetadata("link.txt", info, entry))
+	stat, err := os.Stat(outside)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	require.Equal(t, info.ModTime(), stat.ModTime())
+
+	// a parent reached through a symlink leaving the destination is refused
+	require.Nil(t, os.Symlink(dir, filepath.Join(destDir, "up")))
+	err = x.setMetadata(filepath.Join("up", "outside.txt"), info, entry)
+	require.NotNil(t, err)
+	stat, err = os.Stat(outside)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+}
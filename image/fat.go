@@ -0,0 +1,1494 @@
+package image
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FATType selects the FAT variant of a filesystem
+type FATType int
+
+const (
+	FATAuto FATType = 0
+	FAT12   FATType = 12
+	FAT16   FATType = 16
+	FAT32   FATType = 32
+)
+
+const (
+	FAT_SECTOR_SIZE     = 512
+	FAT_DIR_ENTRY_SIZE  = 32
+	FAT_MAX_AUTO_SPC    = 8
+	FAT12_MAX_CLUSTERS  = 4084
+	FAT16_MAX_CLUSTERS  = 65524
+	FAT32_MAX_CLUSTERS  = 0x0ffffff4
+	FAT_ROOT_ENTRIES    = 512
+	FAT32_RESERVED      = 32
+	FAT32_FSINFO_SECTOR = 1
+	FAT32_BACKUP_SECTOR = 6
+)
+
+const (
+	fatAttrReadOnly  = 0x01
+	fatAttrHidden    = 0x02
+	fatAttrSystem    = 0x04
+	fatAttrVolumeID  = 0x08
+	fatAttrDirectory = 0x10
+	fatAttrArchive   = 0x20
+	fatAttrLongName  = 0x0f
+)
+
+func (t FATType) String() string {
+	if t == FATAuto {
+		return "auto"
+	}
+	return fmt.Sprintf("FAT%d", int(t))
+}
+
+// ParseFATType converts a name such as "fat16", "16" or "auto" to a FATType
+func ParseFATType(name string) (FATType, error) {
+	value := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "fat")
+	switch value {
+	case "", "auto":
+		return FATAuto, nil
+	case "12":
+		return FAT12, nil
+	case "16":
+		return FAT16, nil
+	case "32":
+		return FAT32, nil
+	}
+	return FATAuto, fmt.Errorf("unknown FAT type: %s", name)
+}
+
+// ParseSize converts a byte count with an optional K, M or G suffix to bytes
+func ParseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return size * multiplier, nil
+}
+
+// fatDevice is the storage holding a FAT filesystem
+type fatDevice interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// fatLayout describes the on-disk geometry of a FAT filesystem
+type fatLayout struct {
+	fatType           FATType
+	bytesPerSector    int64
+	sectorsPerCluster int64
+	reservedSectors   int64
+	numFATs           int64
+	rootEntries       int64
+	totalSectors      int64
+	fatSectors        int64
+	clusterCount      int64
+	mediaType         byte
+	sectorsPerTrack   uint16
+	heads             uint16
+}
+
+func (l *fatLayout) clusterSize() int64 {
+	return l.bytesPerSector * l.sectorsPerCluster
+}
+
+func (l *fatLayout) rootDirSectors() int64 {
+	return (l.rootEntries*FAT_DIR_ENTRY_SIZE + l.bytesPerSector - 1) / l.bytesPerSector
+}
+
+func (l *fatLayout) fatOffset(index int64) int64 {
+	return (l.reservedSectors + index*l.fatSectors) * l.bytesPerSector
+}
+
+func (l *fatLayout) rootDirOffset() int64 {
+	return l.fatOffset(l.numFATs)
+}
+
+func (l *fatLayout) dataOffset() int64 {
+	return l.rootDirOffset() + l.rootDirSectors()*l.bytesPerSector
+}
+
+// maxClusters returns the largest cluster count allowed for the layout's FAT type
+func (l *fatLayout) maxClusters() int64 {
+	switch l.fatType {
+	case FAT12:
+		return FAT12_MAX_CLUSTERS
+	case FAT16:
+		return FAT16_MAX_CLUSTERS
+	}
+	return FAT32_MAX_CLUSTERS
+}
+
+// minClusters returns the smallest cluster count allowed for the layout's FAT type
+func (l *fatLayout) minClusters() int64 {
+	switch l.fatType {
+	case FAT16:
+		return FAT12_MAX_CLUSTERS + 1
+	case FAT32:
+		return FAT16_MAX_CLUSTERS + 1
+	}
+	return 1
+}
+
+// newFATLayout computes the geometry of a FAT filesystem of fatType filling size bytes
+func newFATLayout(size int64, fatType FATType) (*fatLayout, error) {
+	if fatType == FATAuto {
+		for _, t := range []FATType{FAT12, FAT16} {
+			layout, err := computeFATLayout(size, t, FAT_MAX_AUTO_SPC)
+			if err == nil {
+				return layout, nil
+			}
+		}
+		return computeFATLayout(size, FAT32, 128)
+	}
+	return computeFATLayout(size, fatType, 128)
+}
+
+func computeFATLayout(size int64, fatType FATType, maxSPC int64) (*fatLayout, error) {
+	layout := fatLayout{
+		fatType:         fatType,
+		bytesPerSector:  FAT_SECTOR_SIZE,
+		reservedSectors: 1,
+		numFATs:         2,
+		rootEntries:     FAT_ROOT_ENTRIES,
+		totalSectors:    size / FAT_SECTOR_SIZE,
+		mediaType:       0xf8,
+		sectorsPerTrack: 63,
+		heads:           255,
+	}
+	switch {
+	case fatType == FAT32:
+		layout.reservedSectors = FAT32_RESERVED
+		layout.rootEntries = 0
+	case size == 1440*1024:
+		layout.rootEntries = 224
+		layout.mediaType = 0xf0
+		layout.sectorsPerTrack = 18
+		layout.heads = 2
+	case size == 2880*1024:
+		layout.rootEntries = 240
+		layout.mediaType = 0xf0
+		layout.sectorsPerTrack = 36
+		layout.heads = 2
+	}
+	if fatType == FAT32 && layout.totalSectors > 0xffffffff {
+		return nil, fmt.Errorf("size %d is too large for %s", size, fatType)
+	}
+	bits := int64(fatType)
+	for spc := int64(1); spc <= maxSPC; spc *= 2 {
+		layout.sectorsPerCluster = spc
+		layout.fatSectors = 1
+		for {
+			metaSectors := layout.reservedSectors + layout.numFATs*layout.fatSectors + layout.rootDirSectors()
+			if metaSectors >= layout.totalSectors {
+				layout.clusterCount = 0
+				break
+			}
+			layout.clusterCount = (layout.totalSectors - metaSectors) / spc
+			fatBytes := ((layout.clusterCount+2)*bits + 7) / 8
+			needed := (fatBytes + layout.bytesPerSector - 1) / layout.bytesPerSector
+			if needed <= layout.fatSectors {
+				break
+			}
+			layout.fatSectors = needed
+		}
+		if layout.clusterCount > layout.maxClusters() {
+			continue
+		}
+		if layout.clusterCount >= layout.minClusters() {
+			return &layout, nil
+		}
+		break
+	}
+	return nil, fmt.Errorf("size %d is not valid for %s", size, fatType)
+}
+
+// fatFS is a FAT12, FAT16 or FAT32 filesystem implementing filesystem.FileSystem
+type fatFS struct {
+	device   fatDevice
+	start    int64
+	layout   fatLayout
+	fat      []uint32
+	label    string
+	serial   uint32
+	root     uint32
+	nextFree uint32
+	now      func() time.Time
+	// fatDirty is set when the in-memory table has changes not yet written to the FAT copies
+	fatDirty bool
+}
+
+// fatDirEntry is a parsed directory entry
+type fatDirEntry struct {
+	name      string
+	shortName string
+	attr      byte
+	cluster   uint32
+	size      uint32
+	modTime   time.Time
+	// accessTime is the last access date; FAT records no time of day
+	accessTime time.Time
+	// offset is the byte offset of the short entry within its directory
+	offset int
+	// slots is the number of directory slots used, including long name entries
+	slots int
+}
+
+func (e *fatDirEntry) isDir() bool {
+	return e.attr&fatAttrDirectory != 0
+}
+
+// fatFileInfo implements os.FileInfo for a FAT directory entry
+type fatFileInfo struct {
+	entry *fatDirEntry
+}
+
+func (fi fatFileInfo) Name() string {
+	return fi.entry.name
+}
+
+func (fi fatFileInfo) Size() int64 {
+	return int64(fi.entry.size)
+}
+
+func (fi fatFileInfo) Mode() os.FileMode {
+	mode := os.FileMode(0644)
+	if fi.entry.attr&fatAttrReadOnly != 0 {
+		mode = 0444
+	}
+	if fi.entry.isDir() {
+		mode |= os.ModeDir | 0111
+	}
+	return mode
+}
+
+func (fi fatFileInfo) ModTime() time.Time {
+	return fi.entry.modTime
+}
+
+// AccessTime returns the last access date of the entry
+func (fi fatFileInfo) AccessTime() time.Time {
+	return fi.entry.accessTime
+}
+
+func (fi fatFileInfo) IsDir() bool {
+	return fi.entry.isDir()
+}
+
+func (fi fatFileInfo) Sys() interface{} {
+	return nil
+}
+
+// formatFAT writes an empty FAT filesystem of size bytes at start and returns it
+func formatFAT(device fatDevice, start, size int64, fatType FATType, label string, stamp BuildStamp) (*fatFS, error) {
+	layout, err := newFATLayout(size, fatType)
+	if err != nil {
+		return nil, err
+	}
+	fs := &fatFS{
+		device: device,
+		start:  start,
+		layout: *layout,
+		label:  label,
+		now:    stamp.now,
+		serial: stamp.serial(),
+	}
+
+	fs.fat = make([]uint32, layout.clusterCount+2)
+	fs.fat[0] = fs.eocMark()&^0xff | uint32(layout.mediaType)
+	fs.fat[1] = fs.eocMark()
+	fs.nextFree = 2
+
+	// zero the reserved sectors, FATs and root directory region
+	zero := make([]byte, layout.dataOffset())
+	_, err = device.WriteAt(zero, start)
+	if err != nil {
+		return nil, err
+	}
+
+	if layout.fatType == FAT32 {
+		fs.root = 2
+		fs.fat[fs.root] = fs.eocMark()
+		fs.nextFree = 3
+		err = fs.zeroCluster(fs.root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = fs.writeBootSector()
+	if err != nil {
+		return nil, err
+	}
+	err = fs.flushFAT()
+	if err != nil {
+		return nil, err
+	}
+	if label != "" {
+		entry := fatShortEntry(fatLabelBytes(label), fatAttrVolumeID, 0, 0, fs.now())
+		err = fs.writeDirectory(fs.root, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// parseFATBootSector returns the layout described by a FAT boot sector
+func parseFATBootSector(b []byte) (*fatLayout, error) {
+	if b[0] != 0xeb && b[0] != 0xe9 {
+		return nil, fmt.Errorf("boot sector jump instruction not found")
+	}
+	layout := fatLayout{
+		bytesPerSector:    int64(binary.LittleEndian.Uint16(b[11:13])),
+		sectorsPerCluster: int64(b[13]),
+		reservedSectors:   int64(binary.LittleEndian.Uint16(b[14:16])),
+		numFATs:           int64(b[16]),
+		rootEntries:       int64(binary.LittleEndian.Uint16(b[17:19])),
+		totalSectors:      int64(binary.LittleEndian.Uint16(b[19:21])),
+		mediaType:         b[21],
+		fatSectors:        int64(binary.LittleEndian.Uint16(b[22:24])),
+		sectorsPerTrack:   binary.LittleEndian.Uint16(b[24:26]),
+		heads:             binary.LittleEndian.Uint16(b[26:28]),
+	}
+	switch layout.bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("invalid bytes per sector: %d", layout.bytesPerSector)
+	}
+	spc := layout.sectorsPerCluster
+	if spc == 0 || spc&(spc-1) != 0 {
+		return nil, fmt.Errorf("invalid sectors per cluster: %d", spc)
+	}
+	if layout.reservedSectors == 0 || layout.numFATs == 0 {
+		return nil, fmt.Errorf("invalid BIOS parameter block")
+	}
+	if layout.totalSectors == 0 {
+		layout.totalSectors = int64(binary.LittleEndian.Uint32(b[32:36]))
+	}
+	if layout.fatSectors == 0 {
+		layout.fatSectors = int64(binary.LittleEndian.Uint32(b[36:40]))
+	}
+	if layout.fatSectors == 0 || layout.totalSectors == 0 {
+		return nil, fmt.Errorf("invalid BIOS parameter block")
+	}
+	metaSectors := layout.reservedSectors + layout.numFATs*layout.fatSectors + layout.rootDirSectors()
+	if metaSectors >= layout.totalSectors {
+		return nil, fmt.Errorf("invalid BIOS parameter block")
+	}
+	layout.clusterCount = (layout.totalSectors - metaSectors) / spc
+	switch {
+	case layout.clusterCount <= FAT12_MAX_CLUSTERS:
+		layout.fatType = FAT12
+	case layout.clusterCount <= FAT16_MAX_CLUSTERS:
+		layout.fatType = FAT16
+	default:
+		layout.fatType = FAT32
+	}
+	if (layout.fatType == FAT32) != (layout.rootEntries == 0) {
+		return nil, fmt.Errorf("invalid BIOS parameter block")
+	}
+	// the FAT must hold an entry for every cluster
+	entryBits := map[FATType]int64{FAT12: 12, FAT16: 16, FAT32: 32}[layout.fatType]
+	needed := ((layout.clusterCount+2)*entryBits + 7) / 8
+	if layout.fatSectors*layout.bytesPerSector < needed {
+		return nil, fmt.Errorf("%d byte FAT is too small for %d clusters", layout.fatSectors*layout.bytesPerSector, layout.clusterCount)
+	}
+	return &layout, nil
+}
+
+// readFAT opens an existing FAT filesystem at start
+func readFAT(device fatDevice, start, size int64) (*fatFS, error) {
+	b := make([]byte, FAT_SECTOR_SIZE)
+	_, err := device.ReadAt(b, start)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading boot sector: %v", err)
+	}
+	layout, err := parseFATBootSector(b)
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 && layout.totalSectors*layout.bytesPerSector > size {
+		return nil, fmt.Errorf("filesystem size exceeds device size")
+	}
+	fs := &fatFS{
+		device: device,
+		start:  start,
+		layout: *layout,
+		now:    time.Now,
+	}
+	labelOffset := 43
+	if layout.fatType == FAT32 {
+		fs.root = binary.LittleEndian.Uint32(b[44:48])
+		labelOffset = 71
+	}
+	if b[labelOffset-5] == 0x29 {
+		fs.serial = binary.LittleEndian.Uint32(b[labelOffset-4 : labelOffset])
+		fs.label = strings.TrimRight(string(b[labelOffset:labelOffset+11]), " \x00")
+		if fs.label == "NO NAME" {
+			fs.label = ""
+		}
+	}
+
+	fatBytes := make([]byte, layout.fatSectors*layout.bytesPerSector)
+	_, err = device.ReadAt(fatBytes, start+layout.fatOffset(0))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading FAT: %v", err)
+	}
+	fs.fat = make([]uint32, layout.clusterCount+2)
+	for i := range fs.fat {
+		fs.fat[i] = decodeFATEntry(fatBytes, layout.fatType, i)
+	}
+	fs.nextFree = 2
+
+	// the root directory volume label entry takes precedence over the boot sector label
+	entries, err := fs.readDirEntries(fs.root, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.attr&fatAttrVolumeID != 0 && entry.attr != fatAttrLongName {
+			fs.label = strings.TrimRight(entry.shortName, " ")
+		}
+	}
+	return fs, nil
+}
+
+func decodeFATEntry(b []byte, fatType FATType, index int) uint32 {
+	switch fatType {
+	case FAT12:
+		offset := index + index/2
+		if offset+1 >= len(b) {
+			return 0
+		}
+		value := binary.LittleEndian.Uint16(b[offset : offset+2])
+		if index%2 == 1 {
+			return uint32(value >> 4)
+		}
+		return uint32(value & 0x0fff)
+	case FAT16:
+		if index*2+2 > len(b) {
+			return 0
+		}
+		return uint32(binary.LittleEndian.Uint16(b[index*2 : index*2+2]))
+	}
+	if index*4+4 > len(b) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b[index*4:index*4+4]) & 0x0fffffff
+}
+
+func encodeFATEntry(b []byte, fatType FATType, index int, value uint32) {
+	switch fatType {
+	case FAT12:
+		offset := index + index/2
+		current := binary.LittleEndian.Uint16(b[offset : offset+2])
+		if index%2 == 1 {
+			current = current&0x000f | uint16(value)<<4
+		} else {
+			current = current&0xf000 | uint16(value)&0x0fff
+		}
+		binary.LittleEndian.PutUint16(b[offset:offset+2], current)
+	case FAT16:
+		binary.LittleEndian.PutUint16(b[index*2:index*2+2], uint16(value))
+	default:
+		current := binary.LittleEndian.Uint32(b[index*4 : index*4+4])
+		binary.LittleEndian.PutUint32(b[index*4:index*4+4], current&0xf0000000|value&0x0fffffff)
+	}
+}
+
+func (fs *fatFS) eocMark() uint32 {
+	switch fs.layout.fatType {
+	case FAT12:
+		return 0x0fff
+	case FAT16:
+		return 0xffff
+	}
+	return 0x0fffffff
+}
+
+func (fs *fatFS) isEOC(value uint32) bool {
+	return value >= fs.eocMark()&^0x7
+}
+
+// FATType returns the FAT variant of the filesystem
+func (fs *fatFS) FATType() FATType {
+	return fs.layout.fatType
+}
+
+func (fs *fatFS) writeBootSector() error {
+	l := &fs.layout
+	b := make([]byte, FAT_SECTOR_SIZE)
+	copy(b[3:11], "fdimage ")
+	binary.LittleEndian.PutUint16(b[11:13], uint16(l.bytesPerSector))
+	b[13] = byte(l.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(b[14:16], uint16(l.reservedSectors))
+	b[16] = byte(l.numFATs)
+	binary.LittleEndian.PutUint16(b[17:19], uint16(l.rootEntries))
+	if l.totalSectors < 0x10000 && l.fatType != FAT32 {
+		binary.LittleEndian.PutUint16(b[19:21], uint16(l.totalSectors))
+	} else {
+		binary.LittleEndian.PutUint32(b[32:36], uint32(l.totalSectors))
+	}
+	b[21] = l.mediaType
+	binary.LittleEndian.PutUint16(b[24:26], l.sectorsPerTrack)
+	binary.LittleEndian.PutUint16(b[26:28], l.heads)
+	// hidden sectors precede the filesystem in a partitioned disk
+	binary.LittleEndian.PutUint32(b[28:32], uint32(fs.start/FAT_SECTOR_SIZE))
+
+	label := fatLabelBytes(fs.label)
+	ebpb := 36
+	if l.fatType == FAT32 {
+		copy(b[0:3], []byte{0xeb, 0x58, 0x90})
+		binary.LittleEndian.PutUint32(b[36:40], uint32(l.fatSectors))
+		binary.LittleEndian.PutUint32(b[44:48], fs.root)
+		binary.LittleEndian.PutUint16(b[48:50], FAT32_FSINFO_SECTOR)
+		binary.LittleEndian.PutUint16(b[50:52], FAT32_BACKUP_SECTOR)
+		ebpb = 64
+	} else {
+		copy(b[0:3], []byte{0xeb, 0x3c, 0x90})
+		binary.LittleEndian.PutUint16(b[22:24], uint16(l.fatSectors))
+	}
+	if l.mediaType != 0xf0 {
+		b[ebpb] = 0x80
+	}
+	b[ebpb+2] = 0x29
+	binary.LittleEndian.PutUint32(b[ebpb+3:ebpb+7], fs.serial)
+	copy(b[ebpb+7:ebpb+18], label)
+	copy(b[ebpb+18:ebpb+26], fmt.Sprintf("%-8s", l.fatType.String()))
+	b[510] = 0x55
+	b[511] = 0xaa
+
+	_, err := fs.device.WriteAt(b, fs.start)
+	if err != nil {
+		return err
+	}
+	if l.fatType == FAT32 {
+		_, err = fs.device.WriteAt(b, fs.start+FAT32_BACKUP_SECTOR*l.bytesPerSector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushFAT writes the in-memory table to every FAT copy
+func (fs *fatFS) flushFAT() error {
+	l := &fs.layout
+	b := make([]byte, l.fatSectors*l.bytesPerSector)
+	if l.fatType == FAT32 {
+		// preserve the reserved high bits of existing entries
+		_, err := fs.device.ReadAt(b, fs.start+l.fatOffset(0))
+		if err != nil {
+			return err
+		}
+	}
+	for i, value := range fs.fat {
+		encodeFATEntry(b, l.fatType, i, value)
+	}
+	for i := int64(0); i < l.numFATs; i++ {
+		_, err := fs.device.WriteAt(b, fs.start+l.fatOffset(i))
+		if err != nil {
+			return err
+		}
+	}
+	fs.fatDirty = false
+	if l.fatType == FAT32 {
+		return fs.writeFSInfo()
+	}
+	return nil
+}
+
+// Sync writes the table to the FAT copies if it has changed since the last flush
+func (fs *fatFS) Sync() error {
+	if !fs.fatDirty {
+		return nil
+	}
+	return fs.flushFAT()
+}
+
+func (fs *fatFS) writeFSInfo() error {
+	b := make([]byte, FAT_SECTOR_SIZE)
+	binary.LittleEndian.PutUint32(b[0:4], 0x41615252)
+	binary.LittleEndian.PutUint32(b[484:488], 0x61417272)
+	binary.LittleEndian.PutUint32(b[488:492], fs.freeClusters())
+	binary.LittleEndian.PutUint32(b[492:496], fs.nextFree)
+	binary.LittleEndian.PutUint32(b[508:512], 0xaa550000)
+	for _, sector := range []int64{FAT32_FSINFO_SECTOR, FAT32_BACKUP_SECTOR + FAT32_FSINFO_SECTOR} {
+		_, err := fs.device.WriteAt(b, fs.start+sector*fs.layout.bytesPerSector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *fatFS) freeClusters() uint32 {
+	count := uint32(0)
+	for _, value := range fs.fat[2:] {
+		if value == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (fs *fatFS) clusterOffset(cluster uint32) int64 {
+	return fs.start + fs.layout.dataOffset() + int64(cluster-2)*fs.layout.clusterSize()
+}
+
+func (fs *fatFS) validCluster(cluster uint32) bool {
+	return cluster >= 2 && int(cluster) < len(fs.fat)
+}
+
+// chain returns the list of clusters starting at cluster
+func (fs *fatFS) chain(cluster uint32) ([]uint32, error) {
+	clusters := []uint32{}
+	if cluster == 0 {
+		return clusters, nil
+	}
+	for !fs.isEOC(cluster) {
+		if !fs.validCluster(cluster) {
+			return nil, fmt.Errorf("invalid cluster in chain: %d", cluster)
+		}
+		if len(clusters) >= len(fs.fat) {
+			return nil, fmt.Errorf("cluster chain loop at %d", cluster)
+		}
+		clusters = append(clusters, cluster)
+		cluster = fs.fat[cluster]
+	}
+	return clusters, nil
+}
+
+// allocate returns a free cluster linked after previous, or a new chain head if previous is 0
+func (fs *fatFS) allocate(previous uint32) (uint32, error) {
+	count := uint32(len(fs.fat))
+	for i := uint32(0); i < count-2; i++ {
+		cluster := fs.nextFree + i
+		if cluster >= count {
+			cluster -= count - 2
+		}
+		if fs.fat[cluster] == 0 {
+			fs.fat[cluster] = fs.eocMark()
+			if previous != 0 {
+				fs.fat[previous] = cluster
+			}
+			fs.nextFree = cluster + 1
+			if fs.nextFree >= count {
+				fs.nextFree = 2
+			}
+			fs.fatDirty = true
+			return cluster, nil
+		}
+	}
+	return 0, fmt.Errorf("no space left in image")
+}
+
+// release frees the chain starting at cluster
+func (fs *fatFS) release(cluster uint32) error {
+	clusters, err := fs.chain(cluster)
+	if err != nil {
+		return err
+	}
+	for _, c := range clusters {
+		fs.fat[c] = 0
+	}
+	if len(clusters) > 0 {
+		fs.fatDirty = true
+	}
+	if len(clusters) > 0 && clusters[0] < fs.nextFree {
+		fs.nextFree = clusters[0]
+	}
+	return nil
+}
+
+func (fs *fatFS) zeroCluster(cluster uint32) error {
+	_, err := fs.device.WriteAt(make([]byte, fs.layout.clusterSize()), fs.clusterOffset(cluster))
+	return err
+}
+
+// readDirectory returns the raw content of the directory starting at cluster (0 is the FAT12/16 root)
+func (fs *fatFS) readDirectory(cluster uint32) ([]byte, error) {
+	if cluster == 0 {
+		b := make([]byte, fs.layout.rootEntries*FAT_DIR_ENTRY_SIZE)
+		_, err := fs.device.ReadAt(b, fs.start+fs.layout.rootDirOffset())
+		return b, err
+	}
+	clusters, err := fs.chain(cluster)
+	if err != nil {
+		return nil, err
+	}
+	size := fs.layout.clusterSize()
+	b := make([]byte, int64(len(clusters))*size)
+	for i, c := range clusters {
+		_, err := fs.device.ReadAt(b[int64(i)*size:int64(i+1)*size], fs.clusterOffset(c))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// writeDirectory writes raw directory content, growing the cluster chain as needed
+func (fs *fatFS) writeDirectory(cluster uint32, b []byte) error {
+	if cluster == 0 {
+		if int64(len(b)) > fs.layout.rootEntries*FAT_DIR_ENTRY_SIZE {
+			return fmt.Errorf("root directory is full")
+		}
+		_, err := fs.device.WriteAt(b, fs.start+fs.layout.rootDirOffset())
+		return err
+	}
+	clusters, err := fs.chain(cluster)
+	if err != nil {
+		return err
+	}
+	size := fs.layout.clusterSize()
+	for int64(len(clusters))*size < int64(len(b)) {
+		next, err := fs.allocate(clusters[len(clusters)-1])
+		if err != nil {
+			return err
+		}
+		clusters = append(clusters, next)
+	}
+	padded := make([]byte, int64(len(clusters))*size)
+	copy(padded, b)
+	for i, c := range clusters {
+		_, err := fs.device.WriteAt(padded[int64(i)*size:int64(i+1)*size], fs.clusterOffset(c))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDirEntries parses the directory at cluster; volume labels are included when withLabel is set
+func (fs *fatFS) readDirEntries(cluster uint32, withLabel bool) ([]*fatDirEntry, error) {
+	b, err := fs.readDirectory(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return parseFATDirectory(b, withLabel), nil
+}
+
+func parseFATDirectory(b []byte, withLabel bool) []*fatDirEntry {
+	entries := []*fatDirEntry{}
+	var longName []uint16
+	var longSlots int
+	var longChecksum byte
+	for offset := 0; offset+FAT_DIR_ENTRY_SIZE <= len(b); offset += FAT_DIR_ENTRY_SIZE {
+		slot := b[offset : offset+FAT_DIR_ENTRY_SIZE]
+		if slot[0] == 0x00 {
+			break
+		}
+		if slot[0] == 0xe5 {
+			longName = nil
+			continue
+		}
+		attr := slot[11]
+		if attr&0x3f == fatAttrLongName {
+			seq := int(slot[0] & 0x1f)
+			if slot[0]&0x40 != 0 {
+				longName = make([]uint16, seq*13)
+				longSlots = 0
+				longChecksum = slot[13]
+			}
+			if longName == nil || seq == 0 || seq*13 > len(longName) || slot[13] != longChecksum {
+				longName = nil
+				continue
+			}
+			chars := make([]uint16, 0, 13)
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for i := r[0]; i < r[1]; i += 2 {
+					chars = append(chars, binary.LittleEndian.Uint16(slot[i:i+2]))
+				}
+			}
+			copy(longName[(seq-1)*13:], chars)
+			longSlots++
+			continue
+		}
+		entry := &fatDirEntry{
+			shortName:  fatShortName(slot),
+			attr:       attr,
+			cluster:    uint32(binary.LittleEndian.Uint16(slot[26:28])) | uint32(binary.LittleEndian.Uint16(slot[20:22]))<<16,
+			size:       binary.LittleEndian.Uint32(slot[28:32]),
+			modTime:    fatTime(binary.LittleEndian.Uint16(slot[24:26]), binary.LittleEndian.Uint16(slot[22:24])),
+			accessTime: fatTime(binary.LittleEndian.Uint16(slot[18:20]), 0),
+			offset:     offset,
+			slots:      1,
+		}
+		entry.name = entry.shortName
+		if longName != nil && fatChecksum(slot[0:11]) == longChecksum {
+			name := []uint16{}
+			for _, c := range longName {
+				if c == 0x0000 || c == 0xffff {
+					break
+				}
+				name = append(name, c)
+			}
+			entry.name = string(utf16.Decode(name))
+			entry.slots += longSlots
+		}
+		longName = nil
+		if attr&fatAttrVolumeID != 0 {
+			if withLabel {
+				entries = append(entries, entry)
+			}
+			continue
+		}
+		if entry.shortName == "." || entry.shortName == ".." {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// fatShortName returns the 8.3 name of a short directory entry, applying the NT lowercase flags
+func fatShortName(slot []byte) string {
+	name := make([]byte, 11)
+	copy(name, slot[0:11])
+	if name[0] == 0x05 {
+		name[0] = 0xe5
+	}
+	base := strings.TrimRight(string(name[0:8]), " ")
+	ext := strings.TrimRight(string(name[8:11]), " ")
+	if slot[11]&fatAttrVolumeID != 0 {
+		return strings.TrimRight(string(name), " ")
+	}
+	if slot[12]&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if slot[12]&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func fatTime(d, t uint16) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(d>>9)+1980, time.Month(d>>5&0x0f), int(d&0x1f), int(t>>11), int(t>>5&0x3f), int(t&0x1f)*2, 0, time.Local)
+}
+
+func fatDateTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local)
+	}
+	d := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return d, tm
+}
+
+func fatChecksum(name []byte) byte {
+	sum := byte(0)
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// fatShortEntry returns a 32 byte short directory entry
+func fatShortEntry(name []byte, attr byte, cluster, size uint32, t time.Time) []byte {
+	b := make([]byte, FAT_DIR_ENTRY_SIZE)
+	copy(b[0:11], name)
+	b[11] = attr
+	d, tm := fatDateTime(t)
+	if attr&fatAttrVolumeID == 0 {
+		b[13] = byte(t.Second()%2*100 + t.Nanosecond()/10000000)
+		binary.LittleEndian.PutUint16(b[14:16], tm)
+		binary.LittleEndian.PutUint16(b[16:18], d)
+		binary.LittleEndian.PutUint16(b[18:20], d)
+	}
+	binary.LittleEndian.PutUint16(b[20:22], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(b[22:24], tm)
+	binary.LittleEndian.PutUint16(b[24:26], d)
+	binary.LittleEndian.PutUint16(b[26:28], uint16(cluster))
+	binary.LittleEndian.PutUint32(b[28:32], size)
+	return b
+}
+
+// fatLabelBytes returns a volume label as an 11 byte space padded field
+func fatLabelBytes(label string) []byte {
+	if label == "" {
+		label = "NO NAME"
+	}
+	return []byte(fmt.Sprintf("%-11.11s", strings.ToUpper(label)))
+}
+
+const fatShortChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!#$%&'()-@^_`{}~"
+
+// fatSplitShortName returns the 8.3 base and extension if name is a valid uppercase short name
+func fatSplitShortName(name string) (string, string, bool) {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	if len(base) < 1 || len(base) > 8 || len(ext) > 3 {
+		return "", "", false
+	}
+	for _, c := range base + ext {
+		if !strings.ContainsRune(fatShortChars, c) {
+			return "", "", false
+		}
+	}
+	return base, ext, true
+}
+
+// fatShortNameBytes returns the 11 byte short name for name and whether long name entries are required
+func fatShortNameBytes(name string, existing []*fatDirEntry) ([]byte, bool) {
+	if base, ext, ok := fatSplitShortName(name); ok {
+		return []byte(fmt.Sprintf("%-8s%-3s", base, ext)), false
+	}
+	clean := func(s string) string {
+		s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+		var out strings.Builder
+		for _, c := range s {
+			if c == '.' {
+				continue
+			}
+			if strings.ContainsRune(fatShortChars, c) {
+				out.WriteRune(c)
+			} else {
+				out.WriteRune('_')
+			}
+		}
+		return out.String()
+	}
+	base, ext := strings.TrimLeft(name, "."), ""
+	if i := strings.LastIndex(base, "."); i > 0 {
+		base, ext = base[:i], base[i+1:]
+	}
+	base = clean(base)
+	ext = clean(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	used := make(map[string]bool)
+	for _, e := range existing {
+		used[strings.ToUpper(e.shortName)] = true
+	}
+	for n := 1; n < 1000000; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		prefix := base
+		if len(prefix) > 8-len(tail) {
+			prefix = prefix[:8-len(tail)]
+		}
+		candidate := prefix + tail
+		if ext != "" {
+			candidate += "." + ext
+		}
+		if !used[candidate] {
+			return []byte(fmt.Sprintf("%-8s%-3s", prefix+tail, ext)), true
+		}
+	}
+	return nil, true
+}
+
+// fatLongEntries returns the long name slots for name, in on-disk order
+func fatLongEntries(name string, shortName []byte) []byte {
+	chars := utf16.Encode([]rune(name))
+	count := (len(chars) + 12) / 13
+	padded := make([]uint16, count*13)
+	for i := range padded {
+		switch {
+		case i < len(chars):
+			padded[i] = chars[i]
+		case i == len(chars):
+			padded[i] = 0x0000
+		default:
+			padded[i] = 0xffff
+		}
+	}
+	checksum := fatChecksum(shortName)
+	b := make([]byte, 0, count*FAT_DIR_ENTRY_SIZE)
+	for seq := count; seq >= 1; seq-- {
+		slot := make([]byte, FAT_DIR_ENTRY_SIZE)
+		slot[0] = byte(seq)
+		if seq == count {
+			slot[0] |= 0x40
+		}
+		slot[11] = fatAttrLongName
+		slot[13] = checksum
+		part := padded[(seq-1)*13 : seq*13]
+		positions := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+		for i, pos := range positions {
+			binary.LittleEndian.PutUint16(slot[pos:pos+2], part[i])
+		}
+		b = append(b, slot...)
+	}
+	return b
+}
+
+// splitImagePath returns the cleaned components of an image path
+func splitImagePath(p string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(path.Clean("/"+p), "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func findFATEntry(entries []*fatDirEntry, name string) *fatDirEntry {
+	for _, entry := range entries {
+		if strings.EqualFold(entry.name, name) || strings.EqualFold(entry.shortName, name) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// lookup returns the directory cluster holding p and the entry for p, which is nil for the root
+func (fs *fatFS) lookup(p string) (uint32, *fatDirEntry, error) {
+	parts := splitImagePath(p)
+	dir := fs.root
+	var entry *fatDirEntry
+	for i, part := range parts {
+		if entry != nil {
+			if !entry.isDir() {
+				return 0, nil, fmt.Errorf("not a directory: %s", path.Join(parts[:i]...))
+			}
+			dir = entry.cluster
+		}
+		entries, err := fs.readDirEntries(dir, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		entry = findFATEntry(entries, part)
+		if entry == nil {
+			return 0, nil, fmt.Errorf("%w: %s", os.ErrNotExist, p)
+		}
+	}
+	return dir, entry, nil
+}
+
+// dirCluster returns the cluster of the directory at p
+func (fs *fatFS) dirCluster(p string) (uint32, error) {
+	_, entry, err := fs.lookup(p)
+	if err != nil {
+		return 0, err
+	}
+	if entry == nil {
+		return fs.root, nil
+	}
+	if !entry.isDir() {
+		return 0, fmt.Errorf("not a directory: %s", p)
+	}
+	return entry.cluster, nil
+}
+
+// addEntry creates a directory entry for name in the directory at dir
+func (fs *fatFS) addEntry(dir uint32, name string, attr byte, cluster uint32) (*fatDirEntry, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "\\/:*?\"<>|") {
+		return nil, fmt.Errorf("invalid filename: %s", name)
+	}
+	b, err := fs.readDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	existing := parseFATDirectory(b, true)
+	if findFATEntry(existing, name) != nil {
+		return nil, fmt.Errorf("%w: %s", os.ErrExist, name)
+	}
+	shortName, needLong := fatShortNameBytes(name, existing)
+	if shortName == nil {
+		return nil, fmt.Errorf("no short name available for %s", name)
+	}
+	slots := []byte{}
+	if needLong {
+		slots = fatLongEntries(name, shortName)
+	}
+	slots = append(slots, fatShortEntry(shortName, attr, cluster, 0, fs.now())...)
+
+	// find a run of free slots, or append at the end of the directory
+	offset := -1
+	run := 0
+	for i := 0; i+FAT_DIR_ENTRY_SIZE <= len(b); i += FAT_DIR_ENTRY_SIZE {
+		if b[i] == 0x00 {
+			offset = i - run*FAT_DIR_ENTRY_SIZE
+			break
+		}
+		if b[i] == 0xe5 {
+			run++
+			if run*FAT_DIR_ENTRY_SIZE == len(slots) {
+				offset = i - (run-1)*FAT_DIR_ENTRY_SIZE
+				break
+			}
+		} else {
+			run = 0
+		}
+	}
+	if offset < 0 {
+		offset = len(b) - run*FAT_DIR_ENTRY_SIZE
+	}
+	if offset+len(slots) > len(b) {
+		grown := make([]byte, offset+len(slots))
+		copy(grown, b)
+		b = grown
+	}
+	copy(b[offset:], slots)
+	err = fs.writeDirectory(dir, b)
+	if err != nil {
+		return nil, err
+	}
+	entries := parseFATDirectory(b, false)
+	return findFATEntry(entries, name), nil
+}
+
+// updateEntry rewrites the cluster, size and modification time of an existing entry
+func (fs *fatFS) updateEntry(dir uint32, entry *fatDirEntry) error {
+	b, err := fs.readDirectory(dir)
+	if err != nil {
+		return err
+	}
+	slot := b[entry.offset : entry.offset+FAT_DIR_ENTRY_SIZE]
+	d, tm := fatDateTime(entry.modTime)
+	binary.LittleEndian.PutUint16(slot[18:20], d)
+	binary.LittleEndian.PutUint16(slot[20:22], uint16(entry.cluster>>16))
+	binary.LittleEndian.PutUint16(slot[22:24], tm)
+	binary.LittleEndian.PutUint16(slot[24:26], d)
+	binary.LittleEndian.PutUint16(slot[26:28], uint16(entry.cluster))
+	binary.LittleEndian.PutUint32(slot[28:32], entry.size)
+	return fs.writeDirectory(dir, b)
+}
+
+// removeEntry marks the slots of entry deleted and releases its clusters
+func (fs *fatFS) removeEntry(dir uint32, entry *fatDirEntry) error {
+	b, err := fs.readDirectory(dir)
+	if err != nil {
+		return err
+	}
+	first := entry.offset - (entry.slots-1)*FAT_DIR_ENTRY_SIZE
+	for i := first; i <= entry.offset; i += FAT_DIR_ENTRY_SIZE {
+		b[i] = 0xe5
+	}
+	err = fs.release(entry.cluster)
+	if err != nil {
+		return err
+	}
+	return fs.writeDirectory(dir, b)
+}
+
+// Type returns filesystem.TypeFat32, which go-diskfs uses for every FAT variant
+func (fs *fatFS) Type() filesystem.Type {
+	return filesystem.TypeFat32
+}
+
+// Mkdir creates the directory p and any missing parents
+func (fs *fatFS) Mkdir(p string) error {
+	dir := fs.root
+	for _, part := range splitImagePath(p) {
+		entries, err := fs.readDirEntries(dir, false)
+		if err != nil {
+			return err
+		}
+		entry := findFATEntry(entries, part)
+		if entry == nil {
+			entry, err = fs.mkSubdir(dir, part)
+			if err != nil {
+				return err
+			}
+		} else if !entry.isDir() {
+			return fmt.Errorf("not a directory: %s", part)
+		}
+		dir = entry.cluster
+	}
+	return fs.Sync()
+}
+
+func (fs *fatFS) mkSubdir(parent uint32, name string) (*fatDirEntry, error) {
+	cluster, err := fs.allocate(0)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.zeroCluster(cluster)
+	if err != nil {
+		return nil, err
+	}
+	parentRef := parent
+	if parent == fs.root {
+		parentRef = 0
+	}
+	now := fs.now()
+	b := fatShortEntry([]byte(".          "), fatAttrDirectory, cluster, 0, now)
+	b = append(b, fatShortEntry([]byte("..         "), fatAttrDirectory, parentRef, 0, now)...)
+	err = fs.writeDirectory(cluster, b)
+	if err != nil {
+		return nil, err
+	}
+	return fs.addEntry(parent, name, fatAttrDirectory, cluster)
+}
+
+// ReadDir returns the entries of the directory p
+func (fs *fatFS) ReadDir(p string) ([]os.FileInfo, error) {
+	dir, err := fs.dirCluster(p)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.readDirEntries(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, len(entries))
+	for i, entry := range entries {
+		infos[i] = fatFileInfo{entry: entry}
+	}
+	return infos, nil
+}
+
+// OpenFile opens the file p with os.OpenFile style flags
+func (fs *fatFS) OpenFile(p string, flag int) (filesystem.File, error) {
+	parts := splitImagePath(p)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
+	}
+	dir, entry, err := fs.lookup(p)
+	if err != nil && !(errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE != 0) {
+		return nil, err
+	}
+	if entry == nil {
+		dir, err = fs.dirCluster(path.Dir(path.Clean("/" + p)))
+		if err != nil {
+			return nil, err
+		}
+		entry, err = fs.addEntry(dir, parts[len(parts)-1], fatAttrArchive, 0)
+		if err != nil {
+			return nil, err
+		}
+	} else if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, fmt.Errorf("%w: %s", os.ErrExist, p)
+	}
+	if entry.isDir() {
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
+	}
+	file := &fatFile{
+		fs:       fs,
+		dir:      dir,
+		entry:    entry,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+	}
+	if flag&os.O_TRUNC != 0 && file.writable && entry.size > 0 {
+		err = fs.release(entry.cluster)
+		if err != nil {
+			return nil, err
+		}
+		entry.cluster = 0
+		entry.size = 0
+		file.dirty = true
+	}
+	if flag&os.O_APPEND != 0 {
+		file.offset = int64(entry.size)
+	}
+	return file, nil
+}
+
+// Remove deletes the file or empty directory p
+func (fs *fatFS) Remove(p string) error {
+	dir, entry, err := fs.lookup(p)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("cannot remove root directory")
+	}
+	if entry.isDir() {
+		children, err := fs.readDirEntries(entry.cluster, false)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return fmt.Errorf("directory not empty: %s", p)
+		}
+	}
+	err = fs.removeEntry(dir, entry)
+	if err != nil {
+		return err
+	}
+	return fs.Sync()
+}
+
+// Label returns the volume label
+func (fs *fatFS) Label() string {
+	return fs.label
+}
+
+// fatFile is an open file in a fatFS
+type fatFile struct {
+	fs       *fatFS
+	dir      uint32
+	entry    *fatDirEntry
+	offset   int64
+	writable bool
+	dirty    bool
+	// clusters caches the cluster chain of the file once read, and grows as clusters are allocated
+	clusters []uint32
+}
+
+// chain returns the cluster chain of the file, following the FAT only on first use
+func (f *fatFile) chain() ([]uint32, error) {
+	if f.clusters == nil {
+		clusters, err := f.fs.chain(f.entry.cluster)
+		if err != nil {
+			return nil, err
+		}
+		f.clusters = clusters
+	}
+	return f.clusters, nil
+}
+
+func (f *fatFile) Read(b []byte) (int, error) {
+	size := int64(f.entry.size)
+	if f.offset >= size {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > size-f.offset {
+		b = b[:size-f.offset]
+	}
+	clusters, err := f.chain()
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.transfer(clusters, b, false)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *fatFile) Write(b []byte) (int, error) {
+	if !f.writable {
+		return 0, fmt.Errorf("file not open for writing")
+	}
+	end := f.offset + int64(len(b))
+	if end > 0xffffffff {
+		return 0, fmt.Errorf("file too large for FAT")
+	}
+	clusters, err := f.chain()
+	if err != nil {
+		return 0, err
+	}
+	clusterSize := f.fs.layout.clusterSize()
+	for int64(len(clusters))*clusterSize < end {
+		previous := uint32(0)
+		if len(clusters) > 0 {
+			previous = clusters[len(clusters)-1]
+		}
+		cluster, err := f.fs.allocate(previous)
+		if err != nil {
+			return 0, err
+		}
+		if previous == 0 {
+			f.entry.cluster = cluster
+		}
+		clusters = append(clusters, cluster)
+		f.clusters = clusters
+	}
+	// zero fill any gap left by seeking past the end of the file
+	if f.offset > int64(f.entry.size) {
+		gap := make([]byte, f.offset-int64(f.entry.size))
+		saved := f.offset
+		f.offset = int64(f.entry.size)
+		_, err = f.transfer(clusters, gap, true)
+		f.offset = saved
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.transfer(clusters, b, true)
+	f.offset += int64(n)
+	if f.offset > int64(f.entry.size) {
+		f.entry.size = uint32(f.offset)
+	}
+	f.dirty = true
+	return n, err
+}
+
+// transfer reads or writes b at the current offset across the cluster list
+func (f *fatFile) transfer(clusters []uint32, b []byte, write bool) (int, error) {
+	clusterSize := f.fs.layout.clusterSize()
+	done := 0
+	for done < len(b) {
+		position := f.offset + int64(done)
+		index := position / clusterSize
+		within := position % clusterSize
+		if index >= int64(len(clusters)) {
+			return done, fmt.Errorf("cluster chain shorter than file size")
+		}
+		count := clusterSize - within
+		if count > int64(len(b)-done) {
+			count = int64(len(b) - done)
+		}
+		offset := f.fs.clusterOffset(clusters[index]) + within
+		var err error
+		if write {
+			_, err = f.fs.device.WriteAt(b[done:done+int(count)], offset)
+		} else {
+			_, err = f.fs.device.ReadAt(b[done:done+int(count)], offset)
+		}
+		if err != nil {
+			return done, err
+		}
+		done += int(count)
+	}
+	return done, nil
+}
+
+func (f *fatFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.entry.size)
+	default:
+		return f.offset, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return f.offset, fmt.Errorf("negative seek offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *fatFile) Close() error {
+	if !f.dirty {
+		return nil
+	}
+	f.dirty = false
+	f.entry.modTime = f.fs.now()
+	err := f.fs.updateEntry(f.dir, f.entry)
+	if err != nil {
+		return err
+	}
+	return f.fs.Sync()
+}
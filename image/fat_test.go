@@ -0,0 +1,234 @@
+package image
+
+import (
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem/fat32"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFATLayout(t *testing.T) {
+	for _, c := range []struct {
+		size    int64
+		fatType FATType
+		want    FATType
+	}{
+		{1440 * 1024, FATAuto, FAT12},
+		{8 * 1024 * 1024, FATAuto, FAT12},
+		{32 * 1024 * 1024, FATAuto, FAT16},
+		{512 * 1024 * 1024, FATAuto, FAT32},
+		{4 * 1024 * 1024, FAT16, FAT16},
+		{64 * 1024 * 1024, FAT32, FAT32},
+	} {
+		layout, err := newFATLayout(c.size, c.fatType)
+		require.Nil(t, err)
+		require.Equal(t, c.want, layout.fatType, "size %d", c.size)
+		require.LessOrEqual(t, layout.clusterCount, layout.maxClusters())
+		require.GreaterOrEqual(t, layout.clusterCount, layout.minClusters())
+	}
+	_, err := newFATLayout(1440*1024, FAT32)
+	require.NotNil(t, err)
+	_, err = newFATLayout(1024*1024*1024, FAT12)
+	require.NotNil(t, err)
+}
+
+func TestFATParse(t *testing.T) {
+	for name, want := range map[string]FATType{"fat12": FAT12, "16": FAT16, "FAT32": FAT32, "auto": FATAuto, "": FATAuto} {
+		fatType, err := ParseFATType(name)
+		require.Nil(t, err)
+		require.Equal(t, want, fatType)
+	}
+	_, err := ParseFATType("fat64")
+	require.NotNil(t, err)
+
+	for value, want := range map[string]int64{"512": 512, "1440K": 1440 * 1024, "4M": 4 * 1024 * 1024, "1GiB": 1024 * 1024 * 1024} {
+		size, err := ParseSize(value)
+		require.Nil(t, err)
+		require.Equal(t, want, size)
+	}
+	_, err = ParseSize("big")
+	require.NotNil(t, err)
+}
+
+func TestFATMalformedBPB(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		size      int64
+		fatType   FATType
+		fatOffset int64
+		fatBytes  []byte
+	}{
+		{1440 * 1024, FAT12, 22, []byte{1, 0}},
+		{32 * 1024 * 1024, FAT16, 22, []byte{1, 0}},
+		{64 * 1024 * 1024, FAT32, 36, []byte{1, 0, 0, 0}},
+	} {
+		filename := filepath.Join(dir, c.fatType.String()+".img")
+		fp, err := os.Create(filename)
+		require.Nil(t, err)
+		require.Nil(t, fp.Truncate(c.size))
+		_, err = formatFAT(fp, 0, c.size, c.fatType, "", BuildStamp{})
+		require.Nil(t, err)
+		// a one sector FAT is too small for the cluster count
+		_, err = fp.WriteAt(c.fatBytes, c.fatOffset)
+		require.Nil(t, err)
+		_, err = readFAT(fp, 0, c.size)
+		require.ErrorContains(t, err, "FAT is too small", c.fatType.String())
+		require.Nil(t, fp.Close())
+
+		// openers fall back to other readers or fail, but never panic
+		require.NotPanics(t, func() { ListImageFiles(filename) }, c.fatType.String())
+		require.NotPanics(t, func() { BootInfo(filename) }, c.fatType.String())
+	}
+}
+
+func TestFATFixture(t *testing.T) {
+	v, err := openImageFS(filepath.Join("testdata", "image"))
+	require.Nil(t, err)
+	defer v.Close()
+	fat, ok := v.fs.(*fatFS)
+	require.True(t, ok)
+	require.Equal(t, FAT12, fat.FATType())
+	require.Equal(t, "test", fat.Label())
+	files, err := walkFS(fat, "/")
+	require.Nil(t, err)
+	require.Equal(t, []string{"/SAMPLE"}, files)
+}
+
+func TestFATReadWrite(t *testing.T) {
+	for _, c := range []struct {
+		size    int64
+		fatType FATType
+	}{
+		{1440 * 1024, FAT12},
+		{4 * 1024 * 1024, FAT16},
+		{40 * 1024 * 1024, FAT32},
+	} {
+		t.Run(c.fatType.String(), func(t *testing.T) {
+			imageFile := filepath.Join(t.TempDir(), "fat.img")
+			fs, fp, err := createFATImage(imageFile, c.size, c.fatType, "TESTFAT", BuildStamp{})
+			require.Nil(t, err)
+
+			err = fs.Mkdir("/EFI/BOOT")
+			require.Nil(t, err)
+			err = fs.Mkdir("/EFI/BOOT")
+			require.Nil(t, err)
+
+			// enough long names to grow a subdirectory past one cluster
+			contents := map[string]string{
+				"/EFI/BOOT/BOOTX64.EFI":   strings.Repeat("x", 100000),
+				"/autoexec.ipxe":          "#!ipxe\n",
+				"/Mixed Case Name.txt":    "mixed\n",
+				"/EFI/BOOT/grub.cfg":      "set timeout=0\n",
+				"/EFI/BOOT/empty":         "",
+				"/EFI/BOOT/long/nested/f": "nested\n",
+			}
+			for i := 0; i < 40; i++ {
+				contents[fmt.Sprintf("/EFI/BOOT/a long file name number %03d.conf", i)] = fmt.Sprintf("%d\n", i)
+			}
+			for _, name := range sortedKeys(contents) {
+				err = fs.Mkdir(filepath.Dir(name))
+				require.Nil(t, err)
+				fp, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR)
+				require.Nil(t, err)
+				_, err = io.WriteString(fp, contents[name])
+				require.Nil(t, err)
+				require.Nil(t, fp.Close())
+			}
+
+			// overwrite with shorter content
+			out, err := fs.OpenFile("/autoexec.ipxe", os.O_RDWR|os.O_TRUNC)
+			require.Nil(t, err)
+			_, err = io.WriteString(out, "#!\n")
+			require.Nil(t, err)
+			require.Nil(t, out.Close())
+			contents["/autoexec.ipxe"] = "#!\n"
+
+			// small writes extend the cached chain, and the FAT is written once on Close
+			out, err = fs.OpenFile("/chunked.bin", os.O_CREATE|os.O_RDWR)
+			require.Nil(t, err)
+			for i := 0; i < 100; i++ {
+				_, err = io.WriteString(out, strings.Repeat(string(rune('a'+i%26)), 1000))
+				require.Nil(t, err)
+			}
+			require.True(t, fs.fatDirty)
+			require.Nil(t, out.Close())
+			require.False(t, fs.fatDirty)
+			var chunked strings.Builder
+			for i := 0; i < 100; i++ {
+				chunked.WriteString(strings.Repeat(string(rune('a'+i%26)), 1000))
+			}
+			contents["/chunked.bin"] = chunked.String()
+
+			_, err = fs.OpenFile("/autoexec.ipxe", os.O_CREATE|os.O_EXCL|os.O_RDWR)
+			require.NotNil(t, err)
+			require.NotNil(t, fs.Remove("/EFI/BOOT"))
+			require.Nil(t, fs.Remove("/Mixed Case Name.txt"))
+			delete(contents, "/Mixed Case Name.txt")
+			require.Nil(t, fp.Close())
+
+			reopenedVolume, err := openImageFS(imageFile)
+			require.Nil(t, err)
+			defer reopenedVolume.Close()
+			reopened := reopenedVolume.fs
+			require.Equal(t, c.fatType, reopened.(*fatFS).FATType())
+			require.Equal(t, "TESTFAT", reopened.Label())
+			for name, content := range contents {
+				in, err := reopened.OpenFile(name, os.O_RDONLY)
+				require.Nil(t, err, name)
+				data, err := io.ReadAll(in)
+				require.Nil(t, err)
+				require.Equal(t, content, string(data), name)
+			}
+			// lookups are case insensitive and accept short names
+			_, err = reopened.OpenFile("/efi/boot/bootx64.efi", os.O_RDONLY)
+			require.Nil(t, err)
+			_, err = reopened.OpenFile("/AUTOEX~1.IPX", os.O_RDONLY)
+			require.Nil(t, err)
+			_, err = reopened.OpenFile("/Mixed Case Name.txt", os.O_RDONLY)
+			require.True(t, os.IsNotExist(err) || strings.Contains(err.Error(), "does not exist"))
+
+			// removing everything returns every cluster to the free pool
+			fat, v, err := openWritableFAT(imageFile, PartitionSelector{})
+			require.Nil(t, err)
+			defer v.Close()
+			files, err := walkFS(fat, "/")
+			require.Nil(t, err)
+			for i := len(files) - 1; i >= 0; i-- {
+				require.Nil(t, fat.Remove(strings.TrimRight(files[i], "/")), files[i])
+			}
+			used := uint32(0)
+			if fat.FATType() == FAT32 {
+				used = 1
+			}
+			require.Equal(t, uint32(fat.layout.clusterCount)-used, fat.freeClusters())
+		})
+	}
+}
+
+func TestFATDiskfsCompatible(t *testing.T) {
+	imageFile := filepath.Join(t.TempDir(), "fat32.img")
+	size := int64(40 * 1024 * 1024)
+	fs, fp, err := createFATImage(imageFile, size, FAT32, "COMPAT", BuildStamp{})
+	require.Nil(t, err)
+	defer fp.Close()
+	err = fs.Mkdir("/EFI/BOOT")
+	require.Nil(t, err)
+	out, err := fs.OpenFile("/EFI/BOOT/BOOTX64.EFI", os.O_CREATE|os.O_RDWR)
+	require.Nil(t, err)
+	content := strings.Repeat("EFI", 5000)
+	_, err = io.WriteString(out, content)
+	require.Nil(t, err)
+	require.Nil(t, out.Close())
+
+	diskfsFS, err := fat32.Read(fp, size, 0, FAT_SECTOR_SIZE)
+	require.Nil(t, err)
+	in, err := diskfsFS.OpenFile("/EFI/BOOT/BOOTX64.EFI", os.O_RDONLY)
+	require.Nil(t, err)
+	data, err := io.ReadAll(in)
+	require.Nil(t, err)
+	require.Equal(t, content, string(data))
+}
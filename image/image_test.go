@@ -1,11 +1,19 @@
 package image
 
 import (
+	"context"
+	"encoding/binary"
+	diskfs "github.com/rstms/go-diskfs"
+	diskpkg "github.com/rstms/go-diskfs/disk"
+	"github.com/rstms/go-diskfs/filesystem"
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -18,12 +26,12 @@ func initTestConfig(t *testing.T) {
 }
 
 func TestEFICreate(t *testing.T) {
-	efiImage := filepath.Join("testdata", "efi.img")
+	efiImage := filepath.Join(t.TempDir(), "efi.img")
 	efiBootFile := filepath.Join("testdata", "bootx64.efi")
 	efiName := "BOOTX64.EFI"
 	extraFiles := []string{filepath.Join("testdata", "autoexec.ipxe")}
 
-	err := CreateEFIImage(efiImage, efiBootFile, efiName, extraFiles)
+	err := CreateEFIImage(t.Context(), efiImage, efiBootFile, efiName, extraFiles)
 	require.Nil(t, err)
 }
 
@@ -66,14 +74,14 @@ func mkTestDir(t *testing.T, name string) string {
 func TestISOExtract(t *testing.T) {
 	imageFile := filepath.Join("testdata", "netboot.xyz.iso")
 	destDir := mkTestDir(t, "isofiles")
-	err := ExtractImageFiles(imageFile, destDir)
+	err := ExtractImageFiles(t.Context(), imageFile, destDir)
 	require.Nil(t, err)
 }
 
 func TestIMGExtract(t *testing.T) {
 	imageFile := filepath.Join("testdata", "esp.img")
 	destDir := mkTestDir(t, "imgfiles")
-	err := ExtractImageFiles(imageFile, destDir)
+	err := ExtractImageFiles(t.Context(), imageFile, destDir)
 	require.Nil(t, err)
 }
 
@@ -85,9 +93,141 @@ func TestImageInfo(t *testing.T) {
 }
 
 func TestISOCreate(t *testing.T) {
-	outputImage := filepath.Join("testdata", "output.iso")
+	outputImage := filepath.Join(t.TempDir(), "output.iso")
 	sourceImage := filepath.Join("testdata", "netboot.xyz.iso")
 	autoexecFile := filepath.Join("testdata", "autoexec.ipxe")
-	err := CreateISOImage(outputImage, sourceImage, autoexecFile)
+	err := CreateISOImage(t.Context(), outputImage, sourceImage, autoexecFile)
 	require.Nil(t, err)
 }
+
+// mkTestFile writes content to name in dir and returns the pathname
+func mkTestFile(t *testing.T, dir, name, content string) string {
+	filename := filepath.Join(dir, name)
+	err := os.WriteFile(filename, []byte(content), 0600)
+	require.Nil(t, err)
+	return filename
+}
+
+// mkTestPE writes a minimal PE/COFF image for machine padded to size bytes and returns the pathname
+func mkTestPE(t *testing.T, dir, name string, machine uint16, size int) string {
+	data := make([]byte, size)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], 0x40)
+	copy(data[0x40:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(data[0x44:], machine)
+	filename := filepath.Join(dir, name)
+	err := os.WriteFile(filename, data, 0600)
+	require.Nil(t, err)
+	return filename
+}
+
+// mkTestISO builds a bootable ISO laid out like the netboot.xyz images and returns its pathname
+func mkTestISO(t *testing.T, dir string) string {
+	efiBootFile := mkTestPE(t, dir, "bootx64.efi", 0x8664, 6000)
+	autoexec := mkTestFile(t, dir, "autoexec.ipxe", "#!ipxe\necho source\n")
+	efiImage := filepath.Join(dir, "esp.img")
+	err := CreateEFIImage(t.Context(), efiImage, efiBootFile, "BOOTX64.EFI", []string{autoexec})
+	require.Nil(t, err)
+
+	files := map[string]string{
+		"/esp.img":         efiImage,
+		"/autoexec.ipxe":   autoexec,
+		"/isolinux.bin":    mkTestFile(t, dir, "isolinux.bin", strings.Repeat("L", 4096)),
+		"/docs/readme.txt": mkTestFile(t, dir, "readme.txt", "netboot test image\n"),
+	}
+	entries := []*iso9660.ElToritoEntry{
+		{Platform: iso9660.BIOS, Emulation: iso9660.NoEmulation, BootFile: "/isolinux.bin", BootTable: true, LoadSize: 4},
+		{Platform: iso9660.EFI, Emulation: iso9660.NoEmulation, BootFile: "/esp.img", LoadSize: EFI_IMAGE_SIZE / 512},
+	}
+	return buildTestISO(t, dir, "source.iso", files, entries)
+}
+
+// buildTestISO writes an ISO labelled NETBOOT holding files with the El Torito entries and returns its pathname
+func buildTestISO(t *testing.T, dir, name string, files map[string]string, entries []*iso9660.ElToritoEntry) string {
+	isoImage := filepath.Join(dir, name)
+	disk, err := diskfs.Create(isoImage, 8*1024*1024, diskfs.Raw)
+	require.Nil(t, err)
+	defer disk.File.Close()
+	disk.LogicalBlocksize = ISO_LOGICAL_BLOCK_SIZE
+	workDir, err := os.MkdirTemp(dir, "workspace")
+	require.Nil(t, err)
+	spec := diskpkg.FilesystemSpec{FSType: filesystem.TypeISO9660, VolumeLabel: "NETBOOT", WorkDir: workDir}
+	fs, err := disk.CreateFilesystem(spec)
+	require.Nil(t, err)
+	for _, name := range sortedKeys(files) {
+		err = fs.Mkdir(path.Dir(name))
+		require.Nil(t, err)
+		err = copyFileToImage(t.Context(), fs, name, files[name], nil)
+		require.Nil(t, err)
+	}
+	iso, ok := fs.(*iso9660.FileSystem)
+	require.True(t, ok)
+	options := iso9660.FinalizeOptions{VolumeIdentifier: "NETBOOT", RockRidge: true}
+	if len(entries) > 0 {
+		options.ElTorito = &iso9660.ElTorito{BootCatalog: "/boot.catalog", HideBootCatalog: true, Entries: entries, Platform: entries[0].Platform}
+	}
+	err = iso.Finalize(options)
+	require.Nil(t, err)
+	return isoImage
+}
+
+// readTestImageFile returns the content of a file inside an image
+func readTestImageFile(t *testing.T, imageFile, name string) string {
+	v, err := openImageFS(imageFile)
+	require.Nil(t, err)
+	defer v.Close()
+	fs := v.fs
+	hostFile := filepath.Join(t.TempDir(), path.Base(name))
+	err = copyFileFromImage(t.Context(), fs, hostFile, name, nil)
+	require.Nil(t, err)
+	data, err := os.ReadFile(hostFile)
+	require.Nil(t, err)
+	return string(data)
+}
+
+// cancelOnData returns a ProgressFunc cancelling ctx once the first file data is copied
+func cancelOnData(cancel context.CancelFunc) ProgressFunc {
+	return func(p Progress) {
+		if p.Bytes > 0 {
+			cancel()
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	efiImage := filepath.Join(dir, "cancelled.img")
+	err := CreateEFIImage(ctx, efiImage, mkTestPE(t, dir, "bootx64.efi", 0x8664, 4096), "BOOTX64.EFI", []string{})
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoFileExists(t, efiImage)
+
+	ctx, cancel = context.WithCancel(t.Context())
+	outputISO := filepath.Join(dir, "cancelled.iso")
+	err = BuildISOImage(ctx, outputISO, isoImage, ISOBuildOptions{Progress: cancelOnData(cancel)})
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoFileExists(t, outputISO)
+	entries, err := os.ReadDir(tmpDir)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+
+	// the partially written EFI image is removed
+	ctx, cancel = context.WithCancel(t.Context())
+	destDir := t.TempDir()
+	err = ExtractImage(ctx, isoImage, destDir, ExtractOptions{Include: []string{"*.img"}, Progress: cancelOnData(cancel)})
+	require.ErrorIs(t, err, context.Canceled)
+	files := []string{}
+	err = filepath.WalkDir(destDir, func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, p)
+		}
+		return err
+	})
+	require.Nil(t, err)
+	require.Empty(t, files)
+}
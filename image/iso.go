@@ -0,0 +1,620 @@
+package image
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem"
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
+	"github.com/rstms/go-diskfs/partition/mbr"
+	"github.com/rstms/go-diskfs/util"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ISOBuildOptions selects the changes BuildISOImage applies to the source ISO
+type ISOBuildOptions struct {
+	// Files maps ISO image paths to host files; existing paths are replaced, new paths are added
+	Files map[string]string
+	// Readers maps ISO image paths to readers supplying the file content
+	Readers map[string]io.Reader
+	// EFIFiles maps paths inside the EFI boot image to host files
+	EFIFiles map[string]string
+	// Delete lists ISO image paths to remove; directories are removed with their contents
+	Delete []string
+	// VolumeLabel overrides the volume identifier of the source ISO
+	VolumeLabel string
+	// Hybrid writes an isohybrid MBR so the output can be written to USB media
+	Hybrid bool
+	// HybridGPT also writes a GPT with an EFI System Partition entry for the EFI boot image; implies Hybrid
+	HybridGPT bool
+	// Stamp fixes the timestamps, EFI image volume serial and GPT GUIDs for reproducible output
+	Stamp BuildStamp
+	// Progress receives the files and bytes copied into the output ISO
+	Progress ProgressFunc
+	// Output selects whether BuildISOImage replaces an existing image file
+	Output OutputOptions
+}
+
+// BuildISOImage writes dstImage as a copy of srcImage with the changes in options applied
+func BuildISOImage(ctx context.Context, dstImage, srcImage string, options ISOBuildOptions) error {
+	src, err := os.Open(srcImage)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := CreateOutputFile(dstImage, options.Output)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+	_, err = buildISOImage(ctx, out.File, src, stat.Size(), srcImage, options)
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// WriteISOImage writes a copy of the ISO image of srcSize bytes in src with the changes in options
+// applied to w and returns the output size. The output is built in place if w also implements
+// io.ReaderAt, io.Seeker and Truncate, so it can be cut to the finalized volume, with unwritten areas of
+// w assumed to be zero; otherwise it is spooled to a temporary file and copied to w.
+func WriteISOImage(ctx context.Context, w io.WriterAt, src io.ReaderAt, srcSize int64, options ISOBuildOptions) (int64, error) {
+	if f, ok := w.(interface {
+		util.File
+		truncater
+	}); ok {
+		return buildISOImage(ctx, f, &readerFile{r: src, size: srcSize}, srcSize, READER_IMAGE_NAME, options)
+	}
+	return spoolOutput(ctx, w, func(f util.File) (int64, error) {
+		return buildISOImage(ctx, f, &readerFile{r: src, size: srcSize}, srcSize, READER_IMAGE_NAME, options)
+	})
+}
+
+// buildISOImage writes the output ISO to f and returns its size; srcName names the source in errors
+func buildISOImage(ctx context.Context, f util.File, src util.File, srcSize int64, srcName string, options ISOBuildOptions) (int64, error) {
+
+	stamp, err := options.Stamp.resolve()
+	if err != nil {
+		return 0, err
+	}
+	srcVolume, err := openFileVolume(src, srcSize, srcName, PartitionSelector{})
+	if err != nil {
+		return 0, err
+	}
+	srcFS := srcVolume.fs
+	imageName := volumeLabel(srcFS)
+	if options.VolumeLabel != "" {
+		imageName = options.VolumeLabel
+	}
+	logger().Info("building ISO image", "source", srcName, "size", srcSize, "volume", imageName)
+
+	tmpDir, err := os.MkdirTemp("", "isobuild*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// files maps each replaced or added ISO path to a host file
+	files, err := spoolReaders(tmpDir, options.Files, options.Readers)
+	if err != nil {
+		return 0, err
+	}
+	efiFiles := make(map[string]string)
+	for name, src := range options.EFIFiles {
+		efiFiles[cleanImagePath(name)] = src
+	}
+	deletes := make([]string, len(options.Delete))
+	for i, name := range options.Delete {
+		deletes[i] = cleanImagePath(name)
+	}
+
+	// isoFiles is the list of files in the source ISO
+	isoFiles, err := listFiles(srcFS)
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range deletes {
+		if !containsPath(isoFiles, name) {
+			return 0, fmt.Errorf("delete target not found in %s: %s", srcName, name)
+		}
+	}
+
+	// boots lists the source boot catalog entries kept in the output
+	boots, catalogPath, err := readBootImages(tmpDir, src, srcFS, deletes)
+	if err != nil {
+		return 0, err
+	}
+
+	// efiSrcImage is the ISO path of the first EFI boot image
+	var efiSrcImage string
+	var efiBoot *bootImage
+	for _, boot := range boots {
+		if boot.entry.Platform == iso9660.EFI {
+			efiBoot = boot
+			efiSrcImage = boot.path
+			break
+		}
+	}
+	logger().Debug("EFI boot image", "path", efiSrcImage)
+
+	// efiBootImage is the host file written to the output ISO as the EFI boot image
+	var efiBootImage string
+	if efiBoot != nil {
+		replacement := files[efiSrcImage]
+		if replacement == "" {
+			replacement = efiBoot.hostFile
+		}
+		efiBootImage, err = prepareEFIBootImage(ctx, tmpDir, srcFS, efiSrcImage, replacement, efiFiles, stamp)
+		if err != nil {
+			return 0, err
+		}
+		efiBoot.hostFile = efiBootImage
+	} else if len(efiFiles) > 0 {
+		return 0, fmt.Errorf("no EFI boot image found in %s", srcName)
+	}
+	for _, boot := range boots {
+		if files[boot.path] != "" && boot != efiBoot {
+			boot.hostFile = files[boot.path]
+		}
+	}
+
+	// srcMBR holds the hybrid boot code of the source ISO
+	var srcMBR []byte
+	hybrid := options.Hybrid || options.HybridGPT
+	if hybrid {
+		srcMBR, err = readMBRBootCode(src, srcName)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	workDir := filepath.Join(tmpDir, "workspace")
+	err = os.Mkdir(workDir, 0700)
+	if err != nil {
+		return 0, err
+	}
+
+	// the output grows as finalize writes it, then is cut to the volume size it records
+	dstFS, err := iso9660.Create(f, 0, 0, ISO_LOGICAL_BLOCK_SIZE, workDir)
+	if err != nil {
+		return 0, err
+	}
+
+	p, err := isoProgress(options.Progress, srcVolume, isoFiles, deletes, catalogPath, efiSrcImage, efiBootImage, files, boots)
+	if err != nil {
+		return 0, err
+	}
+
+	// copy src ISO files to dest ISO
+	written := make(map[string]bool)
+	for _, file := range isoFiles {
+		name := strings.TrimRight(file, "/")
+		switch {
+		case isDeleted(name, deletes):
+			logger().Debug("deleting", "path", name)
+		case strings.HasSuffix(file, "/"):
+			err = dstFS.Mkdir(name)
+			if err != nil {
+				return 0, err
+			}
+		case name == catalogPath:
+			// don't copy (autogenerated)
+		case name == efiSrcImage:
+			logger().Debug("writing EFI boot image", "path", name)
+			err = copyFileToImage(ctx, dstFS, name, efiBootImage, p)
+			if err != nil {
+				return 0, err
+			}
+			written[name] = true
+		case files[name] != "":
+			logger().Debug("replacing", "path", name)
+			err = copyFileToImage(ctx, dstFS, name, files[name], p)
+			if err != nil {
+				return 0, err
+			}
+			written[name] = true
+		default:
+			logger().Debug("copying", "path", name)
+			err = copyFileInterImage(ctx, dstFS, name, srcFS, name, p)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// add files not present in the source ISO
+	for _, name := range sortedKeys(files) {
+		if written[name] {
+			continue
+		}
+		logger().Debug("adding", "path", name)
+		err = dstFS.Mkdir(path.Dir(name))
+		if err != nil {
+			return 0, err
+		}
+		err = copyFileToImage(ctx, dstFS, name, files[name], p)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// add boot images that have no directory entry in the source ISO
+	for _, boot := range boots {
+		if boot.hidden {
+			logger().Debug("writing hidden boot image", "path", boot.path)
+			err = copyFileToImage(ctx, dstFS, boot.path, boot.hostFile, p)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	entries := make([]*iso9660.ElToritoEntry, len(boots))
+	for i, boot := range boots {
+		entries[i] = boot.elToritoEntry()
+	}
+
+	finalizeOptions := iso9660.FinalizeOptions{
+		VolumeIdentifier: imageName,
+		RockRidge:        true,
+	}
+	if len(entries) > 0 {
+		// the catalog is generated by finalize and has no workspace file, so it must be hidden
+		finalizeOptions.ElTorito = &iso9660.ElTorito{
+			BootCatalog:     "/boot.catalog",
+			HideBootCatalog: true,
+			Entries:         entries,
+			Platform:        boots[0].entry.Platform,
+		}
+	}
+	err = ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	logger().Info("finalizing ISO image", "volume", imageName, "boot_entries", len(entries))
+	err = dstFS.Finalize(finalizeOptions)
+	if err != nil {
+		return 0, err
+	}
+	err = ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	isoSize, err := isoVolumeSize(f)
+	if err != nil {
+		return 0, err
+	}
+	outputSize := isoSize
+	if hybrid {
+		outputSize = isohybridSize(isoSize)
+	}
+	// drop trailing slack, or pad a hybrid image for its geometry and backup GPT
+	err = setFileSize(f, outputSize)
+	if err != nil {
+		return 0, err
+	}
+	logger().Info("finalized ISO image", "iso_size", isoSize, "size", outputSize)
+	if stamp.reproducible() {
+		logger().Info("setting timestamps", "time", stamp.Timestamp.Format(time.RFC3339))
+		err = stampISO(f, stamp.Timestamp)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if hybrid {
+		logger().Info("writing isohybrid partition tables", "gpt", options.HybridGPT)
+		err = writeIsohybrid(f, outputSize, srcMBR, boots, options.HybridGPT, stamp)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return outputSize, nil
+}
+
+// isoProgress returns a progress totalling the files buildISOImage copies into the output, or nil if fn is nil
+func isoProgress(fn ProgressFunc, srcVolume *volume, isoFiles, deletes []string, catalogPath, efiSrcImage, efiBootImage string, files map[string]string, boots []*bootImage) (*progress, error) {
+	p := newProgress(fn)
+	if p == nil {
+		return nil, nil
+	}
+	entries, err := srcVolume.entries()
+	if err != nil {
+		return nil, err
+	}
+	srcSizes := make(map[string]int64)
+	for _, entry := range entries {
+		srcSizes[entry.Path] = entry.Size
+	}
+	contents := make(map[string]int64)
+	for name, src := range files {
+		contents[name] = hostFileSize(src)
+	}
+	for _, file := range isoFiles {
+		switch {
+		case strings.HasSuffix(file, "/") || file == catalogPath || isDeleted(file, deletes):
+		case file == efiSrcImage:
+			contents[file] = hostFileSize(efiBootImage)
+		case files[file] == "":
+			contents[file] = srcSizes[file]
+		}
+	}
+	for _, boot := range boots {
+		if boot.hidden {
+			contents[boot.path] = hostFileSize(boot.hostFile)
+		}
+	}
+	p.add(contents)
+	return p, nil
+}
+
+// bootImage is a source boot catalog entry and the image written for it in the output ISO
+type bootImage struct {
+	entry *BootEntry
+	// path is the ISO path of the boot image
+	path string
+	// hidden is true if the boot image has no directory entry
+	hidden bool
+	// hostFile holds replacement content for the boot image, if any
+	hostFile string
+}
+
+// readBootImages returns the boot entries of the source ISO in src that are not deleted and the ISO path
+// of its boot catalog
+func readBootImages(tmpDir string, src io.ReaderAt, srcFS filesystem.FileSystem, deletes []string) ([]*bootImage, string, error) {
+	catalog, err := readBootCatalog(src, srcFS)
+	if err != nil || catalog == nil {
+		return []*bootImage{}, "", err
+	}
+	boots := []*bootImage{}
+	for i, entry := range catalog.Entries {
+		boot := bootImage{entry: entry, path: entry.Path}
+		if entry.Path == "" {
+			// copy a hidden boot image out of the raw source ISO
+			boot.hidden = true
+			boot.path = fmt.Sprintf("/eltorito.%d.img", i)
+			boot.hostFile = filepath.Join(tmpDir, path.Base(boot.path))
+			err = extractBootImage(src, boot.hostFile, entry)
+			if err != nil {
+				return nil, "", err
+			}
+		} else if isDeleted(entry.Path, deletes) {
+			logger().Debug("deleting boot entry", "path", entry.Path)
+			continue
+		}
+		logger().Debug("boot entry", "platform", PlatformName(entry.Platform), "emulation", EmulationName(entry.Emulation),
+			"path", boot.path, "sectors", entry.SectorCount)
+		boots = append(boots, &boot)
+	}
+	return boots, catalog.Path, nil
+}
+
+// elToritoEntry returns the output catalog entry, recomputing the load size of images loaded in full
+func (b *bootImage) elToritoEntry() *iso9660.ElToritoEntry {
+	loadSize := b.entry.SectorCount
+	if b.entry.Emulation == iso9660.NoEmulation && (loadSize == 0 || loadSize >= loadSectors(b.entry.Size)) {
+		size := b.entry.Size
+		if b.hostFile != "" {
+			size = hostFileSize(b.hostFile)
+		}
+		loadSize = loadSectors(size)
+	}
+	return &iso9660.ElToritoEntry{
+		Platform:     b.entry.Platform,
+		Emulation:    b.entry.Emulation,
+		BootFile:     b.path,
+		HideBootFile: b.hidden,
+		LoadSegment:  b.entry.LoadSegment,
+		BootTable:    b.entry.BootTable,
+		SystemType:   mbr.Type(b.entry.SystemType),
+		LoadSize:     loadSize,
+	}
+}
+
+// prepareEFIBootImage returns a host copy of the EFI boot image for the output ISO
+func prepareEFIBootImage(ctx context.Context, tmpDir string, srcFS filesystem.FileSystem, efiSrcImage, replacement string, efiFiles map[string]string, stamp BuildStamp) (string, error) {
+
+	// efiImageName is the basename of the ISO EFI boot image
+	_, efiImageName := path.Split(efiSrcImage)
+
+	efiBootImage := replacement
+	if efiBootImage == "" {
+		// efiBootImage is the temp dir copy of the ISO EFI boot image
+		efiBootImage = filepath.Join(tmpDir, efiImageName+".iso")
+		err := copyFileFromImage(ctx, srcFS, efiBootImage, efiSrcImage, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(efiFiles) == 0 {
+		return efiBootImage, nil
+	}
+
+	// efiTmpModImage is the temp dir generated EFI boot image
+	efiTmpModImage := filepath.Join(tmpDir, efiImageName+".mod")
+	err := rebuildEFIImage(ctx, efiTmpModImage, efiBootImage, efiFiles, stamp)
+	if err != nil {
+		return "", err
+	}
+	return efiTmpModImage, nil
+}
+
+// rebuildEFIImage writes a new EFI image holding the files of srcImage with the files map applied
+func rebuildEFIImage(ctx context.Context, dstImage, srcImage string, files map[string]string, stamp BuildStamp) error {
+	logger().Info("rebuilding EFI boot image", "source", srcImage, "files", len(files))
+
+	for name, src := range files {
+		upper := strings.ToUpper(name)
+		if path.Dir(upper) == EFI_BOOT_DIR && path.Ext(upper) == ".EFI" {
+			err := validateEFILoaderFile(src, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	srcVolume, err := openImageFS(srcImage)
+	if err != nil {
+		return err
+	}
+	defer srcVolume.Close()
+	srcFS := srcVolume.fs
+	srcFiles, err := walkFS(srcFS, "/")
+	if err != nil {
+		return err
+	}
+
+	// keep the source size and FAT type unless the new contents no longer fit
+	contents, err := imageContentSizes(srcFS, "/")
+	if err != nil {
+		return err
+	}
+	for name, src := range files {
+		contents[name] = hostFileSize(src)
+	}
+	size := hostFileSize(srcImage)
+	fatType := FATAuto
+	if fat, ok := srcFS.(*fatFS); ok {
+		fatType = fat.FATType()
+	}
+	if !fatImageFits(size, fatType, contents, 0) {
+		fatType = FATAuto
+		size, err = autoFATImageSize(fatType, contents, EFI_AUTO_SLACK)
+		if err != nil {
+			return err
+		}
+	}
+	dstFS, fp, err := createFATImage(dstImage, size, fatType, srcFS.Label(), stamp)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	written := make(map[string]bool)
+	for _, file := range srcFiles {
+		name := strings.TrimRight(file, "/")
+		switch {
+		case strings.HasSuffix(file, "/"):
+			err = dstFS.Mkdir(name)
+		case files[name] != "":
+			err = copyFileToImage(ctx, dstFS, name, files[name], nil)
+			written[name] = true
+		default:
+			err = copyFileInterImage(ctx, dstFS, name, srcFS, name, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(files) {
+		if written[name] {
+			continue
+		}
+		dir := path.Dir(name)
+		if dir != "/" {
+			err = dstFS.Mkdir(dir)
+			if err != nil {
+				return err
+			}
+		}
+		err = copyFileToImage(ctx, dstFS, name, files[name], nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spoolReaders returns a map of cleaned image paths to host files, writing each reader to a file in tmpDir
+func spoolReaders(tmpDir string, files map[string]string, readers map[string]io.Reader) (map[string]string, error) {
+	ret := make(map[string]string)
+	for name, src := range files {
+		ret[cleanImagePath(name)] = src
+	}
+	for _, name := range sortedKeys(readers) {
+		fp, err := os.CreateTemp(tmpDir, "spool*")
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(fp, readers[name])
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		err = fp.Close()
+		if err != nil {
+			return nil, err
+		}
+		ret[cleanImagePath(name)] = fp.Name()
+	}
+	return ret, nil
+}
+
+// cleanImagePath returns name as an absolute slash-separated image path
+func cleanImagePath(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// isDeleted returns true if name is one of the deleted paths or is inside a deleted directory
+func isDeleted(name string, deletes []string) bool {
+	if name == "" {
+		return false
+	}
+	for _, target := range deletes {
+		if name == target || strings.HasPrefix(name, target+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// containsPath returns true if name is present in a walkFS file list
+func containsPath(files []string, name string) bool {
+	for _, file := range files {
+		if strings.TrimRight(file, "/") == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isoVolumeSize returns the volume space size recorded in the primary volume descriptor of the ISO in r
+func isoVolumeSize(r io.ReaderAt) (int64, error) {
+	descriptor := make([]byte, ISO_LOGICAL_BLOCK_SIZE)
+	_, err := r.ReadAt(descriptor, ISO_SYSTEM_AREA_SECTORS*ISO_LOGICAL_BLOCK_SIZE)
+	if err != nil {
+		return 0, fmt.Errorf("failed reading primary volume descriptor: %v", err)
+	}
+	if descriptor[0] != 1 || string(descriptor[1:6]) != "CD001" {
+		return 0, fmt.Errorf("primary volume descriptor not found")
+	}
+	blocks := int64(binary.LittleEndian.Uint32(descriptor[80:84]))
+	blockSize := int64(binary.LittleEndian.Uint16(descriptor[128:130]))
+	return blocks * blockSize, nil
+}
+
+func hostFileSize(filename string) int64 {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,116 @@
+package image
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestISOBuild(t *testing.T) {
+	dir := t.TempDir()
+	sourceImage := mkTestISO(t, dir)
+	outputImage := filepath.Join(dir, "output.iso")
+	options := ISOBuildOptions{
+		Files: map[string]string{
+			"autoexec.ipxe": mkTestFile(t, dir, "new.ipxe", "#!ipxe\necho replaced\n"),
+		},
+		Readers: map[string]io.Reader{
+			"/extra/added.txt": strings.NewReader("added from reader\n"),
+		},
+		EFIFiles: map[string]string{
+			"/autoexec.ipxe": mkTestFile(t, dir, "efi.ipxe", "#!ipxe\necho efi\n"),
+		},
+		Delete:      []string{"/docs"},
+		VolumeLabel: "REMASTER",
+	}
+	err := BuildISOImage(t.Context(), outputImage, sourceImage, options)
+	require.Nil(t, err)
+
+	files, err := ListImageFiles(outputImage)
+	require.Nil(t, err)
+	require.Contains(t, files, "/extra/added.txt")
+	require.Contains(t, files, "/isolinux.bin")
+	require.NotContains(t, files, "/docs/")
+	require.NotContains(t, files, "/docs/readme.txt")
+
+	label, _, err := ImageInfo(outputImage)
+	require.Nil(t, err)
+	require.Equal(t, "REMASTER", label)
+
+	require.Equal(t, "#!ipxe\necho replaced\n", readTestImageFile(t, outputImage, "/autoexec.ipxe"))
+	require.Equal(t, "added from reader\n", readTestImageFile(t, outputImage, "/extra/added.txt"))
+
+	efiImage := filepath.Join(dir, "output.img")
+	v, err := openImageFS(outputImage)
+	require.Nil(t, err)
+	defer v.Close()
+	fs := v.fs
+	err = copyFileFromImage(t.Context(), fs, efiImage, "/esp.img", nil)
+	require.Nil(t, err)
+	require.Equal(t, "#!ipxe\necho efi\n", readTestImageFile(t, efiImage, "/autoexec.ipxe"))
+	efiFiles, err := ListImageFiles(efiImage)
+	require.Nil(t, err)
+	require.Contains(t, efiFiles, "/EFI/BOOT/BOOTX64.EFI")
+}
+
+func TestISOBuildMissingDelete(t *testing.T) {
+	dir := t.TempDir()
+	sourceImage := mkTestISO(t, dir)
+	err := BuildISOImage(t.Context(), filepath.Join(dir, "output.iso"), sourceImage, ISOBuildOptions{Delete: []string{"/missing"}})
+	require.NotNil(t, err)
+}
+
+// isoTestSizes returns the file size of an ISO image and the volume size recorded in it
+func isoTestSizes(t *testing.T, filename string) (int64, int64) {
+	fp, err := os.Open(filename)
+	require.Nil(t, err)
+	defer fp.Close()
+	volumeSize, err := isoVolumeSize(fp)
+	require.Nil(t, err)
+	return hostFileSize(filename), volumeSize
+}
+
+func TestISOBuildSize(t *testing.T) {
+	dir := t.TempDir()
+	sourceImage := mkTestISO(t, dir)
+
+	// the output is cut to its volume size rather than the size of the source image
+	copyImage := filepath.Join(dir, "copy.iso")
+	err := BuildISOImage(t.Context(), copyImage, sourceImage, ISOBuildOptions{})
+	require.Nil(t, err)
+	size, volumeSize := isoTestSizes(t, copyImage)
+	require.Equal(t, volumeSize, size)
+	require.Less(t, size, hostFileSize(sourceImage))
+
+	// a large replacement grows the output, a small one shrinks it
+	large := mkTestFile(t, dir, "large.bin", strings.Repeat("X", 3*1024*1024+1))
+	largeImage := filepath.Join(dir, "large.iso")
+	err = BuildISOImage(t.Context(), largeImage, sourceImage, ISOBuildOptions{Files: map[string]string{"/docs/readme.txt": large}})
+	require.Nil(t, err)
+	largeSize, volumeSize := isoTestSizes(t, largeImage)
+	require.Equal(t, volumeSize, largeSize)
+	require.GreaterOrEqual(t, largeSize, size+3*1024*1024)
+	require.Equal(t, strings.Repeat("X", 3*1024*1024+1), readTestImageFile(t, largeImage, "/docs/readme.txt"))
+
+	small := mkTestFile(t, dir, "small.bin", strings.Repeat("L", 2048))
+	smallImage := filepath.Join(dir, "small.iso")
+	err = BuildISOImage(t.Context(), smallImage, sourceImage, ISOBuildOptions{Files: map[string]string{"/isolinux.bin": small}})
+	require.Nil(t, err)
+	smallSize, volumeSize := isoTestSizes(t, smallImage)
+	require.Equal(t, volumeSize, smallSize)
+	require.Less(t, smallSize, size)
+
+	// hybrid output is padded to the isohybrid geometry with room for the backup GPT
+	hybridImage := filepath.Join(dir, "hybrid.iso")
+	err = BuildISOImage(t.Context(), hybridImage, sourceImage, ISOBuildOptions{HybridGPT: true})
+	require.Nil(t, err)
+	hybridSize, volumeSize := isoTestSizes(t, hybridImage)
+	require.Equal(t, isohybridSize(volumeSize), hybridSize)
+	require.Zero(t, hybridSize%ISOHYBRID_ALIGN)
+	report, err := VerifyImage(hybridImage)
+	require.Nil(t, err)
+	require.True(t, report.OK(), "%v", report.Findings)
+}
@@ -0,0 +1,172 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
+	"github.com/rstms/go-diskfs/partition/gpt"
+	"github.com/rstms/go-diskfs/partition/mbr"
+	"github.com/rstms/go-diskfs/util"
+	"io"
+)
+
+const (
+	// ISOHYBRID_PARTITION_TYPE is the MBR type isohybrid uses for the partition covering the ISO
+	ISOHYBRID_PARTITION_TYPE = mbr.Type(0x17)
+	// ISOHYBRID_ALIGN pads hybrid images to whole cylinders of the isohybrid 64 head, 32 sector geometry
+	ISOHYBRID_ALIGN        = 64 * 32 * PARTITION_SECTOR_SIZE
+	ISOHYBRID_HEADS        = 64
+	ISOHYBRID_SECTORS      = 32
+	MBR_BOOT_LBA_OFFSET    = 0x1b0
+	MBR_PARTITION_OFFSET   = 0x1be
+	GPT_ARRAY_SECTORS      = 32
+	GPT_BACKUP_SIZE        = (GPT_ARRAY_SECTORS + 1) * PARTITION_SECTOR_SIZE
+	ISOHYBRID_MAX_CYLINDER = 1023
+)
+
+// isohybridSize returns the output size of a hybrid image holding isoSize bytes of ISO data
+func isohybridSize(isoSize int64) int64 {
+	size := isoSize + GPT_BACKUP_SIZE
+	return (size + ISOHYBRID_ALIGN - 1) / ISOHYBRID_ALIGN * ISOHYBRID_ALIGN
+}
+
+// readMBRBootCode returns the first sector of the source ISO, which carries the isohybrid boot code of a hybrid ISO
+func readMBRBootCode(src io.ReaderAt, srcName string) ([]byte, error) {
+	sector := make([]byte, PARTITION_SECTOR_SIZE)
+	_, err := src.ReadAt(sector, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s MBR: %v", srcName, err)
+	}
+	return sector, nil
+}
+
+// writeIsohybrid writes an MBR, and optionally a GPT, to the system area of the finalized ISO in f.
+// The boot code of srcMBR is kept and its boot image address is moved from the source BIOS entry to
+// the output BIOS entry, so hybrid boot code from isohybrid or grub-mkrescue still finds its loader.
+// A source without boot code, such as an ISO that is not hybrid, gives an image that boots from USB
+// only through EFI, so it is refused if there is no EFI boot image.
+func writeIsohybrid(f util.File, size int64, srcMBR []byte, srcBoots []*bootImage, withGPT bool, stamp BuildStamp) error {
+	fs, err := iso9660.Read(f, size, 0, ISO_LOGICAL_BLOCK_SIZE)
+	if err != nil {
+		return err
+	}
+	catalog, err := readBootCatalog(f, fs)
+	if err != nil {
+		return err
+	}
+	if catalog == nil {
+		return fmt.Errorf("isohybrid output requires an El Torito boot catalog")
+	}
+
+	var efi *BootEntry
+	for _, entry := range catalog.Entries {
+		if entry.Platform == iso9660.EFI {
+			efi = entry
+			break
+		}
+	}
+	if withGPT && efi == nil {
+		return fmt.Errorf("GPT output requires an EFI boot image")
+	}
+	if bytes.Count(srcMBR[:MBR_BOOT_LBA_OFFSET], []byte{0}) == MBR_BOOT_LBA_OFFSET {
+		if efi == nil {
+			return fmt.Errorf("isohybrid output requires MBR boot code in the source ISO or an EFI boot image")
+		}
+		logger().Warn("source ISO has no MBR boot code; the hybrid image boots from USB only through EFI")
+	}
+
+	sector := make([]byte, PARTITION_SECTOR_SIZE)
+	copy(sector, srcMBR[:MBR_PARTITION_OFFSET])
+	for i, entry := range catalog.Entries {
+		if entry.Platform == iso9660.BIOS && i < len(srcBoots) {
+			patchMBRBootLBA(sector, srcBoots[i].entry.LoadRBA, entry.LoadRBA)
+		}
+	}
+	_, err = f.WriteAt(sector, 0)
+	if err != nil {
+		return err
+	}
+
+	sectors := size / PARTITION_SECTOR_SIZE
+	table := mbr.Table{
+		LogicalSectorSize:  PARTITION_SECTOR_SIZE,
+		PhysicalSectorSize: PARTITION_SECTOR_SIZE,
+	}
+	if withGPT {
+		table.Partitions = []*mbr.Partition{mbrPartition(false, mbr.GPTProtective, 1, sectors-1)}
+		err = writeIsohybridGPT(f, size, efi, stamp)
+		if err != nil {
+			return err
+		}
+	} else {
+		table.Partitions = []*mbr.Partition{mbrPartition(true, ISOHYBRID_PARTITION_TYPE, 0, sectors)}
+		if efi != nil {
+			start := int64(efi.LoadRBA) * (ISO_LOGICAL_BLOCK_SIZE / PARTITION_SECTOR_SIZE)
+			table.Partitions = append(table.Partitions, mbrPartition(false, mbr.EFISystem, start, efiPartitionSectors(efi)))
+		}
+	}
+	return table.Write(f, size)
+}
+
+// writeIsohybridGPT writes a GPT with an EFI System Partition covering the El Torito EFI image
+func writeIsohybridGPT(f util.File, size int64, efi *BootEntry, stamp BuildStamp) error {
+	start := uint64(efi.LoadRBA) * (ISO_LOGICAL_BLOCK_SIZE / PARTITION_SECTOR_SIZE)
+	table := gpt.Table{
+		LogicalSectorSize:  PARTITION_SECTOR_SIZE,
+		PhysicalSectorSize: PARTITION_SECTOR_SIZE,
+		GUID:               stamp.guid("disk"),
+		Partitions: []*gpt.Partition{{
+			Start: start,
+			End:   start + uint64(efiPartitionSectors(efi)) - 1,
+			Size:  uint64(efi.Size),
+			Type:  gpt.EFISystemPartition,
+			Name:  "EFI System",
+			GUID:  stamp.guid("partition 1"),
+		}},
+	}
+	return table.Write(f, size)
+}
+
+// efiPartitionSectors returns the 512 byte sector count of an EFI boot image
+func efiPartitionSectors(efi *BootEntry) int64 {
+	return (efi.Size + PARTITION_SECTOR_SIZE - 1) / PARTITION_SECTOR_SIZE
+}
+
+// patchMBRBootLBA moves the boot image address stored by hybrid boot code from srcLBA to dstLBA.
+// isohybrid stores the 512 byte sector address of the boot image and grub-mkrescue stores it plus 4,
+// so the value is only changed if it falls in that range.
+func patchMBRBootLBA(sector []byte, srcLBA, dstLBA uint32) {
+	value := binary.LittleEndian.Uint64(sector[MBR_BOOT_LBA_OFFSET : MBR_BOOT_LBA_OFFSET+8])
+	base := uint64(srcLBA) * 4
+	if srcLBA == 0 || value < base || value > base+4 {
+		return
+	}
+	binary.LittleEndian.PutUint64(sector[MBR_BOOT_LBA_OFFSET:MBR_BOOT_LBA_OFFSET+8], value-base+uint64(dstLBA)*4)
+}
+
+// mbrPartition returns an MBR entry with CHS addresses in the isohybrid geometry
+func mbrPartition(bootable bool, partitionType mbr.Type, start, sectors int64) *mbr.Partition {
+	p := mbr.Partition{
+		Bootable: bootable,
+		Type:     partitionType,
+		Start:    uint32(start),
+		Size:     uint32(sectors),
+	}
+	p.StartHead, p.StartSector, p.StartCylinder = chsAddress(start)
+	p.EndHead, p.EndSector, p.EndCylinder = chsAddress(start + sectors - 1)
+	return &p
+}
+
+// chsAddress returns the head, sector and cylinder bytes of an MBR entry for lba
+func chsAddress(lba int64) (uint8, uint8, uint8) {
+	cylinder := lba / (ISOHYBRID_HEADS * ISOHYBRID_SECTORS)
+	head := (lba / ISOHYBRID_SECTORS) % ISOHYBRID_HEADS
+	sector := lba%ISOHYBRID_SECTORS + 1
+	if cylinder > ISOHYBRID_MAX_CYLINDER {
+		cylinder = ISOHYBRID_MAX_CYLINDER
+		head = ISOHYBRID_HEADS - 1
+		sector = ISOHYBRID_SECTORS
+	}
+	return uint8(head), uint8(sector) | uint8((cylinder>>2)&0xc0), uint8(cylinder & 0xff)
+}
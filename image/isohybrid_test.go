@@ -0,0 +1,99 @@
+package image
+
+import (
+	"encoding/binary"
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsohybrid(t *testing.T) {
+	dir := t.TempDir()
+	sourceImage := mkTestISO(t, dir)
+	srcCatalog, err := ReadBootCatalog(sourceImage)
+	require.Nil(t, err)
+
+	// fake isohybrid boot code addressing the source BIOS boot image
+	bootCode := make([]byte, MBR_PARTITION_OFFSET)
+	copy(bootCode, strings.Repeat("B", MBR_BOOT_LBA_OFFSET))
+	binary.LittleEndian.PutUint64(bootCode[MBR_BOOT_LBA_OFFSET:], uint64(srcCatalog.Entries[0].LoadRBA)*4)
+	fp, err := os.OpenFile(sourceImage, os.O_RDWR, 0)
+	require.Nil(t, err)
+	_, err = fp.WriteAt(bootCode, 0)
+	require.Nil(t, err)
+	fp.Close()
+
+	// remove a file ahead of the boot images so they move in the output
+	outputImage := filepath.Join(dir, "hybrid.iso")
+	err = BuildISOImage(t.Context(), outputImage, sourceImage, ISOBuildOptions{Hybrid: true, Delete: []string{"/autoexec.ipxe"}})
+	require.Nil(t, err)
+	size := hostFileSize(outputImage)
+	require.Equal(t, int64(0), size%ISOHYBRID_ALIGN)
+
+	report, err := BootInfo(outputImage)
+	require.Nil(t, err)
+	require.Equal(t, "iso9660", report.Format)
+	require.True(t, report.Isohybrid)
+	require.Nil(t, report.GPT)
+	require.Len(t, report.Entries, 2)
+	bios := report.Entries[0]
+	efi := report.Entries[1]
+	require.Len(t, report.MBR, 2)
+	require.Equal(t, &Partition{Index: 1, Table: "mbr", Type: "0x17", Start: 0, Size: size, Bootable: true}, report.MBR[0])
+	require.Equal(t, "0xef", report.MBR[1].Type)
+	require.Equal(t, int64(efi.LoadRBA)*ISO_LOGICAL_BLOCK_SIZE, report.MBR[1].Start)
+	require.Equal(t, int64(EFI_IMAGE_SIZE), report.MBR[1].Size)
+
+	require.NotEqual(t, srcCatalog.Entries[0].LoadRBA, bios.LoadRBA)
+	output, err := os.Open(outputImage)
+	require.Nil(t, err)
+	defer output.Close()
+	sector, err := readMBRBootCode(output, outputImage)
+	require.Nil(t, err)
+	require.Equal(t, bootCode[:MBR_BOOT_LBA_OFFSET], sector[:MBR_BOOT_LBA_OFFSET])
+	require.Equal(t, uint64(bios.LoadRBA)*4, binary.LittleEndian.Uint64(sector[MBR_BOOT_LBA_OFFSET:]))
+	files, err := ListImageFiles(outputImage)
+	require.Nil(t, err)
+	require.Contains(t, files, "/docs/readme.txt")
+
+	gptImage := filepath.Join(dir, "gpt.iso")
+	err = BuildISOImage(t.Context(), gptImage, sourceImage, ISOBuildOptions{HybridGPT: true})
+	require.Nil(t, err)
+	report, err = BootInfo(gptImage)
+	require.Nil(t, err)
+	require.True(t, report.Isohybrid)
+	require.Len(t, report.MBR, 1)
+	require.Equal(t, "0xee", report.MBR[0].Type)
+	require.Len(t, report.GPT, 1)
+	require.Equal(t, "EFI System", report.GPT[0].TypeName)
+	require.Equal(t, int64(report.Entries[1].LoadRBA)*ISO_LOGICAL_BLOCK_SIZE, report.GPT[0].Start)
+	require.Equal(t, int64(EFI_IMAGE_SIZE), report.GPT[0].Size)
+	require.Len(t, report.Entries[1].Loaders, 1)
+	require.True(t, report.Entries[1].Loaders[0].Valid)
+
+	// the whole image is still the ISO and the ESP opens as a partition
+	_, err = ListImageFiles(gptImage)
+	require.Nil(t, err)
+	espFiles, err := ListPartitionFiles(gptImage, PartitionSelector{Label: "ESP"})
+	require.Nil(t, err)
+	require.Contains(t, espFiles, "/EFI/BOOT/")
+
+	// a GPT needs an EFI boot image
+	biosOnly := buildTestISO(t, dir, "bios.iso", map[string]string{"/isolinux.bin": filepath.Join(dir, "isolinux.bin")},
+		[]*iso9660.ElToritoEntry{{Platform: iso9660.BIOS, Emulation: iso9660.NoEmulation, BootFile: "/isolinux.bin", LoadSize: 4}})
+	err = BuildISOImage(t.Context(), filepath.Join(dir, "bios-gpt.iso"), biosOnly, ISOBuildOptions{HybridGPT: true})
+	require.ErrorContains(t, err, "requires an EFI boot image")
+
+	// a source without MBR boot code boots from USB only through EFI, and not at all without it
+	buf := captureLog(t, slog.LevelWarn)
+	plainSource := mkTestISO(t, t.TempDir())
+	err = BuildISOImage(t.Context(), filepath.Join(dir, "plain-hybrid.iso"), plainSource, ISOBuildOptions{Hybrid: true})
+	require.Nil(t, err)
+	require.Contains(t, buf.String(), "no MBR boot code")
+	err = BuildISOImage(t.Context(), filepath.Join(dir, "bios-hybrid.iso"), biosOnly, ISOBuildOptions{Hybrid: true})
+	require.ErrorContains(t, err, "requires MBR boot code")
+}
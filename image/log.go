@@ -0,0 +1,25 @@
+package image
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var packageLogger atomic.Pointer[slog.Logger]
+
+// SetLogger routes the diagnostics of the package to l. Builds and extractions log their steps at
+// slog.LevelInfo and each file at slog.LevelDebug. A nil logger, the default, discards them.
+func SetLogger(l *slog.Logger) {
+	packageLogger.Store(l)
+}
+
+// logger returns the logger set by SetLogger or one that discards everything
+func logger() *slog.Logger {
+	l := packageLogger.Load()
+	if l == nil {
+		return discardLogger
+	}
+	return l
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
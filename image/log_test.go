@@ -0,0 +1,51 @@
+package image
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// captureLog sends the package log at level to the returned buffer until the test ends
+func captureLog(t *testing.T, level slog.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: level})))
+	t.Cleanup(func() { SetLogger(nil) })
+	return &buf
+}
+
+func TestLogger(t *testing.T) {
+	dir := t.TempDir()
+	options := EFIImageOptions{
+		BootFile: mkTestPE(t, dir, "bootx64.efi", 0x8664, 4096),
+		BootName: "BOOTX64.EFI",
+	}
+
+	buf := captureLog(t, slog.LevelInfo)
+	require.Nil(t, BuildEFIImage(t.Context(), filepath.Join(dir, "info.img"), options))
+	require.Contains(t, buf.String(), "msg=\"building EFI image\"")
+	require.NotContains(t, buf.String(), "BOOTX64.EFI")
+
+	buf = captureLog(t, slog.LevelDebug)
+	require.Nil(t, BuildEFIImage(t.Context(), filepath.Join(dir, "debug.img"), options))
+	require.Contains(t, buf.String(), "path=/EFI/BOOT/BOOTX64.EFI")
+
+	// nothing reaches stdout, even with the default logger
+	SetLogger(nil)
+	stdout := os.Stdout
+	fp, err := os.Create(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	defer fp.Close()
+	os.Stdout = fp
+	defer func() { os.Stdout = stdout }()
+	isoImage := mkTestISO(t, dir)
+	_, _, err = ImageInfo(isoImage)
+	require.Nil(t, err)
+	require.Nil(t, BuildISOImage(t.Context(), filepath.Join(dir, "output.iso"), isoImage, ISOBuildOptions{}))
+	require.Nil(t, ExtractImage(t.Context(), isoImage, t.TempDir(), ExtractOptions{}))
+	os.Stdout = stdout
+	require.Equal(t, int64(0), hostFileSize(fp.Name()))
+}
@@ -0,0 +1,619 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	MANIFEST_FAT  = "fat"
+	MANIFEST_ISO  = "iso"
+	MANIFEST_DISK = "disk"
+)
+
+// Manifest describes an image build. Relative host paths, including the output, are relative to
+// the directory holding the manifest file.
+type Manifest struct {
+	// Type is "fat", "iso" or "disk"
+	Type   string `yaml:"type" toml:"type"`
+	Output string `yaml:"output" toml:"output"`
+	// Size is the FAT image or disk size in bytes with an optional K, M or G suffix, or "auto"
+	Size string `yaml:"size" toml:"size"`
+	// Label is the volume label of the FAT image, the ISO or the disk ESP
+	Label string `yaml:"label" toml:"label"`
+	// FAT is the FAT type of the FAT image or the disk ESP: 12, 16, 32 or auto
+	FAT string `yaml:"fat" toml:"fat"`
+	// Boot lists the EFI loaders of the FAT image, the disk ESP or the ISO EFI boot image
+	Boot []ManifestLoader `yaml:"boot" toml:"boot"`
+	// Files are copied to the FAT image, the disk ESP or the ISO
+	Files []ManifestFile `yaml:"files" toml:"files"`
+	// Source is the ISO image an ISO build starts from
+	Source string `yaml:"source" toml:"source"`
+	// EFIFiles are copied to the EFI boot image of an ISO
+	EFIFiles []ManifestFile `yaml:"efi_files" toml:"efi_files"`
+	// Delete lists ISO paths removed from the source
+	Delete []string `yaml:"delete" toml:"delete"`
+	// Hybrid and GPT write an isohybrid MBR and GPT to an ISO
+	Hybrid bool `yaml:"hybrid" toml:"hybrid"`
+	GPT    bool `yaml:"gpt" toml:"gpt"`
+	// Table is the disk partition table: gpt or mbr
+	Table string `yaml:"table" toml:"table"`
+	// ProtectiveMBR writes a protective MBR ahead of a disk GPT; the default is true
+	ProtectiveMBR *bool `yaml:"protective_mbr" toml:"protective_mbr"`
+	// ESPSize is the size of the disk ESP
+	ESPSize string `yaml:"esp_size" toml:"esp_size"`
+	// Partitions are disk data partitions
+	Partitions []ManifestPartition `yaml:"partitions" toml:"partitions"`
+	// Timestamp fixes the image timestamps as Unix seconds or RFC 3339; see BuildStamp
+	Timestamp string `yaml:"timestamp" toml:"timestamp"`
+	// Serial fixes the FAT volume serial as XXXX-XXXX hex
+	Serial string `yaml:"serial" toml:"serial"`
+	// Progress receives the files and bytes copied by Build
+	Progress ProgressFunc `yaml:"-" toml:"-"`
+	// OutputOptions selects whether Build replaces an existing output file
+	OutputOptions OutputOptions `yaml:"-" toml:"-"`
+
+	filename string
+	// lines maps key paths such as "files[1].src" to their manifest line
+	lines map[string]int
+}
+
+// ManifestLoader is an EFI loader installed under the default name for its architecture
+type ManifestLoader struct {
+	Arch string `yaml:"arch" toml:"arch"`
+	File string `yaml:"file" toml:"file"`
+}
+
+// ManifestFile is a host file or directory copied to image path Dest. Dest defaults to the root
+// directory; a Dest ending with a slash receives Src under its basename.
+type ManifestFile struct {
+	Src  string `yaml:"src" toml:"src"`
+	Dest string `yaml:"dest" toml:"dest"`
+}
+
+// ManifestPartition is a disk data partition filled from host directory Source
+type ManifestPartition struct {
+	Name   string `yaml:"name" toml:"name"`
+	Source string `yaml:"source" toml:"source"`
+	Size   string `yaml:"size" toml:"size"`
+	Label  string `yaml:"label" toml:"label"`
+	FAT    string `yaml:"fat" toml:"fat"`
+}
+
+var yamlLineError = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*?)(?: in type \S+)?$`)
+
+// LoadManifest reads a .yaml, .yml or .toml manifest file
+func LoadManifest(filename string) (*Manifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := Manifest{filename: filename, lines: make(map[string]int)}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = m.parseYAML(data)
+	case ".toml":
+		err = m.parseTOML(data)
+	default:
+		return nil, fmt.Errorf("unknown manifest format (expected .yaml, .yml or .toml): %s", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *Manifest) parseYAML(data []byte) error {
+	var root yaml.Node
+	err := yaml.Unmarshal(data, &root)
+	if err != nil {
+		return m.yamlError(err)
+	}
+	if len(root.Content) > 0 {
+		recordYAMLLines(m.lines, root.Content[0], "")
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(m)
+	if err != nil && err.Error() != "EOF" {
+		return m.yamlError(err)
+	}
+	return nil
+}
+
+// yamlError rewrites yaml.v3 "line N: message" errors as "filename:N: message"
+func (m *Manifest) yamlError(err error) error {
+	messages := []string{err.Error()}
+	var typeError *yaml.TypeError
+	if errors.As(err, &typeError) {
+		messages = typeError.Errors
+	}
+	errs := []error{}
+	for _, message := range messages {
+		match := yamlLineError.FindStringSubmatch(strings.TrimSpace(message))
+		if match == nil {
+			errs = append(errs, fmt.Errorf("%s: %s", m.filename, message))
+		} else {
+			errs = append(errs, fmt.Errorf("%s:%s: %s", m.filename, match[1], match[2]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// recordYAMLLines maps the key paths below node to their lines
+func recordYAMLLines(lines map[string]int, node *yaml.Node, prefix string) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := joinManifestKey(prefix, node.Content[i].Value)
+			lines[key] = node.Content[i].Line
+			recordYAMLLines(lines, node.Content[i+1], key)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			key := fmt.Sprintf("%s[%d]", prefix, i)
+			lines[key] = item.Line
+			recordYAMLLines(lines, item, key)
+		}
+	}
+}
+
+func (m *Manifest) parseTOML(data []byte) error {
+	// decode first: go-toml reports syntax errors with their position only while decoding
+	err := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(m)
+	if err != nil {
+		return m.tomlError(err)
+	}
+	err = recordTOMLLines(m.lines, data)
+	if err != nil {
+		return m.tomlError(err)
+	}
+	return nil
+}
+
+// tomlError adds the file name and line to go-toml errors
+func (m *Manifest) tomlError(err error) error {
+	var strictError *toml.StrictMissingError
+	if errors.As(err, &strictError) {
+		errs := []error{}
+		for _, e := range strictError.Errors {
+			line, _ := e.Position()
+			errs = append(errs, fmt.Errorf("%s:%d: unknown key %s", m.filename, line, strings.Join(e.Key(), ".")))
+		}
+		return errors.Join(errs...)
+	}
+	var decodeError *toml.DecodeError
+	if errors.As(err, &decodeError) {
+		line, _ := decodeError.Position()
+		return fmt.Errorf("%s:%d: %s", m.filename, line, strings.TrimPrefix(decodeError.Error(), "toml: "))
+	}
+	var parserError *unstable.ParserError
+	if errors.As(err, &parserError) {
+		return fmt.Errorf("%s: %s", m.filename, parserError.Message)
+	}
+	return fmt.Errorf("%s: %v", m.filename, err)
+}
+
+// recordTOMLLines maps the key paths of a TOML document to their lines
+func recordTOMLLines(lines map[string]int, data []byte) error {
+	p := unstable.Parser{}
+	p.Reset(data)
+	prefix := ""
+	arrayTables := make(map[string]int)
+	for p.NextExpression() {
+		e := p.Expression()
+		switch e.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			key, line := tomlKey(&p, e)
+			prefix = key
+			if e.Kind == unstable.ArrayTable {
+				prefix = fmt.Sprintf("%s[%d]", key, arrayTables[key])
+				arrayTables[key]++
+			}
+			lines[key] = line
+			lines[prefix] = line
+		case unstable.KeyValue:
+			recordTOMLKeyValue(&p, lines, e, prefix)
+		}
+	}
+	return p.Error()
+}
+
+func recordTOMLKeyValue(p *unstable.Parser, lines map[string]int, e *unstable.Node, prefix string) {
+	name, line := tomlKey(p, e)
+	key := joinManifestKey(prefix, name)
+	lines[key] = line
+	recordTOMLValue(p, lines, e.Value(), key, line)
+}
+
+func recordTOMLValue(p *unstable.Parser, lines map[string]int, value *unstable.Node, key string, line int) {
+	switch value.Kind {
+	case unstable.InlineTable:
+		children := value.Children()
+		for children.Next() {
+			recordTOMLKeyValue(p, lines, children.Node(), key)
+		}
+	case unstable.Array:
+		children := value.Children()
+		for i := 0; children.Next(); i++ {
+			child := children.Node()
+			itemKey := fmt.Sprintf("%s[%d]", key, i)
+			itemLine := line
+			if child.Raw.Length > 0 {
+				itemLine = p.Shape(child.Raw).Start.Line
+			} else if child.Kind == unstable.InlineTable {
+				grandchildren := child.Children()
+				if grandchildren.Next() {
+					_, itemLine = tomlKey(p, grandchildren.Node())
+				}
+			}
+			lines[itemKey] = itemLine
+			recordTOMLValue(p, lines, child, itemKey, itemLine)
+		}
+	}
+}
+
+// tomlKey returns the dotted key of a table or key-value expression and its line
+func tomlKey(p *unstable.Parser, e *unstable.Node) (string, int) {
+	parts := []string{}
+	line := 0
+	keys := e.Key()
+	for keys.Next() {
+		node := keys.Node()
+		if line == 0 {
+			line = p.Shape(node.Raw).Start.Line
+		}
+		parts = append(parts, string(node.Data))
+	}
+	return strings.Join(parts, "."), line
+}
+
+func joinManifestKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// line returns the manifest line of key or its nearest parent, or 0 if unknown
+func (m *Manifest) line(key string) int {
+	for key != "" {
+		if line, ok := m.lines[key]; ok {
+			return line
+		}
+		key = key[:max(strings.LastIndexAny(key, ".["), 0)]
+	}
+	return 0
+}
+
+// Validate checks the manifest, returning every problem found with its line number
+func (m *Manifest) Validate() error {
+	_, err := m.plan()
+	return err
+}
+
+// Build validates the manifest and writes the image it describes
+func (m *Manifest) Build(ctx context.Context) error {
+	build, err := m.plan()
+	if err != nil {
+		return err
+	}
+	return build(ctx)
+}
+
+// OutputPath returns the host path of the manifest output
+func (m *Manifest) OutputPath() string {
+	return m.hostPath(m.Output)
+}
+
+// manifestPlan collects validation errors while converting a manifest to library options
+type manifestPlan struct {
+	m    *Manifest
+	errs []error
+}
+
+func (p *manifestPlan) errorf(key, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if line := p.m.line(key); line > 0 {
+		p.errs = append(p.errs, fmt.Errorf("%s:%d: %s: %s", p.m.filename, line, key, message))
+	} else {
+		p.errs = append(p.errs, fmt.Errorf("%s: %s: %s", p.m.filename, key, message))
+	}
+}
+
+// plan converts the manifest to library options and returns the function building the image
+func (m *Manifest) plan() (func(ctx context.Context) error, error) {
+	p := manifestPlan{m: m}
+	output := m.OutputPath()
+	if m.Output == "" {
+		p.errorf("output", "missing output path")
+	}
+	stamp := p.stamp()
+	var build func(ctx context.Context) error
+	switch m.Type {
+	case MANIFEST_FAT:
+		p.unused(map[string]bool{
+			"source":         m.Source != "",
+			"efi_files":      len(m.EFIFiles) > 0,
+			"delete":         len(m.Delete) > 0,
+			"hybrid":         m.Hybrid,
+			"gpt":            m.GPT,
+			"table":          m.Table != "",
+			"protective_mbr": m.ProtectiveMBR != nil,
+			"esp_size":       m.ESPSize != "",
+			"partitions":     len(m.Partitions) > 0,
+		})
+		options := p.efiOptions(m.Size, "size")
+		options.Stamp = stamp
+		options.Progress = m.Progress
+		options.Output = m.OutputOptions
+		build = func(ctx context.Context) error {
+			return BuildEFIImage(ctx, output, options)
+		}
+	case MANIFEST_ISO:
+		p.unused(map[string]bool{
+			"size":           m.Size != "",
+			"fat":            m.FAT != "",
+			"table":          m.Table != "",
+			"protective_mbr": m.ProtectiveMBR != nil,
+			"esp_size":       m.ESPSize != "",
+			"partitions":     len(m.Partitions) > 0,
+		})
+		options := p.isoOptions()
+		options.Stamp = stamp
+		options.Progress = m.Progress
+		options.Output = m.OutputOptions
+		source := m.hostPath(m.Source)
+		if m.Source == "" {
+			p.errorf("source", "missing source ISO")
+		} else {
+			p.checkFile("source", source)
+		}
+		build = func(ctx context.Context) error {
+			return BuildISOImage(ctx, output, source, options)
+		}
+	case MANIFEST_DISK:
+		p.unused(map[string]bool{
+			"source":    m.Source != "",
+			"efi_files": len(m.EFIFiles) > 0,
+			"delete":    len(m.Delete) > 0,
+			"hybrid":    m.Hybrid,
+			"gpt":       m.GPT,
+		})
+		options := p.diskOptions()
+		options.Stamp = stamp
+		options.Progress = m.Progress
+		options.Output = m.OutputOptions
+		build = func(ctx context.Context) error {
+			return BuildDiskImage(ctx, output, options)
+		}
+	case "":
+		p.errorf("type", "missing image type (expected fat, iso or disk)")
+	default:
+		p.errorf("type", "unknown image type %q (expected fat, iso or disk)", m.Type)
+	}
+	if len(p.errs) > 0 {
+		return nil, errors.Join(p.errs...)
+	}
+	return build, nil
+}
+
+// unused reports the keys that are set but not used by the manifest type
+func (p *manifestPlan) unused(keys map[string]bool) {
+	for _, key := range sortedKeys(keys) {
+		if keys[key] {
+			p.errorf(key, "not used by %s manifests", p.m.Type)
+		}
+	}
+}
+
+// efiOptions returns the EFI image options of a FAT manifest or the ESP of a disk manifest
+func (p *manifestPlan) efiOptions(size, sizeKey string) EFIImageOptions {
+	options := EFIImageOptions{
+		VolumeLabel: p.m.Label,
+		Size:        p.size(sizeKey, size, EFI_SIZE_AUTO),
+		Files:       p.files("files", p.m.Files),
+	}
+	fatType, err := ParseFATType(p.m.FAT)
+	if err != nil {
+		p.errorf("fat", "%v", err)
+	}
+	options.FATType = fatType
+	for _, loader := range p.loaders() {
+		options.Loaders = append(options.Loaders, loader)
+	}
+	return options
+}
+
+func (p *manifestPlan) isoOptions() ISOBuildOptions {
+	options := ISOBuildOptions{
+		Files:       p.treeFiles("files", p.files("files", p.m.Files)),
+		EFIFiles:    p.treeFiles("efi_files", p.files("efi_files", p.m.EFIFiles)),
+		VolumeLabel: p.m.Label,
+		Hybrid:      p.m.Hybrid,
+		HybridGPT:   p.m.GPT,
+	}
+	for i, loader := range p.loaders() {
+		bootName, _ := EFIBootName(loader.Arch)
+		name := EFI_BOOT_DIR + "/" + bootName
+		if options.EFIFiles[name] != "" {
+			p.errorf(fmt.Sprintf("boot[%d]", i), "duplicate EFI loader: %s", bootName)
+		}
+		options.EFIFiles[name] = loader.File
+	}
+	for i, name := range p.m.Delete {
+		if cleanImagePath(name) == "/" {
+			p.errorf(fmt.Sprintf("delete[%d]", i), "cannot delete the root directory")
+		}
+		options.Delete = append(options.Delete, cleanImagePath(name))
+	}
+	return options
+}
+
+func (p *manifestPlan) diskOptions() DiskImageOptions {
+	options := DiskImageOptions{
+		Table: p.m.Table,
+		ESP:   p.efiOptions(p.m.ESPSize, "esp_size"),
+		Size:  p.size("size", p.m.Size, 0),
+	}
+	switch p.m.Table {
+	case "", DISK_TABLE_GPT, DISK_TABLE_MBR:
+	default:
+		p.errorf("table", "unknown partition table type %q (expected gpt or mbr)", p.m.Table)
+	}
+	if p.m.ProtectiveMBR != nil {
+		options.NoProtectiveMBR = !*p.m.ProtectiveMBR
+	}
+	for i, partition := range p.m.Partitions {
+		key := fmt.Sprintf("partitions[%d]", i)
+		source := p.m.hostPath(partition.Source)
+		if partition.Source == "" {
+			p.errorf(key+".source", "missing source directory")
+		} else if stat, err := os.Stat(source); err != nil {
+			p.errorf(key+".source", "%v", err)
+		} else if !stat.IsDir() {
+			p.errorf(key+".source", "not a directory: %s", source)
+		}
+		fatType, err := ParseFATType(partition.FAT)
+		if err != nil {
+			p.errorf(key+".fat", "%v", err)
+		}
+		options.Partitions = append(options.Partitions, DiskPartition{
+			Name:        partition.Name,
+			SourceDir:   source,
+			Size:        p.size(key+".size", partition.Size, 0),
+			FATType:     fatType,
+			VolumeLabel: partition.Label,
+		})
+	}
+	return options
+}
+
+// stamp parses the timestamp and serial keys
+func (p *manifestPlan) stamp() BuildStamp {
+	stamp := BuildStamp{}
+	var err error
+	if p.m.Timestamp != "" {
+		stamp.Timestamp, err = ParseTimestamp(p.m.Timestamp)
+		if err != nil {
+			p.errorf("timestamp", "%v", err)
+		}
+	}
+	if p.m.Serial != "" {
+		stamp.VolumeSerial, err = ParseVolumeSerial(p.m.Serial)
+		if err != nil {
+			p.errorf("serial", "%v", err)
+		}
+	}
+	return stamp
+}
+
+// size parses a size value; "auto" selects auto
+func (p *manifestPlan) size(key, value string, auto int64) int64 {
+	switch value {
+	case "":
+		return 0
+	case "auto":
+		return auto
+	}
+	size, err := ParseSize(value)
+	if err != nil {
+		p.errorf(key, "%v", err)
+	}
+	return size
+}
+
+// loaders validates the boot loaders
+func (p *manifestPlan) loaders() []EFILoader {
+	loaders := []EFILoader{}
+	for i, loader := range p.m.Boot {
+		key := fmt.Sprintf("boot[%d]", i)
+		bootName, err := EFIBootName(loader.Arch)
+		if err != nil {
+			p.errorf(key+".arch", "%v", err)
+			continue
+		}
+		file := p.m.hostPath(loader.File)
+		if loader.File == "" {
+			p.errorf(key+".file", "missing loader file")
+			continue
+		}
+		err = validateEFILoaderFile(file, bootName)
+		if err != nil {
+			p.errorf(key+".file", "%v", err)
+			continue
+		}
+		loaders = append(loaders, EFILoader{Arch: strings.ToLower(loader.Arch), File: file})
+	}
+	return loaders
+}
+
+// files maps the image paths of file entries to their host paths
+func (p *manifestPlan) files(key string, files []ManifestFile) map[string]string {
+	mapped := make(map[string]string)
+	paths := make(map[string]bool)
+	for i, file := range files {
+		fileKey := key + "[" + strconv.Itoa(i) + "]"
+		if file.Src == "" {
+			p.errorf(fileKey+".src", "missing source path")
+			continue
+		}
+		src := p.m.hostPath(file.Src)
+		if _, err := os.Stat(src); err != nil {
+			p.errorf(fileKey+".src", "%v", err)
+			continue
+		}
+		dest := file.Dest
+		if dest == "" || strings.HasSuffix(dest, "/") {
+			dest = path.Join("/", dest, filepath.Base(src))
+		}
+		dest = cleanImagePath(dest)
+		if paths[strings.ToUpper(dest)] {
+			p.errorf(fileKey+".dest", "duplicate image path: %s", dest)
+			continue
+		}
+		paths[strings.ToUpper(dest)] = true
+		mapped[dest] = src
+	}
+	return mapped
+}
+
+// treeFiles expands directories in files to the regular files below them
+func (p *manifestPlan) treeFiles(key string, files map[string]string) map[string]string {
+	tree := newImageTree()
+	for _, name := range sortedKeys(files) {
+		err := tree.add(name, files[name])
+		if err != nil {
+			p.errorf(key, "%v", err)
+		}
+	}
+	return tree.files
+}
+
+func (p *manifestPlan) checkFile(key, filename string) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		p.errorf(key, "%v", err)
+	} else if stat.IsDir() {
+		p.errorf(key, "is a directory: %s", filename)
+	}
+}
+
+// hostPath resolves a manifest path relative to the manifest directory
+func (m *Manifest) hostPath(name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(m.filename), name)
+}
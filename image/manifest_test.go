@@ -0,0 +1,135 @@
+package image
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestFAT(t *testing.T) {
+	dir := t.TempDir()
+	mkTestPE(t, dir, "bootx64.efi", 0x8664, 4096)
+	mkTestFile(t, dir, "grub.cfg", "set timeout=5\n")
+	manifest := mkTestFile(t, dir, "efi.yaml", `type: fat
+output: efi.img
+size: auto
+label: BOOT
+boot:
+  - arch: x64
+    file: bootx64.efi
+files:
+  - src: grub.cfg
+    dest: /EFI/BOOT/
+`)
+	m, err := LoadManifest(manifest)
+	require.Nil(t, err)
+	err = m.Build(t.Context())
+	require.Nil(t, err)
+	output := filepath.Join(dir, "efi.img")
+	require.Equal(t, output, m.OutputPath())
+	require.Equal(t, "set timeout=5\n", readTestImageFile(t, output, "/EFI/BOOT/grub.cfg"))
+	require.Equal(t, 4096, len(readTestImageFile(t, output, "/EFI/BOOT/BOOTX64.EFI")))
+}
+
+func TestManifestISO(t *testing.T) {
+	dir := t.TempDir()
+	mkTestISO(t, dir)
+	mkTestFile(t, dir, "menu.ipxe", "#!ipxe\necho manifest\n")
+	manifest := mkTestFile(t, dir, "iso.toml", `type = "iso"
+output = "out.iso"
+source = "source.iso"
+delete = ["/docs/readme.txt"]
+
+[[files]]
+src = "menu.ipxe"
+dest = "/autoexec.ipxe"
+
+[[efi_files]]
+src = "menu.ipxe"
+dest = "/autoexec.ipxe"
+`)
+	m, err := LoadManifest(manifest)
+	require.Nil(t, err)
+	err = m.Build(t.Context())
+	require.Nil(t, err)
+	output := filepath.Join(dir, "out.iso")
+	require.Equal(t, "#!ipxe\necho manifest\n", readTestImageFile(t, output, "/autoexec.ipxe"))
+	files, err := ListImageFiles(output)
+	require.Nil(t, err)
+	require.NotContains(t, files, "/docs/readme.txt")
+}
+
+func TestManifestDisk(t *testing.T) {
+	dir := t.TempDir()
+	mkTestPE(t, dir, "bootx64.efi", 0x8664, 4096)
+	data := filepath.Join(dir, "data")
+	require.Nil(t, os.Mkdir(data, 0700))
+	mkTestFile(t, data, "readme.txt", "data\n")
+	manifest := mkTestFile(t, dir, "disk.yml", `type: disk
+output: disk.img
+table: mbr
+boot:
+  - {arch: x64, file: bootx64.efi}
+partitions:
+  - {source: data, label: STUFF}
+`)
+	m, err := LoadManifest(manifest)
+	require.Nil(t, err)
+	err = m.Build(t.Context())
+	require.Nil(t, err)
+	partitions, err := ReadPartitions(filepath.Join(dir, "disk.img"))
+	require.Nil(t, err)
+	require.Len(t, partitions, 2)
+}
+
+func TestManifestErrors(t *testing.T) {
+	dir := t.TempDir()
+	mkTestFile(t, dir, "grub.cfg", "set timeout=5\n")
+
+	m, err := LoadManifest(mkTestFile(t, dir, "bad.yaml", `type: fat
+output: efi.img
+size: 3Q
+files:
+  - src: grub.cfg
+  - src: missing.cfg
+hybrid: true
+timestamp: soon
+`))
+	require.Nil(t, err)
+	err = m.Validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "bad.yaml:3: size:")
+	require.Contains(t, err.Error(), "bad.yaml:6: files[1].src:")
+	require.Contains(t, err.Error(), "bad.yaml:7: hybrid: not used by fat manifests")
+	require.Contains(t, err.Error(), "bad.yaml:8: timestamp:")
+	require.NotContains(t, err.Error(), "files[0]")
+
+	m, err = LoadManifest(mkTestFile(t, dir, "bad.toml", `type = "disk"
+output = "disk.img"
+table = "apm"
+
+[[partitions]]
+label = "DATA"
+`))
+	require.Nil(t, err)
+	err = m.Validate()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "bad.toml:3: table:")
+	require.Contains(t, err.Error(), "bad.toml:5: partitions[0].source: missing source directory")
+
+	_, err = LoadManifest(mkTestFile(t, dir, "unknown.yaml", "type: fat\noutput: efi.img\nlabl: BOOT\n"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown.yaml:3: field labl not found")
+
+	_, err = LoadManifest(mkTestFile(t, dir, "unknown.toml", "type = \"fat\"\nlabl = \"BOOT\"\n"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown.toml:2: unknown key labl")
+
+	_, err = LoadManifest(mkTestFile(t, dir, "syntax.toml", "type = \"fat\"\noutput = \n"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "syntax.toml:2:")
+
+	_, err = LoadManifest(mkTestFile(t, dir, "manifest.json", "{}"))
+	require.NotNil(t, err)
+}
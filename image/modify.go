@@ -0,0 +1,251 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	diskfs "github.com/rstms/go-diskfs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrReadOnlyFormat is returned when asked to modify an image format that cannot be changed in place
+var ErrReadOnlyFormat = errors.New("read-only image format")
+
+// openWritableFAT opens the FAT filesystem chosen by selector for in-place changes
+func openWritableFAT(imageFilename string, selector PartitionSelector) (*fatFS, *volume, error) {
+	logger().Debug("opening image for writing", "image", imageFilename, "partition", selector.String())
+	disk, err := diskfs.Open(imageFilename)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := openFileVolume(disk.File, disk.Size, imageFilename, selector)
+	if err != nil {
+		disk.File.Close()
+		return nil, nil, err
+	}
+	fat, err := volumeFAT(v, imageFilename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fat, v, nil
+}
+
+// openFATPlan opens the FAT filesystem chosen by selector read-only, to plan changes to it
+func openFATPlan(imageFilename string, selector PartitionSelector) (*fatFS, *volume, error) {
+	v, err := openVolume(imageFilename, selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	fat, err := volumeFAT(v, imageFilename)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fat, v, nil
+}
+
+// volumeFAT returns the FAT filesystem of v, closing v and refusing other formats
+func volumeFAT(v *volume, imageFilename string) (*fatFS, error) {
+	fat, ok := v.fs.(*fatFS)
+	if !ok {
+		v.Close()
+		return nil, fmt.Errorf("cannot modify %s: %s is a %w", imageFilename, filesystemName(v.fs.Type()), ErrReadOnlyFormat)
+	}
+	return fat, nil
+}
+
+// AddImageFiles copies the host file or directory tree src into a FAT image at imagePath. If imagePath
+// ends with a slash or names an existing directory, src is copied into it under its base name. Parent
+// directories are created and existing files are replaced unless noClobber is set.
+func AddImageFiles(imageFilename string, selector PartitionSelector, src, imagePath string, noClobber bool) error {
+	logger().Info("adding files", "image", imageFilename, "partition", selector.String(), "source", src, "path", imagePath)
+	_, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	fat, v, err := openWritableFAT(imageFilename, selector)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	tree, err := addTree(fat, src, imagePath)
+	if err != nil {
+		return err
+	}
+	if noClobber {
+		for _, name := range existingFiles(fat, tree) {
+			logger().Debug("keeping existing file", "path", name)
+			delete(tree.files, name)
+		}
+	}
+	err = tree.copyTo(context.Background(), fat, nil)
+	if err != nil {
+		return err
+	}
+	return v.Sync()
+}
+
+// PlanAddImageFiles returns the image paths of the files AddImageFiles would write and of those among
+// them that already exist, both sorted by path
+func PlanAddImageFiles(imageFilename string, selector PartitionSelector, src, imagePath string) ([]string, []string, error) {
+	_, err := os.Stat(src)
+	if err != nil {
+		return []string{}, []string{}, err
+	}
+	fat, v, err := openFATPlan(imageFilename, selector)
+	if err != nil {
+		return []string{}, []string{}, err
+	}
+	defer v.Close()
+	tree, err := addTree(fat, src, imagePath)
+	if err != nil {
+		return []string{}, []string{}, err
+	}
+	return sortedKeys(tree.files), existingFiles(fat, tree), nil
+}
+
+// addTree returns the files and directories AddImageFiles copies from src to imagePath in fat
+func addTree(fat *fatFS, src, imagePath string) (*imageTree, error) {
+	dest := cleanImagePath(imagePath)
+	if strings.HasSuffix(imagePath, "/") || fatIsDir(fat, dest) {
+		dest = path.Join(dest, filepath.Base(src))
+	}
+	if dest == "/" {
+		return nil, fmt.Errorf("cannot replace root directory")
+	}
+	tree := newImageTree()
+	err := tree.add(dest, src)
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// existingFiles returns the sorted image paths of the files of tree already present in fat
+func existingFiles(fat *fatFS, tree *imageTree) []string {
+	existing := []string{}
+	for _, name := range sortedKeys(tree.files) {
+		_, entry, err := fat.lookup(name)
+		if err == nil && entry != nil {
+			existing = append(existing, name)
+		}
+	}
+	return existing
+}
+
+// RemoveImageFile deletes a file or empty directory from a FAT image; recursive also deletes
+// non-empty directories
+func RemoveImageFile(imageFilename string, selector PartitionSelector, imagePath string, recursive bool) error {
+	logger().Info("removing file", "image", imageFilename, "partition", selector.String(), "path", imagePath, "recursive", recursive)
+	fat, v, err := openWritableFAT(imageFilename, selector)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	paths, err := removePaths(fat, cleanImagePath(imagePath), recursive)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		logger().Debug("removing", "path", p)
+		err = fat.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+	return v.Sync()
+}
+
+// PlanRemoveImageFile returns the image paths RemoveImageFile would delete, each directory after its
+// contents
+func PlanRemoveImageFile(imageFilename string, selector PartitionSelector, imagePath string, recursive bool) ([]string, error) {
+	fat, v, err := openFATPlan(imageFilename, selector)
+	if err != nil {
+		return []string{}, err
+	}
+	defer v.Close()
+	return removePaths(fat, cleanImagePath(imagePath), recursive)
+}
+
+// removePaths returns p and, if recursive, everything below it, each directory after its contents
+func removePaths(fat *fatFS, p string, recursive bool) ([]string, error) {
+	if p == "/" {
+		return []string{}, fmt.Errorf("cannot remove root directory")
+	}
+	_, entry, err := fat.lookup(p)
+	if err != nil {
+		return []string{}, err
+	}
+	if !entry.isDir() {
+		return []string{p}, nil
+	}
+	entries, err := fat.ReadDir(p)
+	if err != nil {
+		return []string{}, err
+	}
+	if len(entries) > 0 && !recursive {
+		return []string{}, fmt.Errorf("directory not empty: %s", p)
+	}
+	paths := []string{}
+	for _, child := range entries {
+		childPaths, err := removePaths(fat, path.Join(p, child.Name()), true)
+		if err != nil {
+			return []string{}, err
+		}
+		paths = append(paths, childPaths...)
+	}
+	return append(paths, p), nil
+}
+
+// MakeImageDir creates a directory and any missing parents in a FAT image
+func MakeImageDir(imageFilename string, selector PartitionSelector, imagePath string) error {
+	logger().Info("making directory", "image", imageFilename, "partition", selector.String(), "path", imagePath)
+	fat, v, err := openWritableFAT(imageFilename, selector)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+	err = fat.Mkdir(cleanImagePath(imagePath))
+	if err != nil {
+		return err
+	}
+	return v.Sync()
+}
+
+// PlanMakeImageDir returns the image paths of the directories MakeImageDir would create, parents first
+func PlanMakeImageDir(imageFilename string, selector PartitionSelector, imagePath string) ([]string, error) {
+	fat, v, err := openFATPlan(imageFilename, selector)
+	if err != nil {
+		return []string{}, err
+	}
+	defer v.Close()
+	dirs := []string{}
+	current := "/"
+	for _, part := range splitImagePath(cleanImagePath(imagePath)) {
+		current = path.Join(current, part)
+		if len(dirs) > 0 {
+			dirs = append(dirs, current)
+			continue
+		}
+		_, entry, err := fat.lookup(current)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			dirs = append(dirs, current)
+		case err != nil:
+			return []string{}, err
+		case !entry.isDir():
+			return []string{}, fmt.Errorf("not a directory: %s", current)
+		}
+	}
+	return dirs, nil
+}
+
+// fatIsDir returns true if p is an existing directory
+func fatIsDir(fat *fatFS, p string) bool {
+	_, entry, err := fat.lookup(p)
+	return err == nil && (entry == nil || entry.isDir())
+}
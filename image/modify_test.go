@@ -0,0 +1,100 @@
+package image
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModifyImage(t *testing.T) {
+	dir := t.TempDir()
+	imageFile := filepath.Join(dir, "esp.img")
+	require.Nil(t, BuildEFIImage(t.Context(), imageFile, EFIImageOptions{}))
+	whole := PartitionSelector{}
+
+	// replacing a file with shorter content leaves no stale data
+	long := mkTestFile(t, dir, "long.cfg", "a much longer grub configuration\n")
+	short := mkTestFile(t, dir, "short.cfg", "short\n")
+	require.Nil(t, AddImageFiles(imageFile, whole, long, "/EFI/BOOT/grub.cfg", false))
+	require.Equal(t, "a much longer grub configuration\n", readTestImageFile(t, imageFile, "/EFI/BOOT/grub.cfg"))
+	require.Nil(t, AddImageFiles(imageFile, whole, short, "/EFI/BOOT/grub.cfg", false))
+	require.Equal(t, "short\n", readTestImageFile(t, imageFile, "/EFI/BOOT/grub.cfg"))
+
+	// an existing directory or trailing slash receives the base name
+	require.Nil(t, AddImageFiles(imageFile, whole, short, "/EFI/BOOT", false))
+	require.Nil(t, AddImageFiles(imageFile, whole, long, "/new/", false))
+
+	tree := filepath.Join(dir, "tree")
+	require.Nil(t, os.MkdirAll(filepath.Join(tree, "sub", "empty"), 0700))
+	mkTestFile(t, filepath.Join(tree, "sub"), "leaf.txt", "leaf\n")
+	require.Nil(t, AddImageFiles(imageFile, whole, tree, "/", false))
+	require.Nil(t, MakeImageDir(imageFile, whole, "/a/b/c"))
+
+	files, err := ListImageFiles(imageFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"/EFI/",
+		"/EFI/BOOT/",
+		"/EFI/BOOT/grub.cfg",
+		"/EFI/BOOT/short.cfg",
+		"/new/",
+		"/new/long.cfg",
+		"/tree/",
+		"/tree/sub/",
+		"/tree/sub/empty/",
+		"/tree/sub/leaf.txt",
+		"/a/",
+		"/a/b/",
+		"/a/b/c/",
+	}, files)
+	require.Equal(t, "leaf\n", readTestImageFile(t, imageFile, "/tree/sub/leaf.txt"))
+
+	// plans report the changes without making them, and noClobber keeps existing files
+	added, existing, err := PlanAddImageFiles(imageFile, whole, long, "/EFI/BOOT/")
+	require.Nil(t, err)
+	require.Equal(t, []string{"/EFI/BOOT/long.cfg"}, added)
+	require.Equal(t, []string{}, existing)
+	added, existing, err = PlanAddImageFiles(imageFile, whole, tree, "/")
+	require.Nil(t, err)
+	require.Equal(t, []string{"/tree/sub/leaf.txt"}, added)
+	require.Equal(t, added, existing)
+	require.Nil(t, AddImageFiles(imageFile, whole, long, "/EFI/BOOT/grub.cfg", true))
+	require.Equal(t, "short\n", readTestImageFile(t, imageFile, "/EFI/BOOT/grub.cfg"))
+	dirs, err := PlanMakeImageDir(imageFile, whole, "/a/b/x/y")
+	require.Nil(t, err)
+	require.Equal(t, []string{"/a/b/x", "/a/b/x/y"}, dirs)
+	_, err = PlanMakeImageDir(imageFile, whole, "/EFI/BOOT/grub.cfg/x")
+	require.ErrorContains(t, err, "not a directory")
+	removed, err := PlanRemoveImageFile(imageFile, whole, "/tree", true)
+	require.Nil(t, err)
+	require.Equal(t, []string{"/tree/sub/empty", "/tree/sub/leaf.txt", "/tree/sub", "/tree"}, removed)
+
+	require.Nil(t, RemoveImageFile(imageFile, whole, "/EFI/BOOT/short.cfg", false))
+	err = RemoveImageFile(imageFile, whole, "/tree", false)
+	require.ErrorContains(t, err, "not empty")
+	require.Nil(t, RemoveImageFile(imageFile, whole, "/tree", true))
+	err = RemoveImageFile(imageFile, whole, "/", true)
+	require.ErrorContains(t, err, "root directory")
+	err = RemoveImageFile(imageFile, whole, "/missing", false)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	files, err = ListImageFiles(imageFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{"/EFI/", "/EFI/BOOT/", "/EFI/BOOT/grub.cfg", "/new/", "/new/long.cfg", "/a/", "/a/b/", "/a/b/c/"}, files)
+
+	// ISO9660 images are refused
+	isoImage := mkTestISO(t, t.TempDir())
+	err = AddImageFiles(isoImage, whole, short, "/short.cfg", false)
+	require.ErrorIs(t, err, ErrReadOnlyFormat)
+	require.ErrorContains(t, err, "ISO9660")
+	require.ErrorIs(t, MakeImageDir(isoImage, whole, "/x"), ErrReadOnlyFormat)
+	require.ErrorIs(t, RemoveImageFile(isoImage, whole, "/autoexec.ipxe", false), ErrReadOnlyFormat)
+
+	// partitions are selected like the read commands
+	diskImage := mkPartitionedImage(t, dir)
+	require.Nil(t, AddImageFiles(diskImage, PartitionSelector{Label: "STUFF"}, short, "/short.cfg", false))
+	var buf bytes.Buffer
+	require.Nil(t, ExtractPartitionFile(diskImage, PartitionSelector{Index: 2}, "/short.cfg", &buf))
+	require.Equal(t, "short\n", buf.String())
+}
@@ -0,0 +1,151 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+)
+
+// BACKUP_SUFFIX is appended to the name of an output file kept by OutputOptions.Backup
+const BACKUP_SUFFIX = ".bak"
+
+// OutputOptions selects how a build replaces an existing output file
+type OutputOptions struct {
+	// Overwrite replaces an existing output file; without it the build fails if the output exists
+	Overwrite bool
+	// Backup keeps the replaced output file under its name with BACKUP_SUFFIX appended
+	Backup bool
+}
+
+// OutputFile is an image written to a temporary file in the directory of its destination. Commit
+// renames it over the destination, so a failed or cancelled build never leaves a partial image there.
+type OutputFile struct {
+	*os.File
+	name      string
+	options   OutputOptions
+	committed bool
+}
+
+// CreateOutputFile creates the temporary file of an image written to filename. It fails if filename
+// exists unless options.Overwrite is set.
+func CreateOutputFile(filename string, options OutputOptions) (*OutputFile, error) {
+	if !options.Overwrite {
+		_, err := os.Lstat(filename)
+		if err == nil {
+			return nil, &os.PathError{Op: "create", Path: filename, Err: os.ErrExist}
+		}
+	}
+	dir, base := filepath.Split(filename)
+	for {
+		// created like the output itself, so the image gets the usual umask permissions
+		tmpName := filepath.Join(dir, fmt.Sprintf(".%s.%08x.tmp", base, rand.Uint32()))
+		fp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &OutputFile{File: fp, name: filename, options: options}, nil
+	}
+}
+
+// Commit syncs the image to disk and renames it to the destination, keeping the replaced file as a
+// backup if requested
+func (o *OutputFile) Commit() error {
+	err := o.Sync()
+	if err != nil {
+		return err
+	}
+	err = o.File.Close()
+	if err != nil {
+		return err
+	}
+	tmpName := o.File.Name()
+	stat, err := os.Stat(o.name)
+	switch {
+	case err == nil:
+		if !o.options.Overwrite {
+			return &os.PathError{Op: "create", Path: o.name, Err: os.ErrExist}
+		}
+		// the replacement keeps the permissions of the replaced file
+		err = os.Chmod(tmpName, stat.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if o.options.Backup {
+			err = backupFile(o.name)
+			if err != nil {
+				return err
+			}
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	if o.options.Overwrite {
+		err = os.Rename(tmpName, o.name)
+	} else {
+		err = commitNew(tmpName, o.name)
+	}
+	if err != nil {
+		return err
+	}
+	o.committed = true
+	syncDir(filepath.Dir(o.name))
+	logger().Info("wrote image", "image", o.name)
+	return nil
+}
+
+// Abort closes and removes the temporary file of an output that was not committed
+func (o *OutputFile) Abort() {
+	if o.committed {
+		return
+	}
+	o.File.Close()
+	os.Remove(o.File.Name())
+}
+
+// commitNew moves tmpName to filename, failing if filename was created during the build. A hard link
+// refuses an existing name atomically; filesystems without hard links fall back to a rename.
+func commitNew(tmpName, filename string) error {
+	err := os.Link(tmpName, filename)
+	if err == nil {
+		return os.Remove(tmpName)
+	}
+	if errors.Is(err, os.ErrExist) {
+		return err
+	}
+	_, statErr := os.Lstat(filename)
+	if statErr == nil {
+		return &os.PathError{Op: "create", Path: filename, Err: os.ErrExist}
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// backupFile links filename to its backup name, replacing an older backup. Filesystems without hard
+// links fall back to renaming it.
+func backupFile(filename string) error {
+	backup := filename + BACKUP_SUFFIX
+	err := os.Remove(backup)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	logger().Info("keeping backup", "image", filename, "backup", backup)
+	err = os.Link(filename, backup)
+	if err != nil {
+		return os.Rename(filename, backup)
+	}
+	return nil
+}
+
+// syncDir flushes a directory so a rename in it survives a crash; not every platform supports it
+func syncDir(dir string) {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	fp.Sync()
+}
@@ -0,0 +1,97 @@
+package image
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// requireNoTempFiles checks that dir holds only the named files
+func requireNoTempFiles(t *testing.T, dir string, names ...string) {
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	found := []string{}
+	for _, entry := range entries {
+		found = append(found, entry.Name())
+	}
+	require.ElementsMatch(t, names, found)
+}
+
+func TestOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "out.img")
+
+	out, err := CreateOutputFile(target, OutputOptions{})
+	require.Nil(t, err)
+	_, err = out.WriteString("first")
+	require.Nil(t, err)
+	// a file appearing at the destination during the build is not replaced
+	require.Nil(t, os.WriteFile(target, []byte("racing"), 0600))
+	require.ErrorIs(t, out.Commit(), os.ErrExist)
+	out.Abort()
+	requireNoTempFiles(t, dir, "out.img")
+
+	_, err = CreateOutputFile(target, OutputOptions{})
+	require.ErrorIs(t, err, os.ErrExist)
+
+	out, err = CreateOutputFile(target, OutputOptions{Overwrite: true, Backup: true})
+	require.Nil(t, err)
+	_, err = out.WriteString("second")
+	require.Nil(t, err)
+	require.Nil(t, out.Commit())
+	out.Abort()
+	data, err := os.ReadFile(target)
+	require.Nil(t, err)
+	require.Equal(t, "second", string(data))
+	data, err = os.ReadFile(target + BACKUP_SUFFIX)
+	require.Nil(t, err)
+	require.Equal(t, "racing", string(data))
+	stat, err := os.Stat(target)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	requireNoTempFiles(t, dir, "out.img", "out.img.bak")
+}
+
+func TestOutputReplace(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+	outDir := t.TempDir()
+	target := filepath.Join(outDir, "output.iso")
+	require.Nil(t, os.WriteFile(target, []byte("previous"), 0644))
+
+	err := BuildISOImage(t.Context(), target, isoImage, ISOBuildOptions{})
+	require.ErrorIs(t, err, os.ErrExist)
+
+	// a failed or cancelled build leaves the existing output untouched
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	err = BuildISOImage(ctx, target, isoImage, ISOBuildOptions{Output: OutputOptions{Overwrite: true}})
+	require.ErrorIs(t, err, context.Canceled)
+	err = BuildISOImage(t.Context(), target, isoImage, ISOBuildOptions{
+		Output: OutputOptions{Overwrite: true},
+		Delete: []string{"/missing"},
+	})
+	require.NotNil(t, err)
+	data, err := os.ReadFile(target)
+	require.Nil(t, err)
+	require.Equal(t, "previous", string(data))
+	requireNoTempFiles(t, outDir, "output.iso")
+
+	err = BuildISOImage(t.Context(), target, isoImage, ISOBuildOptions{Output: OutputOptions{Overwrite: true, Backup: true}})
+	require.Nil(t, err)
+	require.Equal(t, "#!ipxe\necho source\n", readTestImageFile(t, target, "/autoexec.ipxe"))
+	data, err = os.ReadFile(target + BACKUP_SUFFIX)
+	require.Nil(t, err)
+	require.Equal(t, "previous", string(data))
+
+	options := EFIImageOptions{
+		BootFile: mkTestPE(t, dir, "bootx64.efi", 0x8664, 4096),
+		BootName: "BOOTX64.EFI",
+		Output:   OutputOptions{Overwrite: true},
+	}
+	require.Nil(t, BuildEFIImage(t.Context(), target, options))
+	require.Equal(t, 4096, len(readTestImageFile(t, target, "/EFI/BOOT/BOOTX64.EFI")))
+	requireNoTempFiles(t, outDir, "output.iso", "output.iso.bak")
+}
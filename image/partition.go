@@ -0,0 +1,349 @@
+package image
+
+import (
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem"
+	"github.com/rstms/go-diskfs/filesystem/fat32"
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
+	"github.com/rstms/go-diskfs/filesystem/squashfs"
+	"github.com/rstms/go-diskfs/partition/gpt"
+	"github.com/rstms/go-diskfs/partition/mbr"
+	"github.com/rstms/go-diskfs/util"
+	"io"
+	"os"
+	"strings"
+)
+
+const PARTITION_SECTOR_SIZE = 512
+
+// Partition is an entry in an MBR or GPT partition table
+type Partition struct {
+	// Index is the 1-based position of the entry in its table
+	Index int `json:"index"`
+	// Table is "mbr" or "gpt"
+	Table string `json:"table"`
+	// Type is the MBR type byte in hex or the GPT type GUID
+	Type string `json:"type"`
+	// TypeName describes well known partition types
+	TypeName string `json:"type_name,omitempty"`
+	// Name is the GPT partition name
+	Name string `json:"name,omitempty"`
+	// Start is the byte offset of the partition
+	Start int64 `json:"start"`
+	// Size is the partition size in bytes
+	Size     int64 `json:"size"`
+	Bootable bool  `json:"bootable,omitempty"`
+}
+
+var mbrTypeNames = map[mbr.Type]string{
+	mbr.Fat12:         "FAT12",
+	mbr.Fat16:         "FAT16",
+	mbr.Fat16b:        "FAT16",
+	mbr.Fat16bLBA:     "FAT16 LBA",
+	mbr.Fat32CHS:      "FAT32",
+	mbr.Fat32LBA:      "FAT32 LBA",
+	mbr.NTFS:          "NTFS/exFAT",
+	mbr.Linux:         "Linux",
+	mbr.Iso9660:       "ISO9660",
+	mbr.GPTProtective: "GPT protective",
+	mbr.EFISystem:     "EFI System",
+}
+
+var gptTypeNames = map[gpt.Type]string{
+	gpt.EFISystemPartition: "EFI System",
+	gpt.BiosBoot:           "BIOS boot",
+	gpt.MicrosoftBasicData: "Basic data",
+	gpt.LinuxFilesystem:    "Linux filesystem",
+	gpt.LinuxSwap:          "Linux swap",
+	gpt.LinuxLVM:           "Linux LVM",
+}
+
+// readMBRPartitions returns the non-empty entries of an MBR partition table, or nil if there is none
+func readMBRPartitions(f util.File) ([]*Partition, error) {
+	sector := make([]byte, PARTITION_SECTOR_SIZE)
+	_, err := f.ReadAt(sector, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading sector 0: %v", err)
+	}
+	// a FAT superfloppy boot sector carries the same signature as an MBR
+	if _, err := parseFATBootSector(sector); err == nil {
+		return nil, nil
+	}
+	table, err := mbr.Read(f, PARTITION_SECTOR_SIZE, PARTITION_SECTOR_SIZE)
+	if err != nil {
+		return nil, nil
+	}
+	partitions := []*Partition{}
+	for i, p := range table.Partitions {
+		if p.Type == mbr.Empty && p.Size == 0 {
+			continue
+		}
+		partitions = append(partitions, &Partition{
+			Index:    i + 1,
+			Table:    "mbr",
+			Type:     fmt.Sprintf("0x%02x", uint8(p.Type)),
+			TypeName: mbrTypeNames[p.Type],
+			Start:    int64(p.Start) * PARTITION_SECTOR_SIZE,
+			Size:     int64(p.Size) * PARTITION_SECTOR_SIZE,
+			Bootable: p.Bootable,
+		})
+	}
+	if len(partitions) == 0 {
+		return nil, nil
+	}
+	return partitions, nil
+}
+
+// readGPTPartitions returns the used entries of a GPT partition table, or nil if there is none
+func readGPTPartitions(f util.File) ([]*Partition, error) {
+	table, err := gpt.Read(f, PARTITION_SECTOR_SIZE, PARTITION_SECTOR_SIZE)
+	if err != nil {
+		return nil, nil
+	}
+	partitions := []*Partition{}
+	for i, p := range table.Partitions {
+		if p.Type == gpt.Unused {
+			continue
+		}
+		partitions = append(partitions, &Partition{
+			Index:    i + 1,
+			Table:    "gpt",
+			Type:     strings.ToUpper(string(p.Type)),
+			TypeName: gptTypeNames[p.Type],
+			Name:     p.Name,
+			Start:    int64(p.Start) * PARTITION_SECTOR_SIZE,
+			Size:     int64(p.End-p.Start+1) * PARTITION_SECTOR_SIZE,
+		})
+	}
+	return partitions, nil
+}
+
+// PartitionSelector chooses the filesystem to open in a disk image. The zero value selects the
+// filesystem at the start of the image.
+type PartitionSelector struct {
+	// Index is the 1-based partition number
+	Index int
+	// Label matches the GPT partition name or the filesystem label; "ESP" also matches the
+	// EFI System partition type
+	Label string
+}
+
+// IsZero returns true if the selector selects the whole image
+func (s PartitionSelector) IsZero() bool {
+	return s.Index == 0 && s.Label == ""
+}
+
+func (s PartitionSelector) String() string {
+	switch {
+	case s.IsZero():
+		return "whole image"
+	case s.Label != "":
+		return fmt.Sprintf("partition labeled %q", s.Label)
+	default:
+		return fmt.Sprintf("partition %d", s.Index)
+	}
+}
+
+// ReadPartitions returns the GPT partitions of an image, or its MBR partitions if it has no GPT.
+// The result is empty if the image has no partition table.
+func ReadPartitions(imageFilename string) ([]*Partition, error) {
+	fp, err := os.Open(imageFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	partitions, err := readPartitions(fp)
+	if err != nil {
+		return nil, err
+	}
+	if partitions == nil {
+		return []*Partition{}, nil
+	}
+	return partitions, nil
+}
+
+func readPartitions(f util.File) ([]*Partition, error) {
+	partitions, err := readGPTPartitions(f)
+	if err != nil || partitions != nil {
+		return partitions, err
+	}
+	return readMBRPartitions(f)
+}
+
+// OpenPartition returns the filesystem of the image partition chosen by selector and the closer of the
+// image file, which the caller closes when done with the filesystem
+func OpenPartition(imageFilename string, selector PartitionSelector) (filesystem.FileSystem, io.Closer, error) {
+	v, err := openVolume(imageFilename, selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v.fs, v, nil
+}
+
+// volume is an image filesystem and the byte range it occupies in the image file
+type volume struct {
+	fs    filesystem.FileSystem
+	file  util.File
+	start int64
+	size  int64
+}
+
+// openVolume opens the filesystem chosen by selector read-only
+func openVolume(imageFilename string, selector PartitionSelector) (*volume, error) {
+	logger().Debug("opening image", "image", imageFilename, "partition", selector.String())
+	fp, err := os.Open(imageFilename)
+	if err != nil {
+		return nil, err
+	}
+	// seeking to the end also sizes block devices, which stat reports as empty
+	size, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	v, err := openFileVolume(fp, size, imageFilename, selector)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// openFileVolume opens the filesystem chosen by selector in the image of size bytes in f
+func openFileVolume(f util.File, size int64, imageFilename string, selector PartitionSelector) (*volume, error) {
+	if selector.Index != 0 && selector.Label != "" {
+		return nil, fmt.Errorf("select a partition by number or by label, not both")
+	}
+	if selector.IsZero() {
+		v := volume{file: f, start: 0, size: size}
+		fat, err := readFAT(f, 0, size)
+		if err == nil {
+			logger().Debug("opened filesystem", "image", imageFilename, "type", fat.FATType())
+			v.fs = fat
+			return &v, nil
+		}
+		v.fs, err = readImageFS(f, size)
+		if err != nil {
+			partitions, _ := readPartitions(f)
+			if len(partitions) > 0 {
+				return nil, fmt.Errorf("%s has a %s partition table; select a partition: %v", imageFilename, partitions[0].Table, err)
+			}
+			return nil, err
+		}
+		logger().Debug("opened filesystem", "image", imageFilename, "type", filesystemName(v.fs.Type()))
+		return &v, nil
+	}
+
+	partitions, err := readPartitions(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(partitions) == 0 {
+		return nil, fmt.Errorf("%s has no partition table", imageFilename)
+	}
+	for _, p := range partitions {
+		switch {
+		case selector.Index != 0:
+			if p.Index != selector.Index {
+				continue
+			}
+		case strings.EqualFold(p.Name, selector.Label):
+		case strings.EqualFold(selector.Label, "ESP") && p.TypeName == "EFI System":
+		default:
+			// fall back to the filesystem label
+			fs, err := readVolumeFS(f, p.Start, p.Size)
+			if err != nil || !strings.EqualFold(volumeLabel(fs), selector.Label) {
+				continue
+			}
+		}
+		fs, err := readVolumeFS(f, p.Start, p.Size)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", imageFilename, selector, err)
+		}
+		logger().Debug("opened partition", "image", imageFilename, "index", p.Index, "start", p.Start)
+		return &volume{fs: fs, file: f, start: p.Start, size: p.Size}, nil
+	}
+	return nil, fmt.Errorf("%s not found in %s", selector, imageFilename)
+}
+
+// readVolumeFS reads the FAT or ISO9660 filesystem in a partition
+func readVolumeFS(f util.File, start, size int64) (filesystem.FileSystem, error) {
+	fat, err := readFAT(f, start, size)
+	if err == nil {
+		return fat, nil
+	}
+	iso, isoErr := iso9660.Read(f, size, start, 0)
+	if isoErr == nil {
+		return iso, nil
+	}
+	return nil, fmt.Errorf("no FAT or ISO9660 filesystem: %v", err)
+}
+
+// readImageFS reads the filesystem occupying a whole unpartitioned image, trying the types go-diskfs
+// supports in the order it does
+func readImageFS(f util.File, size int64) (filesystem.FileSystem, error) {
+	fat, err := fat32.Read(f, size, 0, PARTITION_SECTOR_SIZE)
+	if err == nil {
+		return fat, nil
+	}
+	iso, err := iso9660.Read(f, size, 0, 0)
+	if err == nil {
+		return iso, nil
+	}
+	squash, err := squashfs.Read(f, size, 0, PARTITION_SECTOR_SIZE)
+	if err == nil {
+		return squash, nil
+	}
+	return nil, fmt.Errorf("Unknown filesystem on partition 0")
+}
+
+// volumeLabel returns the filesystem label without padding
+func volumeLabel(fs filesystem.FileSystem) string {
+	return strings.TrimSpace(strings.Trim(fs.Label(), "\x00"))
+}
+
+// isoEntries maps image paths to their directory records, or returns an empty map if the volume
+// is not ISO9660
+func (v *volume) isoEntries() (map[string]*isoEntry, error) {
+	isoEntries := make(map[string]*isoEntry)
+	if v.fs.Type() != filesystem.TypeISO9660 {
+		return isoEntries, nil
+	}
+	entries, err := readISOEntries(io.NewSectionReader(v.file, v.start, v.size))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		isoEntries[entry.path] = entry
+	}
+	return isoEntries, nil
+}
+
+// Sync flushes changes to the image file
+func (v *volume) Sync() error {
+	if fp, ok := v.file.(*os.File); ok {
+		return fp.Sync()
+	}
+	return nil
+}
+
+// Close closes the image file
+func (v *volume) Close() error {
+	if c, ok := v.file.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// filesystemName returns a display name for a filesystem type
+func filesystemName(t filesystem.Type) string {
+	switch t {
+	case filesystem.TypeFat32:
+		return "FAT"
+	case filesystem.TypeISO9660:
+		return "ISO9660"
+	case filesystem.TypeSquashfs:
+		return "SquashFS"
+	}
+	return "unknown"
+}
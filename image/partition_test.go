@@ -0,0 +1,118 @@
+package image
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"github.com/rstms/go-diskfs/partition/gpt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mkPartitionedImage writes a GPT disk with a FAT ESP and a FAT data partition labeled STUFF
+func mkPartitionedImage(t *testing.T, dir string) string {
+	imageFile := filepath.Join(dir, "disk.img")
+	fp, err := os.Create(imageFile)
+	require.Nil(t, err)
+	defer fp.Close()
+	size := int64(4 * 1024 * 1024)
+	require.Nil(t, fp.Truncate(size))
+	table := gpt.Table{
+		LogicalSectorSize:  PARTITION_SECTOR_SIZE,
+		PhysicalSectorSize: PARTITION_SECTOR_SIZE,
+		ProtectiveMBR:      true,
+		Partitions: []*gpt.Partition{
+			{Start: 2048, End: 4095, Type: gpt.EFISystemPartition, Name: "EFI System", GUID: uuid.NewString()},
+			{Start: 4096, End: 6143, Type: gpt.LinuxFilesystem, Name: "data", GUID: uuid.NewString()},
+		},
+	}
+	require.Nil(t, table.Write(fp, size))
+	files := map[int64]string{2048: "/bootx64.efi", 4096: "/readme.txt"}
+	for _, start := range []int64{2048, 4096} {
+		label := "EFI"
+		if start == 4096 {
+			label = "STUFF"
+		}
+		fs, err := formatFAT(fp, start*PARTITION_SECTOR_SIZE, 2048*PARTITION_SECTOR_SIZE, FAT12, label, BuildStamp{})
+		require.Nil(t, err)
+		ofp, err := fs.OpenFile(files[start], os.O_CREATE|os.O_RDWR)
+		require.Nil(t, err)
+		_, err = ofp.Write([]byte(label + "\n"))
+		require.Nil(t, err)
+		require.Nil(t, ofp.Close())
+	}
+	return imageFile
+}
+
+func TestPartitions(t *testing.T) {
+	imageFile := mkPartitionedImage(t, t.TempDir())
+
+	partitions, err := ReadPartitions(imageFile)
+	require.Nil(t, err)
+	require.Len(t, partitions, 2)
+	require.Equal(t, "gpt", partitions[0].Table)
+	require.Equal(t, "EFI System", partitions[0].TypeName)
+	require.Equal(t, int64(2048*PARTITION_SECTOR_SIZE), partitions[0].Start)
+	require.Equal(t, "data", partitions[1].Name)
+
+	_, err = ListImageFiles(imageFile)
+	require.ErrorContains(t, err, "select a partition")
+
+	files, err := ListPartitionFiles(imageFile, PartitionSelector{Label: "esp"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"/bootx64.efi"}, files)
+	files, err = ListPartitionFiles(imageFile, PartitionSelector{Index: 2})
+	require.Nil(t, err)
+	require.Equal(t, []string{"/readme.txt"}, files)
+
+	// GPT name and filesystem label
+	for _, label := range []string{"DATA", "stuff"} {
+		fs, closer, err := OpenPartition(imageFile, PartitionSelector{Label: label})
+		require.Nil(t, err)
+		require.Equal(t, "STUFF", fs.Label())
+		require.Nil(t, closer.Close())
+	}
+
+	var buf bytes.Buffer
+	err = ExtractPartitionFile(imageFile, PartitionSelector{Index: 1}, "/bootx64.efi", &buf)
+	require.Nil(t, err)
+	require.Equal(t, "EFI\n", buf.String())
+
+	entries, err := ListPartitionEntries(imageFile, PartitionSelector{Label: "ESP"})
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+
+	destDir := t.TempDir()
+	err = ExtractImage(t.Context(), imageFile, destDir, ExtractOptions{Partition: PartitionSelector{Index: 2}})
+	require.Nil(t, err)
+	require.FileExists(t, filepath.Join(destDir, "readme.txt"))
+
+	_, _, err = OpenPartition(imageFile, PartitionSelector{Index: 3})
+	require.ErrorContains(t, err, "partition 3 not found")
+	_, _, err = OpenPartition(imageFile, PartitionSelector{Label: "missing"})
+	require.ErrorContains(t, err, "not found")
+	_, _, err = OpenPartition(imageFile, PartitionSelector{Index: 1, Label: "ESP"})
+	require.NotNil(t, err)
+
+	// an unpartitioned image has no partitions to select
+	fatImage := filepath.Join(filepath.Dir(imageFile), "esp.img")
+	require.Nil(t, BuildEFIImage(t.Context(), fatImage, EFIImageOptions{}))
+	partitions, err = ReadPartitions(fatImage)
+	require.Nil(t, err)
+	require.Empty(t, partitions)
+	_, _, err = OpenPartition(fatImage, PartitionSelector{Index: 1})
+	require.ErrorContains(t, err, "no partition table")
+
+	// read access opens the image read-only, in-place changes open it for writing
+	v, err := openVolume(imageFile, PartitionSelector{Index: 2})
+	require.Nil(t, err)
+	_, err = v.file.WriteAt([]byte{0}, v.start)
+	require.NotNil(t, err)
+	require.Nil(t, v.Close())
+	_, v, err = openWritableFAT(imageFile, PartitionSelector{Index: 2})
+	require.Nil(t, err)
+	_, err = v.file.WriteAt([]byte{0xeb}, v.start)
+	require.Nil(t, err)
+	require.Nil(t, v.Close())
+}
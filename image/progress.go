@@ -0,0 +1,76 @@
+package image
+
+import (
+	"io"
+)
+
+// Progress reports how much of a build or extraction is done. Totals are computed before the first
+// file is copied.
+type Progress struct {
+	// Path is the image path of the file being copied
+	Path       string `json:"path"`
+	Files      int    `json:"files"`
+	TotalFiles int    `json:"total_files"`
+	Bytes      int64  `json:"bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+}
+
+// ProgressFunc receives progress as file data is copied and as each file completes
+type ProgressFunc func(Progress)
+
+// progress accumulates the files and bytes an operation has copied; a nil progress reports nothing
+type progress struct {
+	fn    ProgressFunc
+	state Progress
+}
+
+// newProgress returns a progress reporting to fn, or nil if fn is nil
+func newProgress(fn ProgressFunc) *progress {
+	if fn == nil {
+		return nil
+	}
+	return &progress{fn: fn}
+}
+
+// add counts the files sized by contents into the totals
+func (p *progress) add(contents map[string]int64) {
+	if p == nil {
+		return
+	}
+	for _, size := range contents {
+		p.state.TotalFiles++
+		p.state.TotalBytes += size
+	}
+}
+
+// reader returns r, counting the bytes read from it as copied data of the file at imagePath
+func (p *progress) reader(imagePath string, r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	p.state.Path = imagePath
+	return &progressReader{r: r, p: p}
+}
+
+// fileDone counts a completed file
+func (p *progress) fileDone() {
+	if p == nil {
+		return
+	}
+	p.state.Files++
+	p.fn(p.state)
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.p.state.Bytes += int64(n)
+		r.p.fn(r.p.state)
+	}
+	return n, err
+}
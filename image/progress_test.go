@@ -0,0 +1,66 @@
+package image
+
+import (
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordProgress returns a ProgressFunc appending each report to reports
+func recordProgress(reports *[]Progress) ProgressFunc {
+	return func(p Progress) {
+		*reports = append(*reports, p)
+	}
+}
+
+// requireProgress checks that reports count up to totalFiles and totalBytes
+func requireProgress(t *testing.T, reports []Progress, totalFiles int, totalBytes int64) {
+	require.NotEmpty(t, reports)
+	for i, p := range reports {
+		require.Equal(t, totalFiles, p.TotalFiles)
+		require.Equal(t, totalBytes, p.TotalBytes)
+		if i > 0 {
+			require.GreaterOrEqual(t, p.Files, reports[i-1].Files)
+			require.GreaterOrEqual(t, p.Bytes, reports[i-1].Bytes)
+		}
+	}
+	last := reports[len(reports)-1]
+	require.Equal(t, totalFiles, last.Files)
+	require.Equal(t, totalBytes, last.Bytes)
+}
+
+func TestProgress(t *testing.T) {
+	dir := t.TempDir()
+	var reports []Progress
+	options := EFIImageOptions{
+		BootFile:   mkTestPE(t, dir, "bootx64.efi", 0x8664, 100000),
+		BootName:   "BOOTX64.EFI",
+		ExtraFiles: []string{mkTestFile(t, dir, "autoexec.ipxe", "#!ipxe\n")},
+		Progress:   recordProgress(&reports),
+	}
+	require.Nil(t, BuildEFIImage(t.Context(), filepath.Join(dir, "efi.img"), options))
+	requireProgress(t, reports, 2, 100000+7)
+	require.Equal(t, "/autoexec.ipxe", reports[len(reports)-1].Path)
+
+	// the output holds the replaced readme, the EFI and BIOS boot images and the autoexec
+	isoImage := mkTestISO(t, dir)
+	reports = nil
+	isoOptions := ISOBuildOptions{
+		Files:    map[string]string{"/docs/readme.txt": mkTestFile(t, dir, "readme.txt", "replaced\n")},
+		Progress: recordProgress(&reports),
+	}
+	require.Nil(t, BuildISOImage(t.Context(), filepath.Join(dir, "output.iso"), isoImage, isoOptions))
+	requireProgress(t, reports, 4, int64(len("#!ipxe\necho source\n")+len("replaced\n")+4096)+hostFileSize(filepath.Join(dir, "esp.img")))
+
+	reports = nil
+	extractOptions := ExtractOptions{
+		Include:  []string{"*.txt", "*.ipxe"},
+		Progress: recordProgress(&reports),
+	}
+	require.Nil(t, ExtractImage(t.Context(), isoImage, t.TempDir(), extractOptions))
+	requireProgress(t, reports, 2, int64(len("#!ipxe\necho source\n")+len("netboot test image\n")))
+	for _, p := range reports {
+		require.False(t, strings.HasSuffix(p.Path, ".img"))
+	}
+}
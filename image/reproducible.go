@@ -0,0 +1,301 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rstms/go-diskfs/util"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SOURCE_DATE_EPOCH is the environment variable holding the reproducible build timestamp in Unix seconds
+const SOURCE_DATE_EPOCH = "SOURCE_DATE_EPOCH"
+
+// BuildStamp fixes the values an image build otherwise takes from the clock or a random source. When
+// Timestamp is zero, SOURCE_DATE_EPOCH supplies it; when neither is set images get the current time,
+// a clock based FAT volume serial and random GPT GUIDs.
+type BuildStamp struct {
+	// Timestamp replaces the current time in every timestamp written to the image
+	Timestamp time.Time
+	// VolumeSerial replaces the FAT volume serial, which is otherwise derived from the timestamp
+	VolumeSerial uint32
+}
+
+// SourceDateEpoch returns the time set by SOURCE_DATE_EPOCH, or the zero time if it is not set
+func SourceDateEpoch() (time.Time, error) {
+	value := os.Getenv(SOURCE_DATE_EPOCH)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %s", SOURCE_DATE_EPOCH, value)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// ParseTimestamp converts Unix seconds or an RFC 3339 time to a build timestamp
+func ParseTimestamp(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp (expected Unix seconds or RFC 3339): %s", value)
+	}
+	return t.UTC(), nil
+}
+
+// ParseVolumeSerial converts a hexadecimal volume serial, optionally written as XXXX-XXXX, to a number
+func ParseVolumeSerial(value string) (uint32, error) {
+	serial, err := strconv.ParseUint(strings.ReplaceAll(value, "-", ""), 16, 32)
+	if err != nil || serial == 0 {
+		return 0, fmt.Errorf("invalid volume serial (expected nonzero XXXX-XXXX hex): %s", value)
+	}
+	return uint32(serial), nil
+}
+
+// resolve returns the stamp with the timestamp taken from SOURCE_DATE_EPOCH if unset and converted to UTC
+func (s BuildStamp) resolve() (BuildStamp, error) {
+	if s.Timestamp.IsZero() {
+		t, err := SourceDateEpoch()
+		if err != nil {
+			return s, err
+		}
+		s.Timestamp = t
+	}
+	// FAT times are stored without a zone, so a fixed timestamp must not depend on the local zone
+	s.Timestamp = s.Timestamp.UTC()
+	return s, nil
+}
+
+// reproducible returns true if the stamp fixes the image timestamps
+func (s BuildStamp) reproducible() bool {
+	return !s.Timestamp.IsZero()
+}
+
+// now returns the fixed timestamp or the current time
+func (s BuildStamp) now() time.Time {
+	if s.Timestamp.IsZero() {
+		return time.Now()
+	}
+	return s.Timestamp
+}
+
+// serial returns the fixed volume serial or one derived from the timestamp
+func (s BuildStamp) serial() uint32 {
+	if s.VolumeSerial != 0 {
+		return s.VolumeSerial
+	}
+	now := s.now()
+	return uint32(now.Unix()<<20 | (now.UnixNano() / 1000000))
+}
+
+// guid returns a GPT GUID, derived from the stamp and name when the build is reproducible
+func (s BuildStamp) guid(name string) string {
+	if !s.reproducible() {
+		return uuid.NewString()
+	}
+	seed := fmt.Sprintf("fdimage:%d:%08x:%s", s.Timestamp.Unix(), s.serial(), name)
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(seed)).String()
+}
+
+// stampISO sets every ISO9660 and Rock Ridge timestamp of the image in f to t and clears the Rock
+// Ridge owner, which otherwise reflect the clock and the user at the time of the build
+func stampISO(f util.File, t time.Time) error {
+	reader := isoReader{r: f, visited: make(map[uint32]bool), suspSkip: -1}
+	root, err := reader.readRoot()
+	if err != nil {
+		return err
+	}
+	err = stampISOVolumeDescriptors(f, t)
+	if err != nil {
+		return err
+	}
+	stamper := isoStamper{isoReader: &reader, w: f, t: t}
+	return stamper.stampDirectory(root.location, root.size, 0)
+}
+
+// stampISOVolumeDescriptors sets the root directory record date and the creation, modification and
+// effective dates of the primary and supplementary volume descriptors. The expiration date is left not
+// specified, since a build time there would mark the volume expired when built.
+func stampISOVolumeDescriptors(f util.File, t time.Time) error {
+	descriptor := make([]byte, ISO_LOGICAL_BLOCK_SIZE)
+	for sector := int64(ISO_SYSTEM_AREA_SECTORS); ; sector++ {
+		offset := sector * ISO_LOGICAL_BLOCK_SIZE
+		_, err := f.ReadAt(descriptor, offset)
+		if err != nil {
+			return fmt.Errorf("failed reading volume descriptor %d: %v", sector, err)
+		}
+		if string(descriptor[1:6]) != "CD001" || descriptor[0] == 0xff {
+			return nil
+		}
+		if descriptor[0] != 1 && descriptor[0] != 2 {
+			continue
+		}
+		// the root directory record, then the volume dates
+		copy(descriptor[156+18:156+18+isoRecordDateSize], isoRecordTimeBytes(t))
+		for _, field := range []int{813, 830, 864} {
+			copy(descriptor[field:field+17], isoVolumeTimeBytes(t))
+		}
+		copy(descriptor[847:847+17], isoVolumeTimeUnspecified)
+		_, err = f.WriteAt(descriptor, offset)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isoStamper rewrites the timestamps of directory records and their system use entries
+type isoStamper struct {
+	*isoReader
+	w util.File
+	t time.Time
+}
+
+func (s *isoStamper) stampDirectory(location uint32, size int64, depth int) error {
+	if depth > ISO_MAX_DEPTH {
+		return fmt.Errorf("directory nesting too deep")
+	}
+	if s.visited[location] {
+		return nil
+	}
+	s.visited[location] = true
+	if size > ISO_MAX_DIRECTORY_SIZE {
+		return fmt.Errorf("directory too large")
+	}
+	data := make([]byte, size)
+	dirOffset := int64(location) * s.blockSize
+	_, err := s.r.ReadAt(data, dirOffset)
+	if err != nil {
+		return fmt.Errorf("failed reading directory: %v", err)
+	}
+	subdirs := [][2]int64{}
+	for offset := 0; offset < len(data); {
+		length := int(data[offset])
+		if length == 0 {
+			offset = (offset/int(s.blockSize) + 1) * int(s.blockSize)
+			continue
+		}
+		if length < 34 || offset+length > len(data) {
+			return fmt.Errorf("invalid directory record at offset %d", dirOffset+int64(offset))
+		}
+		record := data[offset : offset+length]
+		offset += length
+		copy(record[18:18+isoRecordDateSize], isoRecordTimeBytes(s.t))
+		if s.suspSkip >= 0 {
+			start := systemUseOffset(record) + s.suspSkip
+			if start < len(record) {
+				err = s.stampSystemUse(record[start:], 0)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		isDot := record[32] == 1 && record[33] <= 1
+		if record[25]&isoDirectoryFlag != 0 && !isDot {
+			subdirs = append(subdirs, [2]int64{int64(binary.LittleEndian.Uint32(record[2:6])), int64(binary.LittleEndian.Uint32(record[10:14]))})
+		}
+	}
+	_, err = s.w.WriteAt(data, dirOffset)
+	if err != nil {
+		return err
+	}
+	for _, subdir := range subdirs {
+		err = s.stampDirectory(uint32(subdir[0]), subdir[1], depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stampSystemUse rewrites the TF and PX entries in area, following CE continuation areas
+func (s *isoStamper) stampSystemUse(area []byte, continuations int) error {
+	for i := 0; i+4 <= len(area); {
+		length := int(area[i+2])
+		if length < 4 || i+length > len(area) {
+			break
+		}
+		entry := area[i : i+length]
+		i += length
+		switch string(entry[0:2]) {
+		case "ST":
+			return nil
+		case "TF":
+			stampRockRidgeTimes(entry, s.t)
+		case "PX":
+			if length >= 36 {
+				// uid and gid, both byte orders
+				clear(entry[20:36])
+			}
+		case "CE":
+			if length < 28 {
+				continue
+			}
+			if continuations >= ISO_MAX_CONTINUATIONS {
+				return fmt.Errorf("too many system use continuation areas")
+			}
+			block := int64(binary.LittleEndian.Uint32(entry[4:8]))
+			offset := int64(binary.LittleEndian.Uint32(entry[12:16]))
+			size := int64(binary.LittleEndian.Uint32(entry[20:24]))
+			if size > s.blockSize {
+				return fmt.Errorf("invalid system use continuation area")
+			}
+			next := make([]byte, size)
+			_, err := s.r.ReadAt(next, block*s.blockSize+offset)
+			if err != nil {
+				return fmt.Errorf("failed reading system use continuation area: %v", err)
+			}
+			err = s.stampSystemUse(next, continuations+1)
+			if err != nil {
+				return err
+			}
+			_, err = s.w.WriteAt(next, block*s.blockSize+offset)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stampRockRidgeTimes sets every timestamp of a TF entry to t
+func stampRockRidgeTimes(b []byte, t time.Time) {
+	flags := b[4]
+	stamp := isoRecordTimeBytes(t)
+	if flags&0x80 != 0 {
+		stamp = isoVolumeTimeBytes(t)
+	}
+	data := b[5:]
+	for bit := uint8(0); bit < 7; bit++ {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		if len(data) < len(stamp) {
+			return
+		}
+		copy(data, stamp)
+		data = data[len(stamp):]
+	}
+}
+
+// isoRecordTimeBytes encodes t in the 7 byte directory record date format
+func isoRecordTimeBytes(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+// isoVolumeTimeUnspecified is the volume descriptor date meaning not specified: ASCII zero digits and a
+// zero time zone offset
+var isoVolumeTimeUnspecified = append([]byte("0000000000000000"), 0)
+
+// isoVolumeTimeBytes encodes t in the 17 byte volume descriptor date format
+func isoVolumeTimeBytes(t time.Time) []byte {
+	t = t.UTC()
+	return append([]byte(fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/10000000)), 0)
+}
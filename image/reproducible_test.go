@@ -0,0 +1,124 @@
+package image
+
+import (
+	"crypto/sha256"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sha256File returns the SHA-256 digest of a host file
+func sha256File(t *testing.T, filename string) []byte {
+	fp, err := os.Open(filename)
+	require.Nil(t, err)
+	defer fp.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, fp)
+	require.Nil(t, err)
+	return h.Sum(nil)
+}
+
+func TestReproducible(t *testing.T) {
+	dir := t.TempDir()
+	loader := mkTestPE(t, dir, "bootx64.efi", 0x8664, 4096)
+	autoexec := mkTestFile(t, dir, "autoexec.ipxe", "#!ipxe\necho reproducible\n")
+	sourceISO := mkTestISO(t, t.TempDir())
+	data := filepath.Join(dir, "data")
+	require.Nil(t, os.Mkdir(data, 0700))
+	mkTestFile(t, data, "readme.txt", "data\n")
+	stamp := BuildStamp{Timestamp: time.Date(2024, 5, 17, 12, 30, 0, 0, time.UTC)}
+
+	builds := map[string]func(string) error{
+		"efi.img": func(output string) error {
+			options := EFIImageOptions{Loaders: []EFILoader{{Arch: "x64", File: loader}}, ExtraFiles: []string{autoexec}, Stamp: stamp}
+			return BuildEFIImage(t.Context(), output, options)
+		},
+		"hybrid.iso": func(output string) error {
+			options := ISOBuildOptions{
+				Files:     map[string]string{"/autoexec.ipxe": autoexec},
+				EFIFiles:  map[string]string{"/autoexec.ipxe": autoexec},
+				HybridGPT: true,
+				Stamp:     stamp,
+			}
+			return BuildISOImage(t.Context(), output, sourceISO, options)
+		},
+		"disk.img": func(output string) error {
+			options := DiskImageOptions{
+				ESP:        EFIImageOptions{Loaders: []EFILoader{{Arch: "x64", File: loader}}},
+				Partitions: []DiskPartition{{Name: "data", SourceDir: data}},
+				Stamp:      stamp,
+			}
+			return BuildDiskImage(t.Context(), output, options)
+		},
+	}
+	for _, name := range sortedKeys(builds) {
+		first := filepath.Join(t.TempDir(), name)
+		require.Nil(t, builds[name](first), name)
+		// cross a second boundary so clock based values would differ
+		time.Sleep(1100 * time.Millisecond)
+		second := filepath.Join(t.TempDir(), name)
+		require.Nil(t, builds[name](second), name)
+		require.Equal(t, sha256File(t, first), sha256File(t, second), name)
+	}
+
+	// the primary volume descriptor gets the build time but no expiration date
+	isoImage := filepath.Join(dir, "stamped.iso")
+	require.Nil(t, builds["hybrid.iso"](isoImage))
+	fp, err := os.Open(isoImage)
+	require.Nil(t, err)
+	descriptor := make([]byte, ISO_LOGICAL_BLOCK_SIZE)
+	_, err = fp.ReadAt(descriptor, ISO_SYSTEM_AREA_SECTORS*ISO_LOGICAL_BLOCK_SIZE)
+	require.Nil(t, err)
+	fp.Close()
+	for _, field := range []int{813, 830, 864} {
+		require.Equal(t, "2024051712300000\x00", string(descriptor[field:field+17]), field)
+	}
+	require.Equal(t, "0000000000000000\x00", string(descriptor[847:847+17]))
+
+	// SOURCE_DATE_EPOCH fixes the timestamp when the options do not
+	t.Setenv(SOURCE_DATE_EPOCH, "1715949000")
+	epochImage := filepath.Join(dir, "epoch.img")
+	err = CreateEFIImage(t.Context(), epochImage, loader, "BOOTX64.EFI", []string{autoexec})
+	require.Nil(t, err)
+	entries, err := ListImageEntries(epochImage)
+	require.Nil(t, err)
+	require.NotEmpty(t, entries)
+	for _, entry := range entries {
+		require.Equal(t, "2024-05-17 12:30:00", entry.ModTime.Format(time.DateTime), entry.Path)
+	}
+
+	epochISO := filepath.Join(dir, "epoch.iso")
+	err = CreateISOImage(t.Context(), epochISO, sourceISO, autoexec)
+	require.Nil(t, err)
+	entries, err = ListImageEntries(epochISO)
+	require.Nil(t, err)
+	for _, entry := range entries {
+		require.Equal(t, stamp.Timestamp.Unix(), entry.ModTime.Unix(), entry.Path)
+	}
+
+	t.Setenv(SOURCE_DATE_EPOCH, "yesterday")
+	err = CreateEFIImage(t.Context(), filepath.Join(dir, "bad.img"), loader, "BOOTX64.EFI", nil)
+	require.NotNil(t, err)
+}
+
+func TestParseBuildStamp(t *testing.T) {
+	ts, err := ParseTimestamp("1715949000")
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2024, 5, 17, 12, 30, 0, 0, time.UTC), ts)
+	ts, err = ParseTimestamp("2024-05-17T14:30:00+02:00")
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2024, 5, 17, 12, 30, 0, 0, time.UTC), ts)
+	_, err = ParseTimestamp("May 17")
+	require.NotNil(t, err)
+
+	serial, err := ParseVolumeSerial("1234-ABCD")
+	require.Nil(t, err)
+	require.Equal(t, uint32(0x1234abcd), serial)
+	_, err = ParseVolumeSerial("0")
+	require.NotNil(t, err)
+	_, err = ParseVolumeSerial("xyz")
+	require.NotNil(t, err)
+}
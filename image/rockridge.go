@@ -0,0 +1,486 @@
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ISO_MAX_DEPTH          = 64
+	ISO_MAX_CONTINUATIONS  = 32
+	ISO_MAX_DIRECTORY_SIZE = 16 * 1024 * 1024
+	isoDirectoryFlag       = 0x02
+	isoMultiExtent         = 0x80
+	isoRecordDateSize      = 7
+)
+
+// POSIX file type bits of the Rock Ridge PX mode field
+const (
+	posixTypeMask  = 0170000
+	posixSocket    = 0140000
+	posixSymlink   = 0120000
+	posixRegular   = 0100000
+	posixBlock     = 0060000
+	posixDirectory = 0040000
+	posixChar      = 0020000
+	posixFifo      = 0010000
+)
+
+// isoEntry is an ISO9660 directory record with its Rock Ridge attributes
+type isoEntry struct {
+	path string
+	// name is the raw ISO9660 or Rock Ridge name of the entry
+	name     string
+	location uint32
+	size     int64
+	mode     os.FileMode
+	// rockRidge is true if the entry has a PX record, making mode, uid, gid and nlink valid
+	rockRidge  bool
+	uid        uint32
+	gid        uint32
+	nlink      uint32
+	modTime    time.Time
+	accessTime time.Time
+	symlink    string
+	rdev       uint64
+	// offset is the image byte offset of the directory record
+	offset int64
+}
+
+func (e *isoEntry) isDir() bool {
+	return e.mode.IsDir()
+}
+
+// isoReader walks the directory tree of a raw ISO9660 image
+type isoReader struct {
+	r         io.ReaderAt
+	blockSize int64
+	// suspSkip is the SUSP SP skip length, or -1 if the image has no system use entries
+	suspSkip int
+	visited  map[uint32]bool
+}
+
+// readISOEntries returns every directory record below the root of the ISO9660 image in r, parents first
+func readISOEntries(r io.ReaderAt) ([]*isoEntry, error) {
+	reader := isoReader{r: r, visited: make(map[uint32]bool), suspSkip: -1}
+	root, err := reader.readRoot()
+	if err != nil {
+		return nil, err
+	}
+	return reader.walk(root, 0)
+}
+
+// readRoot locates the primary volume descriptor and returns the root directory entry
+func (ir *isoReader) readRoot() (*isoEntry, error) {
+	descriptor := make([]byte, ISO_LOGICAL_BLOCK_SIZE)
+	for sector := int64(ISO_SYSTEM_AREA_SECTORS); ; sector++ {
+		_, err := ir.r.ReadAt(descriptor, sector*ISO_LOGICAL_BLOCK_SIZE)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading volume descriptor %d: %v", sector, err)
+		}
+		if string(descriptor[1:6]) != "CD001" || descriptor[0] == 0xff {
+			return nil, fmt.Errorf("primary volume descriptor not found")
+		}
+		if descriptor[0] == 1 {
+			break
+		}
+	}
+	ir.blockSize = int64(binary.LittleEndian.Uint16(descriptor[128:130]))
+	if ir.blockSize == 0 {
+		return nil, fmt.Errorf("invalid logical block size")
+	}
+	record := descriptor[156 : 156+34]
+	root := isoEntry{
+		path:     "/",
+		location: binary.LittleEndian.Uint32(record[2:6]),
+		size:     int64(binary.LittleEndian.Uint32(record[10:14])),
+		mode:     os.ModeDir | 0755,
+	}
+
+	// the SUSP SP entry is the first system use entry of the root "." record
+	data := make([]byte, 255)
+	_, err := ir.r.ReadAt(data, int64(root.location)*ir.blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading root directory: %v", err)
+	}
+	dot := data[:data[0]]
+	if len(dot) >= 34 && systemUseOffset(dot) < len(dot) {
+		use := dot[systemUseOffset(dot):]
+		if len(use) >= 7 && string(use[0:2]) == "SP" && use[4] == 0xbe && use[5] == 0xef {
+			ir.suspSkip = int(use[6])
+		}
+	}
+	return &root, nil
+}
+
+// walk returns the entries below directory dir
+func (ir *isoReader) walk(dir *isoEntry, depth int) ([]*isoEntry, error) {
+	if depth > ISO_MAX_DEPTH {
+		return nil, fmt.Errorf("directory nesting too deep: %s", dir.path)
+	}
+	if ir.visited[dir.location] {
+		return nil, fmt.Errorf("directory loop at %s", dir.path)
+	}
+	ir.visited[dir.location] = true
+	if dir.size > ISO_MAX_DIRECTORY_SIZE {
+		return nil, fmt.Errorf("directory too large: %s", dir.path)
+	}
+	data := make([]byte, dir.size)
+	dirOffset := int64(dir.location) * ir.blockSize
+	_, err := ir.r.ReadAt(data, dirOffset)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading directory %s: %v", dir.path, err)
+	}
+
+	entries := []*isoEntry{}
+	var previous *isoEntry
+	for offset := 0; offset < len(data); {
+		length := int(data[offset])
+		if length == 0 {
+			// records do not span sectors; skip the sector padding
+			offset = (offset/int(ir.blockSize) + 1) * int(ir.blockSize)
+			continue
+		}
+		if length < 34 || offset+length > len(data) {
+			return nil, fmt.Errorf("invalid directory record in %s at offset %d", dir.path, offset)
+		}
+		record := data[offset : offset+length]
+		recordOffset := dirOffset + int64(offset)
+		offset += length
+
+		nameLength := int(record[32])
+		if 33+nameLength > length {
+			return nil, fmt.Errorf("invalid directory record in %s at offset %d", dir.path, recordOffset-dirOffset)
+		}
+		if nameLength == 1 && record[33] <= 1 {
+			// "." and ".."
+			continue
+		}
+		if previous != nil {
+			// the remaining extents of a multi-extent file
+			previous.size += int64(binary.LittleEndian.Uint32(record[10:14]))
+			if record[25]&isoMultiExtent == 0 {
+				previous = nil
+			}
+			continue
+		}
+		entry, relocated, err := ir.parseRecord(dir.path, record, recordOffset)
+		if err != nil {
+			return nil, err
+		}
+		if relocated {
+			continue
+		}
+		if record[25]&isoMultiExtent != 0 {
+			previous = entry
+		}
+		entries = append(entries, entry)
+		if entry.isDir() {
+			children, err := ir.walk(entry, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, children...)
+		}
+	}
+	return entries, nil
+}
+
+// parseRecord decodes a directory record and its system use entries, returning true if the record
+// is a relocated directory that is listed through its child link instead
+func (ir *isoReader) parseRecord(parent string, record []byte, offset int64) (*isoEntry, bool, error) {
+	nameLength := int(record[32])
+	name := string(record[33 : 33+nameLength])
+	entry := isoEntry{
+		location: binary.LittleEndian.Uint32(record[2:6]),
+		size:     int64(binary.LittleEndian.Uint32(record[10:14])),
+		modTime:  isoRecordTime(record[18 : 18+isoRecordDateSize]),
+		offset:   offset,
+	}
+	if record[25]&isoDirectoryFlag != 0 {
+		entry.mode = os.ModeDir | 0755
+	} else {
+		entry.mode = 0644
+		name = strings.TrimSuffix(name, ";1")
+		name = strings.TrimSuffix(name, ".")
+		name = strings.TrimPrefix(name, ".")
+	}
+	entry.accessTime = entry.modTime
+
+	if ir.suspSkip >= 0 {
+		use, err := ir.systemUse(record)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", path.Join(parent, name), err)
+		}
+		rrName, relocated, err := ir.parseRockRidge(&entry, use)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", path.Join(parent, name), err)
+		}
+		if relocated {
+			return nil, true, nil
+		}
+		if rrName != "" {
+			name = rrName
+		}
+	}
+	entry.name = name
+	entry.path = path.Join(parent, name)
+	return &entry, false, nil
+}
+
+// systemUseOffset returns the start of the system use area of a directory record
+func systemUseOffset(record []byte) int {
+	offset := 33 + int(record[32])
+	if record[32]%2 == 0 {
+		offset++
+	}
+	return offset
+}
+
+// systemUse returns the system use entries of a record, following CE continuation areas
+func (ir *isoReader) systemUse(record []byte) ([]byte, error) {
+	start := systemUseOffset(record) + ir.suspSkip
+	if start >= len(record) {
+		return []byte{}, nil
+	}
+	area := record[start:]
+	use := []byte{}
+	for continuations := 0; ; continuations++ {
+		var next []byte
+		for i := 0; i+4 <= len(area); {
+			length := int(area[i+2])
+			if length < 4 || i+length > len(area) {
+				break
+			}
+			entry := area[i : i+length]
+			if string(entry[0:2]) == "ST" {
+				break
+			}
+			if string(entry[0:2]) == "CE" && length >= 28 {
+				next = entry
+			} else {
+				use = append(use, entry...)
+			}
+			i += length
+		}
+		if next == nil {
+			return use, nil
+		}
+		if continuations >= ISO_MAX_CONTINUATIONS {
+			return nil, fmt.Errorf("too many system use continuation areas")
+		}
+		block := int64(binary.LittleEndian.Uint32(next[4:8]))
+		offset := int64(binary.LittleEndian.Uint32(next[12:16]))
+		length := int64(binary.LittleEndian.Uint32(next[20:24]))
+		if length > ir.blockSize {
+			return nil, fmt.Errorf("invalid system use continuation area")
+		}
+		area = make([]byte, length)
+		_, err := ir.r.ReadAt(area, block*ir.blockSize+offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading system use continuation area: %v", err)
+		}
+	}
+}
+
+// parseRockRidge applies the Rock Ridge entries in use to entry, returning the alternate name and
+// true if the entry is a relocated directory
+func (ir *isoReader) parseRockRidge(entry *isoEntry, use []byte) (string, bool, error) {
+	name := ""
+	link := symlinkBuilder{}
+	for i := 0; i+4 <= len(use); {
+		length := int(use[i+2])
+		if length < 4 || i+length > len(use) {
+			break
+		}
+		b := use[i : i+length]
+		i += length
+		switch string(b[0:2]) {
+		case "PX":
+			if length < 36 {
+				return "", false, fmt.Errorf("invalid Rock Ridge PX entry")
+			}
+			entry.rockRidge = true
+			entry.mode = posixFileMode(binary.LittleEndian.Uint32(b[4:8]))
+			entry.nlink = binary.LittleEndian.Uint32(b[12:16])
+			entry.uid = binary.LittleEndian.Uint32(b[20:24])
+			entry.gid = binary.LittleEndian.Uint32(b[28:32])
+		case "PN":
+			if length < 20 {
+				return "", false, fmt.Errorf("invalid Rock Ridge PN entry")
+			}
+			high := uint64(binary.LittleEndian.Uint32(b[4:8]))
+			low := uint64(binary.LittleEndian.Uint32(b[12:16]))
+			entry.rdev = high<<32 | low
+		case "NM":
+			if length < 5 {
+				return "", false, fmt.Errorf("invalid Rock Ridge NM entry")
+			}
+			switch {
+			case b[4]&0x02 != 0:
+				name += "."
+			case b[4]&0x04 != 0:
+				name += ".."
+			default:
+				name += string(b[5:])
+			}
+		case "SL":
+			if length < 5 {
+				return "", false, fmt.Errorf("invalid Rock Ridge SL entry")
+			}
+			err := link.add(b[5:])
+			if err != nil {
+				return "", false, err
+			}
+		case "TF":
+			if length < 5 {
+				return "", false, fmt.Errorf("invalid Rock Ridge TF entry")
+			}
+			parseRockRidgeTimes(entry, b)
+		case "CL":
+			if length < 12 {
+				return "", false, fmt.Errorf("invalid Rock Ridge CL entry")
+			}
+			// a deep directory moved elsewhere; read its size from its "." record
+			entry.location = binary.LittleEndian.Uint32(b[4:8])
+			entry.mode = os.ModeDir | entry.mode.Perm()
+			dot := make([]byte, 34)
+			_, err := ir.r.ReadAt(dot, int64(entry.location)*ir.blockSize)
+			if err != nil {
+				return "", false, fmt.Errorf("failed reading relocated directory: %v", err)
+			}
+			entry.size = int64(binary.LittleEndian.Uint32(dot[10:14]))
+		case "RE":
+			return "", true, nil
+		}
+	}
+	if entry.mode&os.ModeSymlink != 0 {
+		entry.symlink = link.target()
+	}
+	return name, false, nil
+}
+
+// symlinkBuilder assembles a symlink target from SL component records
+type symlinkBuilder struct {
+	components []string
+	absolute   bool
+	// continued is true if the last component continues in the next record
+	continued bool
+}
+
+func (s *symlinkBuilder) add(data []byte) error {
+	for i := 0; i < len(data); {
+		if i+2 > len(data) || i+2+int(data[i+1]) > len(data) {
+			return fmt.Errorf("invalid Rock Ridge SL component")
+		}
+		flags := data[i]
+		content := string(data[i+2 : i+2+int(data[i+1])])
+		i += 2 + int(data[i+1])
+		switch {
+		case flags&0x08 != 0:
+			s.absolute = true
+			continue
+		case flags&0x02 != 0:
+			content = "."
+		case flags&0x04 != 0:
+			content = ".."
+		}
+		if s.continued && len(s.components) > 0 {
+			s.components[len(s.components)-1] += content
+		} else {
+			s.components = append(s.components, content)
+		}
+		s.continued = flags&0x01 != 0
+	}
+	return nil
+}
+
+func (s *symlinkBuilder) target() string {
+	target := strings.Join(s.components, "/")
+	if s.absolute {
+		return "/" + target
+	}
+	return target
+}
+
+// parseRockRidgeTimes sets the modify and access times of entry from a TF entry
+func parseRockRidgeTimes(entry *isoEntry, b []byte) {
+	flags := b[4]
+	size := isoRecordDateSize
+	if flags&0x80 != 0 {
+		size = 17
+	}
+	data := b[5:]
+	for bit := uint8(0); bit < 7; bit++ {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		if len(data) < size {
+			return
+		}
+		var t time.Time
+		if size == isoRecordDateSize {
+			t = isoRecordTime(data[:size])
+		} else {
+			t = isoVolumeTime(data[:size])
+		}
+		data = data[size:]
+		switch bit {
+		case 1:
+			entry.modTime = t
+		case 2:
+			entry.accessTime = t
+		}
+	}
+}
+
+// isoRecordTime decodes the 7 byte directory record date format
+func isoRecordTime(b []byte) time.Time {
+	location := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(int(b[0])+1900, time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, location)
+}
+
+// isoVolumeTime decodes the 17 byte volume descriptor date format
+func isoVolumeTime(b []byte) time.Time {
+	field := func(start, end int) int {
+		value, _ := strconv.Atoi(string(b[start:end]))
+		return value
+	}
+	location := time.FixedZone("", int(int8(b[16]))*15*60)
+	return time.Date(field(0, 4), time.Month(field(4, 6)), field(6, 8), field(8, 10), field(10, 12), field(12, 14), field(14, 16)*10000000, location)
+}
+
+// posixFileMode converts a POSIX st_mode value to an os.FileMode
+func posixFileMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	switch mode & posixTypeMask {
+	case posixDirectory:
+		fileMode |= os.ModeDir
+	case posixSymlink:
+		fileMode |= os.ModeSymlink
+	case posixChar:
+		fileMode |= os.ModeDevice | os.ModeCharDevice
+	case posixBlock:
+		fileMode |= os.ModeDevice
+	case posixFifo:
+		fileMode |= os.ModeNamedPipe
+	case posixSocket:
+		fileMode |= os.ModeSocket
+	}
+	return fileMode
+}
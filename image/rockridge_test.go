@@ -0,0 +1,97 @@
+package image
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestISOEntries(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+	fp, err := os.Open(isoImage)
+	require.Nil(t, err)
+	defer fp.Close()
+	entries, err := readISOEntries(fp)
+	require.Nil(t, err)
+
+	files, err := ListImageFiles(isoImage)
+	require.Nil(t, err)
+	paths := []string{}
+	for _, entry := range entries {
+		name := entry.path
+		if entry.isDir() {
+			name += "/"
+		}
+		paths = append(paths, name)
+	}
+	require.Equal(t, files, paths)
+
+	catalog, err := ReadBootCatalog(isoImage)
+	require.Nil(t, err)
+	for _, entry := range entries {
+		require.True(t, entry.rockRidge, entry.path)
+		switch entry.path {
+		case "/docs":
+			require.Equal(t, os.ModeDir, entry.mode.Type())
+		case "/docs/readme.txt":
+			require.Equal(t, int64(len("netboot test image\n")), entry.size)
+			require.True(t, entry.mode.IsRegular())
+			require.False(t, entry.modTime.IsZero())
+		case "/esp.img":
+			require.Equal(t, catalog.Entries[1].LoadRBA, entry.location)
+		}
+	}
+
+	require.Equal(t, os.ModeSymlink|0777, posixFileMode(posixSymlink|0777))
+	require.Equal(t, os.ModeDevice|os.ModeCharDevice|0600, posixFileMode(posixChar|0600))
+	require.Equal(t, os.ModeDir|os.ModeSetgid|0755, posixFileMode(posixDirectory|02755))
+}
+
+func TestISOEntriesLoop(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+
+	// point /docs back at the root directory
+	fp, err := os.Open(isoImage)
+	require.Nil(t, err)
+	reader := isoReader{r: fp, visited: make(map[uint32]bool), suspSkip: -1}
+	root, err := reader.readRoot()
+	fp.Close()
+	require.Nil(t, err)
+	patchISORecord(t, isoImage, "/docs", func(record []byte) {
+		binary.LittleEndian.PutUint32(record[2:6], root.location)
+		binary.BigEndian.PutUint32(record[6:10], root.location)
+	})
+
+	fp, err = os.Open(isoImage)
+	require.Nil(t, err)
+	defer fp.Close()
+	_, err = readISOEntries(fp)
+	require.ErrorContains(t, err, "directory loop at /docs")
+}
+
+func TestISOEntriesMalformedRoot(t *testing.T) {
+	dir := t.TempDir()
+	isoImage := mkTestISO(t, dir)
+
+	// give the root "." record a name running past the end of the record
+	fp, err := os.OpenFile(isoImage, os.O_RDWR, 0)
+	require.Nil(t, err)
+	reader := isoReader{r: fp, visited: make(map[uint32]bool), suspSkip: -1}
+	root, err := reader.readRoot()
+	require.Nil(t, err)
+	_, err = fp.WriteAt([]byte{200}, int64(root.location)*reader.blockSize+32)
+	require.Nil(t, err)
+	fp.Close()
+
+	fp, err = os.Open(isoImage)
+	require.Nil(t, err)
+	defer fp.Close()
+	_, err = readISOEntries(fp)
+	require.ErrorContains(t, err, "invalid directory record")
+	report, err := VerifyImage(isoImage)
+	require.Nil(t, err)
+	require.False(t, report.OK())
+}
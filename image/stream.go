@@ -0,0 +1,151 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"github.com/rstms/go-diskfs/util"
+	"io"
+	"os"
+)
+
+// READER_IMAGE_NAME names images read from an io.ReaderAt in errors
+const READER_IMAGE_NAME = "image"
+
+// readerFile adapts an io.ReaderAt of known size to a util.File that refuses writes
+type readerFile struct {
+	r      io.ReaderAt
+	size   int64
+	offset int64
+}
+
+func (f *readerFile) ReadAt(p []byte, offset int64) (int, error) {
+	return f.r.ReadAt(p, offset)
+}
+
+func (f *readerFile) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, fmt.Errorf("image is read-only")
+}
+
+func (f *readerFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative seek offset: %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// openReaderVolume opens the filesystem chosen by selector in the image of size bytes read from r
+func openReaderVolume(r io.ReaderAt, size int64, selector PartitionSelector) (*volume, error) {
+	return openFileVolume(&readerFile{r: r, size: size}, size, READER_IMAGE_NAME, selector)
+}
+
+// ListReaderFiles lists the files of the partition chosen by selector in the image of size bytes read from r
+func ListReaderFiles(r io.ReaderAt, size int64, selector PartitionSelector) ([]string, error) {
+	v, err := openReaderVolume(r, size, selector)
+	if err != nil {
+		return []string{}, err
+	}
+	return listFiles(v.fs)
+}
+
+// ListReaderEntries returns the files and directories of the partition chosen by selector in the image
+// of size bytes read from r
+func ListReaderEntries(r io.ReaderAt, size int64, selector PartitionSelector) ([]Entry, error) {
+	v, err := openReaderVolume(r, size, selector)
+	if err != nil {
+		return []Entry{}, err
+	}
+	return v.entries()
+}
+
+// ExtractReader writes the files of the image of size bytes read from r below destDir, like ExtractImage
+func ExtractReader(ctx context.Context, r io.ReaderAt, size int64, destDir string, options ExtractOptions) error {
+	err := checkExtractOptions(options)
+	if err != nil {
+		return err
+	}
+	v, err := openReaderVolume(r, size, options.Partition)
+	if err != nil {
+		return err
+	}
+	return v.extract(ctx, destDir, options)
+}
+
+// PlanExtractReader returns the image paths of the files ExtractReader would write with options, like
+// PlanExtract
+func PlanExtractReader(r io.ReaderAt, size int64, options ExtractOptions) ([]string, error) {
+	err := checkExtractOptions(options)
+	if err != nil {
+		return []string{}, err
+	}
+	v, err := openReaderVolume(r, size, options.Partition)
+	if err != nil {
+		return []string{}, err
+	}
+	return v.plan(options)
+}
+
+// ExtractReaderFile copies the file at imagePath in the partition chosen by selector in the image of size
+// bytes read from r to w
+func ExtractReaderFile(r io.ReaderAt, size int64, selector PartitionSelector, imagePath string, w io.Writer) error {
+	v, err := openReaderVolume(r, size, selector)
+	if err != nil {
+		return err
+	}
+	return v.extractFile(READER_IMAGE_NAME, imagePath, w)
+}
+
+// truncater is a file whose size can be set
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// setFileSize truncates f to size bytes if it supports Truncate; otherwise f is extended to size bytes
+// unless it is already that long, and existing data is never overwritten
+func setFileSize(f fatDevice, size int64) error {
+	if t, ok := f.(truncater); ok {
+		return t.Truncate(size)
+	}
+	if size == 0 {
+		return nil
+	}
+	n, err := f.ReadAt(make([]byte, 1), size-1)
+	if n == 1 {
+		return nil
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	_, err = f.WriteAt([]byte{0}, size-1)
+	return err
+}
+
+// spoolOutput builds an image in a temporary file with build, which returns the image size, and copies
+// the image to w until ctx is done
+func spoolOutput(ctx context.Context, w io.WriterAt, build func(f util.File) (int64, error)) (int64, error) {
+	fp, err := os.CreateTemp("", "fdimage*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	size, err := build(fp)
+	if err != nil {
+		return 0, err
+	}
+	logger().Debug("copying spooled image", "size", size)
+	_, err = io.Copy(io.NewOffsetWriter(w, 0), &contextReader{ctx: ctx, r: io.NewSectionReader(fp, 0, size)})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
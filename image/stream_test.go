@@ -0,0 +1,181 @@
+package image
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// memWriter is an in-memory io.WriterAt
+type memWriter struct {
+	data []byte
+}
+
+func (m *memWriter) WriteAt(p []byte, offset int64) (int, error) {
+	if end := offset + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[offset:], p), nil
+}
+
+// memFile is an in-memory io.WriterAt that also reads
+type memFile struct {
+	memWriter
+}
+
+func (m *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// seekFile is an in-memory util.File without Truncate
+type seekFile struct {
+	memFile
+	offset int64
+}
+
+func (m *seekFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+// truncateFile is an in-memory util.File with Truncate
+type truncateFile struct {
+	seekFile
+}
+
+func (m *truncateFile) Truncate(size int64) error {
+	if size > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, size-int64(len(m.data)))...)
+	}
+	m.data = m.data[:size]
+	return nil
+}
+
+func TestReaderImage(t *testing.T) {
+	dir := t.TempDir()
+	sourceISO := mkTestISO(t, dir)
+	data, err := os.ReadFile(sourceISO)
+	require.Nil(t, err)
+	r := bytes.NewReader(data)
+
+	files, err := ListReaderFiles(r, r.Size(), PartitionSelector{})
+	require.Nil(t, err)
+	expected, err := ListImageFiles(sourceISO)
+	require.Nil(t, err)
+	require.Equal(t, expected, files)
+
+	entries, err := ListReaderEntries(r, r.Size(), PartitionSelector{})
+	require.Nil(t, err)
+	require.Len(t, entries, len(files))
+
+	var buf bytes.Buffer
+	err = ExtractReaderFile(r, r.Size(), PartitionSelector{}, "/docs/readme.txt", &buf)
+	require.Nil(t, err)
+	require.Equal(t, "netboot test image\n", buf.String())
+	err = ExtractReaderFile(r, r.Size(), PartitionSelector{}, "/missing.txt", &buf)
+	require.ErrorContains(t, err, "not found in image")
+
+	extractDir := t.TempDir()
+	err = ExtractReader(t.Context(), r, r.Size(), extractDir, ExtractOptions{})
+	require.Nil(t, err)
+	content, err := os.ReadFile(filepath.Join(extractDir, "autoexec.ipxe"))
+	require.Nil(t, err)
+	require.Equal(t, "#!ipxe\necho source\n", string(content))
+
+	// the in-memory FAT boot image opens like a file
+	espData, err := os.ReadFile(filepath.Join(dir, "esp.img"))
+	require.Nil(t, err)
+	files, err = ListReaderFiles(bytes.NewReader(espData), int64(len(espData)), PartitionSelector{})
+	require.Nil(t, err)
+	require.Contains(t, files, "/EFI/BOOT/BOOTX64.EFI")
+}
+
+func TestWriterImage(t *testing.T) {
+	dir := t.TempDir()
+	stamp := BuildStamp{Timestamp: time.Unix(1700000000, 0), VolumeSerial: 0x12345678}
+	efiOptions := EFIImageOptions{
+		BootFile:   mkTestPE(t, dir, "bootx64.efi", 0x8664, 6000),
+		BootName:   "BOOTX64.EFI",
+		ExtraFiles: []string{mkTestFile(t, dir, "autoexec.ipxe", "#!ipxe\necho writer\n")},
+		Stamp:      stamp,
+	}
+	efiImage := filepath.Join(dir, "efi.img")
+	err := BuildEFIImage(t.Context(), efiImage, efiOptions)
+	require.Nil(t, err)
+	expected, err := os.ReadFile(efiImage)
+	require.Nil(t, err)
+
+	// a plain writer is spooled, a reading writer is formatted in place
+	spooled := memWriter{}
+	size, err := WriteEFIImage(t.Context(), &spooled, efiOptions)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(expected)), size)
+	require.Equal(t, expected, spooled.data)
+	inPlace := memFile{}
+	size, err = WriteEFIImage(t.Context(), &inPlace, efiOptions)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(expected)), size)
+	require.Equal(t, expected, inPlace.data)
+
+	sourceISO := mkTestISO(t, t.TempDir())
+	isoOptions := ISOBuildOptions{
+		Files:  map[string]string{"/autoexec.ipxe": efiOptions.ExtraFiles[0]},
+		Hybrid: true,
+		Stamp:  stamp,
+	}
+	isoImage := filepath.Join(dir, "output.iso")
+	err = BuildISOImage(t.Context(), isoImage, sourceISO, isoOptions)
+	require.Nil(t, err)
+	expected, err = os.ReadFile(isoImage)
+	require.Nil(t, err)
+	source, err := os.ReadFile(sourceISO)
+	require.Nil(t, err)
+
+	output := memWriter{}
+	size, err = WriteISOImage(t.Context(), &output, bytes.NewReader(source), int64(len(source)), isoOptions)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(expected)), size)
+	require.Equal(t, expected, output.data)
+
+	// an output without Truncate is spooled, so existing data past the volume is never zeroed
+	inPlaceISO := seekFile{}
+	inPlaceISO.data = bytes.Repeat([]byte("Z"), len(expected))
+	size, err = WriteISOImage(t.Context(), &inPlaceISO, bytes.NewReader(source), int64(len(source)), isoOptions)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(expected)), size)
+	require.True(t, bytes.Equal(expected, inPlaceISO.data))
+	truncated := truncateFile{}
+	size, err = WriteISOImage(t.Context(), &truncated, bytes.NewReader(source), int64(len(source)), isoOptions)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(expected)), size)
+	require.True(t, bytes.Equal(expected, truncated.data))
+
+	// setFileSize extends a short file and leaves a longer one alone
+	short := memFile{}
+	require.Nil(t, setFileSize(&short, 4))
+	require.Equal(t, []byte{0, 0, 0, 0}, short.data)
+	long := memFile{}
+	long.data = []byte("ZZZZZZ")
+	require.Nil(t, setFileSize(&long, 4))
+	require.Equal(t, []byte("ZZZZZZ"), long.data)
+
+	content := readTestImageFile(t, isoImage, "/autoexec.ipxe")
+	require.Equal(t, "#!ipxe\necho writer\n", content)
+}
@@ -0,0 +1,193 @@
+package image
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	HASH_SHA256  = "sha256"
+	HASH_SHA512  = "sha512"
+	HASH_BLAKE2B = "blake2b"
+)
+
+// Results of checking an image against a checksum manifest
+const (
+	CHECK_OK       = "OK"
+	CHECK_FAILED   = "FAILED"
+	CHECK_MISSING  = "MISSING"
+	CHECK_UNLISTED = "UNLISTED"
+)
+
+// FileHash is the checksum of a file inside an image
+type FileHash struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// String formats the checksum as a sha256sum line, with the path relative to the image root
+func (h FileHash) String() string {
+	name := strings.TrimPrefix(h.Path, "/")
+	if strings.ContainsAny(name, "\\\n") {
+		name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+		return fmt.Sprintf("\\%s  %s", h.Hash, name)
+	}
+	return fmt.Sprintf("%s  %s", h.Hash, name)
+}
+
+// CheckResult is the outcome of checking one file against a checksum manifest
+type CheckResult struct {
+	Path string `json:"path"`
+	// Status is CHECK_OK, CHECK_FAILED, CHECK_MISSING for manifest files absent from the image or
+	// CHECK_UNLISTED for image files absent from the manifest
+	Status string `json:"status"`
+}
+
+// newHash returns a hash for algorithm, one of HASH_SHA256, HASH_SHA512 or HASH_BLAKE2B
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "", HASH_SHA256:
+		return sha256.New(), nil
+	case HASH_SHA512:
+		return sha512.New(), nil
+	case HASH_BLAKE2B:
+		return blake2b.New512(nil)
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+}
+
+// HashContents returns the checksum of every file in an image, sorted by path
+func HashContents(imageFilename string, algorithm string) ([]FileHash, error) {
+	return HashPartitionContents(imageFilename, PartitionSelector{}, algorithm)
+}
+
+// HashPartitionContents returns the checksum of every file in the image partition chosen by selector.
+// Directories, symlinks and device nodes are skipped.
+func HashPartitionContents(imageFilename string, selector PartitionSelector, algorithm string) ([]FileHash, error) {
+	_, err := newHash(algorithm)
+	if err != nil {
+		return []FileHash{}, err
+	}
+	v, err := openVolume(imageFilename, selector)
+	if err != nil {
+		return []FileHash{}, err
+	}
+	defer v.Close()
+	isoEntries, err := v.isoEntries()
+	if err != nil {
+		return []FileHash{}, err
+	}
+	files, err := walkFS(v.fs, "/")
+	if err != nil {
+		return []FileHash{}, err
+	}
+	sort.Strings(files)
+	hashes := []FileHash{}
+	for _, file := range files {
+		if strings.HasSuffix(file, "/") || isSpecialFile(isoEntries[file]) {
+			continue
+		}
+		h, _ := newHash(algorithm)
+		fp, err := v.fs.OpenFile(file, os.O_RDONLY)
+		if err != nil {
+			return []FileHash{}, fmt.Errorf("%s: %v", file, err)
+		}
+		_, err = io.Copy(h, fp)
+		fp.Close()
+		if err != nil {
+			return []FileHash{}, fmt.Errorf("%s: %v", file, err)
+		}
+		hashes = append(hashes, FileHash{Path: file, Hash: hex.EncodeToString(h.Sum(nil))})
+	}
+	return hashes, nil
+}
+
+// ReadHashManifest parses checksum lines in sha256sum format. Paths are returned relative to the image
+// root with a leading slash.
+func ReadHashManifest(r io.Reader, algorithm string) ([]FileHash, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return []FileHash{}, err
+	}
+	hashes := []FileHash{}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		// a '*' marks binary mode, which reads files the same way
+		name = strings.TrimPrefix(strings.TrimPrefix(name, " "), "*")
+		if !ok || name == "" || len(sum) != h.Size()*2 {
+			return []FileHash{}, fmt.Errorf("line %d: invalid %s checksum line", lineNumber, algorithmName(algorithm))
+		}
+		_, err := hex.DecodeString(sum)
+		if err != nil {
+			return []FileHash{}, fmt.Errorf("line %d: invalid %s checksum line", lineNumber, algorithmName(algorithm))
+		}
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+		}
+		hashes = append(hashes, FileHash{Path: "/" + strings.TrimPrefix(name, "/"), Hash: strings.ToLower(sum)})
+	}
+	err = scanner.Err()
+	if err != nil {
+		return []FileHash{}, err
+	}
+	return hashes, nil
+}
+
+// CheckContents compares the files of the image partition chosen by selector with a checksum manifest.
+// Every manifest file and every file of the image not in the manifest has a result.
+func CheckContents(imageFilename string, selector PartitionSelector, manifest []FileHash, algorithm string) ([]CheckResult, error) {
+	hashes, err := HashPartitionContents(imageFilename, selector, algorithm)
+	if err != nil {
+		return []CheckResult{}, err
+	}
+	computed := make(map[string]string)
+	for _, h := range hashes {
+		computed[h.Path] = h.Hash
+	}
+	listed := make(map[string]bool)
+	results := []CheckResult{}
+	for _, h := range manifest {
+		listed[h.Path] = true
+		sum, ok := computed[h.Path]
+		switch {
+		case !ok:
+			results = append(results, CheckResult{Path: h.Path, Status: CHECK_MISSING})
+		case sum != h.Hash:
+			results = append(results, CheckResult{Path: h.Path, Status: CHECK_FAILED})
+		default:
+			results = append(results, CheckResult{Path: h.Path, Status: CHECK_OK})
+		}
+	}
+	for _, h := range hashes {
+		if !listed[h.Path] {
+			results = append(results, CheckResult{Path: h.Path, Status: CHECK_UNLISTED})
+		}
+	}
+	return results, nil
+}
+
+// algorithmName returns the algorithm with the default spelled out
+func algorithmName(algorithm string) string {
+	if algorithm == "" {
+		return HASH_SHA256
+	}
+	return algorithm
+}
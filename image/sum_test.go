@@ -0,0 +1,84 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashContents(t *testing.T) {
+	dir := t.TempDir()
+	sourceISO := mkTestISO(t, dir)
+
+	hashes, err := HashContents(sourceISO, HASH_SHA256)
+	require.Nil(t, err)
+	paths := []string{}
+	for _, h := range hashes {
+		paths = append(paths, h.Path)
+	}
+	require.Equal(t, []string{"/autoexec.ipxe", "/docs/readme.txt", "/esp.img", "/isolinux.bin"}, paths)
+	sum := sha256.Sum256([]byte("#!ipxe\necho source\n"))
+	require.Equal(t, hex.EncodeToString(sum[:]), hashes[0].Hash)
+	require.Equal(t, hashes[0].Hash+"  autoexec.ipxe", hashes[0].String())
+	require.Equal(t, hex.EncodeToString(sha256File(t, filepath.Join(dir, "esp.img"))), hashes[2].Hash)
+
+	for algorithm, size := range map[string]int{HASH_SHA512: 128, HASH_BLAKE2B: 128} {
+		hashes, err := HashContents(sourceISO, algorithm)
+		require.Nil(t, err)
+		require.Len(t, hashes, 4)
+		require.Len(t, hashes[0].Hash, size)
+	}
+	_, err = HashContents(sourceISO, "md5")
+	require.NotNil(t, err)
+}
+
+func TestCheckContents(t *testing.T) {
+	dir := t.TempDir()
+	sourceISO := mkTestISO(t, dir)
+	hashes, err := HashContents(sourceISO, HASH_BLAKE2B)
+	require.Nil(t, err)
+	lines := []string{}
+	for _, h := range hashes {
+		lines = append(lines, h.String())
+	}
+	manifestFile := mkTestFile(t, dir, "B2SUMS", strings.Join(lines, "\n")+"\n")
+
+	fp, err := os.Open(manifestFile)
+	require.Nil(t, err)
+	defer fp.Close()
+	manifest, err := ReadHashManifest(fp, HASH_BLAKE2B)
+	require.Nil(t, err)
+	require.Equal(t, hashes, manifest)
+
+	results, err := CheckContents(sourceISO, PartitionSelector{}, manifest, HASH_BLAKE2B)
+	require.Nil(t, err)
+	require.Len(t, results, 4)
+	for _, result := range results {
+		require.Equal(t, CHECK_OK, result.Status)
+	}
+
+	// a changed hash, a file missing from the image and a file missing from the manifest
+	manifest[0].Hash = strings.Repeat("0", 128)
+	manifest[1].Path = "/docs/missing.txt"
+	results, err = CheckContents(sourceISO, PartitionSelector{}, manifest, HASH_BLAKE2B)
+	require.Nil(t, err)
+	require.Equal(t, []CheckResult{
+		{Path: "/autoexec.ipxe", Status: CHECK_FAILED},
+		{Path: "/docs/missing.txt", Status: CHECK_MISSING},
+		{Path: "/esp.img", Status: CHECK_OK},
+		{Path: "/isolinux.bin", Status: CHECK_OK},
+		{Path: "/docs/readme.txt", Status: CHECK_UNLISTED},
+	}, results)
+
+	_, err = ReadHashManifest(strings.NewReader("abc  file\n"), HASH_SHA256)
+	require.ErrorContains(t, err, "line 1: invalid sha256 checksum line")
+
+	escaped := FileHash{Path: "/a\\b", Hash: strings.Repeat("1", 64)}
+	manifest, err = ReadHashManifest(strings.NewReader(escaped.String()+"\n"), HASH_SHA256)
+	require.Nil(t, err)
+	require.Equal(t, []FileHash{escaped}, manifest)
+}
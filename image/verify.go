@@ -0,0 +1,533 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/rstms/go-diskfs/filesystem/iso9660"
+	"github.com/rstms/go-diskfs/util"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+	// ISO_MAX_DESCRIPTORS bounds the volume descriptor set scanned for a terminator
+	ISO_MAX_DESCRIPTORS = 64
+)
+
+// Finding is a problem found by VerifyImage
+type Finding struct {
+	// Severity is SEVERITY_ERROR or SEVERITY_WARNING
+	Severity string `json:"severity"`
+	// Check names the failed check, such as fat.copies or iso.catalog
+	Check string `json:"check"`
+	// Volume is the checked filesystem: image, partition N or boot entry N
+	Volume string `json:"volume"`
+	// Path is the image path of the file or directory involved, if any
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (f *Finding) String() string {
+	s := fmt.Sprintf("%s: %s: %s: ", f.Severity, f.Volume, f.Check)
+	if f.Path != "" {
+		s += f.Path + ": "
+	}
+	return s + f.Message
+}
+
+// VerifyReport lists the findings of VerifyImage
+type VerifyReport struct {
+	Image string `json:"image"`
+	// Format is iso9660, FAT12, FAT16, FAT32, disk or unknown
+	Format string `json:"format"`
+	// Volumes lists the filesystems checked
+	Volumes  []string   `json:"volumes"`
+	Findings []*Finding `json:"findings"`
+	Errors   int        `json:"errors"`
+	Warnings int        `json:"warnings"`
+}
+
+// OK returns true if no errors were found
+func (r *VerifyReport) OK() bool {
+	return r.Errors == 0
+}
+
+func (r *VerifyReport) add(severity, volume, check, imagePath, format string, args ...any) {
+	r.Findings = append(r.Findings, &Finding{
+		Severity: severity,
+		Check:    check,
+		Volume:   volume,
+		Path:     imagePath,
+		Message:  fmt.Sprintf(format, args...),
+	})
+	if severity == SEVERITY_ERROR {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+// VerifyImage checks the structure of a FAT image, an ISO9660 image with its El Torito boot images, or
+// the FAT partitions of a partitioned disk image. Problems are returned as findings; the error result
+// is only set if the image cannot be read at all.
+func VerifyImage(imageFilename string) (*VerifyReport, error) {
+	fp, err := os.Open(imageFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	stat, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	report := VerifyReport{Image: imageFilename, Format: "unknown", Volumes: []string{}, Findings: []*Finding{}}
+
+	switch {
+	case isISO9660(fp):
+		report.Format = "iso9660"
+		verifyISO(&report, fp, size)
+	case isFATBootSector(fp, 0):
+		report.Format = verifyFAT(&report, "image", fp, 0, size).String()
+	default:
+		partitions, err := readPartitions(fp)
+		if err != nil {
+			return nil, err
+		}
+		if len(partitions) == 0 {
+			if hasBootSectorSignature(fp, 0) {
+				// report why the boot sector is not a valid FAT filesystem
+				verifyFAT(&report, "image", fp, 0, size)
+			} else {
+				report.add(SEVERITY_ERROR, "image", "image.format", "", "no FAT or ISO9660 filesystem or partition table found")
+			}
+			break
+		}
+		report.Format = "disk"
+		for _, p := range partitions {
+			volume := fmt.Sprintf("partition %d", p.Index)
+			switch {
+			case p.Start+p.Size > size:
+				report.add(SEVERITY_ERROR, volume, "partition.bounds", "", "partition ends at %d beyond the image size %d", p.Start+p.Size, size)
+			case isFATBootSector(fp, p.Start):
+				verifyFAT(&report, volume, fp, p.Start, p.Size)
+			}
+		}
+	}
+	return &report, nil
+}
+
+// isFATBootSector returns true if the sector at start holds a valid FAT boot sector
+func isFATBootSector(r io.ReaderAt, start int64) bool {
+	b := make([]byte, FAT_SECTOR_SIZE)
+	_, err := r.ReadAt(b, start)
+	if err != nil {
+		return false
+	}
+	_, err = parseFATBootSector(b)
+	return err == nil
+}
+
+// hasBootSectorSignature returns true if the sector at start has a jump instruction and boot signature
+func hasBootSectorSignature(r io.ReaderAt, start int64) bool {
+	b := make([]byte, FAT_SECTOR_SIZE)
+	_, err := r.ReadAt(b, start)
+	return err == nil && (b[0] == 0xeb || b[0] == 0xe9) && b[510] == 0x55 && b[511] == 0xaa
+}
+
+// fatVerifier checks one FAT filesystem
+type fatVerifier struct {
+	report *VerifyReport
+	volume string
+	fs     *fatFS
+	// owners maps each cluster reached from the directory tree to the path using it
+	owners  map[uint32]string
+	visited map[uint32]bool
+}
+
+func (v *fatVerifier) errorf(check, imagePath, format string, args ...any) {
+	v.report.add(SEVERITY_ERROR, v.volume, check, imagePath, format, args...)
+}
+
+func (v *fatVerifier) warnf(check, imagePath, format string, args ...any) {
+	v.report.add(SEVERITY_WARNING, v.volume, check, imagePath, format, args...)
+}
+
+// verifyFAT checks the FAT filesystem of size bytes at start and returns its type
+func verifyFAT(report *VerifyReport, volume string, r io.ReaderAt, start, size int64) FATType {
+	report.Volumes = append(report.Volumes, volume)
+	v := fatVerifier{report: report, volume: volume, owners: make(map[uint32]string), visited: make(map[uint32]bool)}
+
+	b := make([]byte, FAT_SECTOR_SIZE)
+	_, err := r.ReadAt(b, start)
+	if err != nil {
+		v.errorf("fat.boot_sector", "", "failed reading boot sector: %v", err)
+		return FATAuto
+	}
+	if b[510] != 0x55 || b[511] != 0xaa {
+		v.errorf("fat.boot_sector", "", "missing boot sector signature")
+	}
+	layout, err := parseFATBootSector(b)
+	if err != nil {
+		v.errorf("fat.bpb", "", "%v", err)
+		return FATAuto
+	}
+	if layout.totalSectors*layout.bytesPerSector > size {
+		v.errorf("fat.bpb", "", "filesystem size %d exceeds volume size %d", layout.totalSectors*layout.bytesPerSector, size)
+		return layout.fatType
+	}
+	if layout.mediaType != 0xf0 && layout.mediaType < 0xf8 {
+		v.warnf("fat.bpb", "", "invalid media descriptor 0x%02x", layout.mediaType)
+	}
+	typeOffset := 54
+	if layout.fatType == FAT32 {
+		typeOffset = 82
+	}
+	if b[typeOffset-28] == 0x29 {
+		label := strings.TrimSpace(string(b[typeOffset : typeOffset+8]))
+		if strings.HasPrefix(label, "FAT") && label != "FAT" && label != layout.fatType.String() {
+			v.warnf("fat.bpb", "", "filesystem type field is %s but the cluster count makes it %s", label, layout.fatType)
+		}
+	}
+
+	v.verifyFATCopies(r, start, layout)
+
+	device := readOnlyDevice{io.NewSectionReader(r, start, size)}
+	fs, err := readFAT(device, 0, size)
+	if err != nil {
+		v.errorf("fat.bpb", "", "%v", err)
+		return layout.fatType
+	}
+	v.fs = fs
+	if byte(fs.fat[0]) != layout.mediaType {
+		v.warnf("fat.media", "", "FAT media byte 0x%02x does not match the BPB media descriptor 0x%02x", byte(fs.fat[0]), layout.mediaType)
+	}
+	if layout.fatType == FAT32 {
+		v.verifyFSInfo(b, device)
+		if !fs.validCluster(fs.root) {
+			v.errorf("fat.bpb", "", "invalid root directory cluster %d", fs.root)
+			return layout.fatType
+		}
+	}
+	for cluster := uint32(2); cluster < uint32(len(fs.fat)); cluster++ {
+		value := fs.fat[cluster]
+		if value != 0 && !fs.isEOC(value) && !fs.isBad(value) && !fs.validCluster(value) {
+			v.errorf("fat.chain", "", "cluster %d links to invalid cluster %d", cluster, value)
+		}
+	}
+
+	if fs.root != 0 {
+		v.claimChain("/", fs.root, -1)
+	}
+	v.verifyDirectory("/", fs.root)
+
+	lost := 0
+	for cluster := uint32(2); cluster < uint32(len(fs.fat)); cluster++ {
+		value := fs.fat[cluster]
+		if value != 0 && !fs.isBad(value) && v.owners[cluster] == "" {
+			lost++
+		}
+	}
+	if lost > 0 {
+		v.warnf("fat.lost_clusters", "", "%d allocated clusters are not used by any file or directory", lost)
+	}
+	return layout.fatType
+}
+
+// isBad returns true if value marks a bad cluster
+func (fs *fatFS) isBad(value uint32) bool {
+	return value == fs.eocMark()-8
+}
+
+// verifyFATCopies compares each FAT copy with the first
+func (v *fatVerifier) verifyFATCopies(r io.ReaderAt, start int64, layout *fatLayout) {
+	length := layout.fatSectors * layout.bytesPerSector
+	first := make([]byte, length)
+	_, err := r.ReadAt(first, start+layout.fatOffset(0))
+	if err != nil {
+		v.errorf("fat.copies", "", "failed reading FAT: %v", err)
+		return
+	}
+	other := make([]byte, length)
+	for i := int64(1); i < layout.numFATs; i++ {
+		_, err := r.ReadAt(other, start+layout.fatOffset(i))
+		if err != nil {
+			v.errorf("fat.copies", "", "failed reading FAT copy %d: %v", i+1, err)
+			continue
+		}
+		if !bytes.Equal(first, other) {
+			v.errorf("fat.copies", "", "FAT copy %d differs from FAT copy 1", i+1)
+		}
+	}
+}
+
+// verifyFSInfo checks the FAT32 FSInfo sector signatures
+func (v *fatVerifier) verifyFSInfo(bootSector []byte, device fatDevice) {
+	sector := int64(binary.LittleEndian.Uint16(bootSector[48:50]))
+	if sector == 0 || sector == 0xffff {
+		return
+	}
+	b := make([]byte, FAT_SECTOR_SIZE)
+	_, err := device.ReadAt(b, sector*v.fs.layout.bytesPerSector)
+	if err != nil || string(b[0:4]) != "RRaA" || string(b[484:488]) != "rrAa" {
+		v.warnf("fat.fsinfo", "", "invalid FSInfo sector %d", sector)
+	}
+}
+
+// claimChain marks the cluster chain of imagePath as used, reporting loops, invalid links and clusters
+// already used by another path, and returns the chain length. A size of -1 skips the size check.
+func (v *fatVerifier) claimChain(imagePath string, cluster uint32, size int64) int64 {
+	fs := v.fs
+	count := int64(0)
+	for cluster != 0 && !fs.isEOC(cluster) {
+		if !fs.validCluster(cluster) {
+			v.errorf("fat.chain", imagePath, "invalid cluster %d in chain", cluster)
+			return count
+		}
+		if owner := v.owners[cluster]; owner != "" {
+			if owner == imagePath {
+				v.errorf("fat.chain", imagePath, "cluster chain loops at cluster %d", cluster)
+			} else {
+				v.errorf("fat.cross_link", imagePath, "cluster %d is also used by %s", cluster, owner)
+			}
+			return count
+		}
+		if fs.fat[cluster] == 0 {
+			v.errorf("fat.chain", imagePath, "cluster %d in chain is marked free", cluster)
+			return count + 1
+		}
+		v.owners[cluster] = imagePath
+		count++
+		cluster = fs.fat[cluster]
+	}
+	if size >= 0 {
+		clusterSize := fs.layout.clusterSize()
+		expected := (size + clusterSize - 1) / clusterSize
+		switch {
+		case count < expected:
+			v.errorf("fat.file_size", imagePath, "file size %d needs %d clusters but the chain has %d", size, expected, count)
+		case count > expected:
+			v.warnf("fat.file_size", imagePath, "file size %d needs %d clusters but the chain has %d", size, expected, count)
+		}
+	}
+	return count
+}
+
+// verifyDirectory checks the entries of the directory at cluster and everything below it
+func (v *fatVerifier) verifyDirectory(dir string, cluster uint32) {
+	if v.visited[cluster] {
+		v.errorf("fat.directory", dir, "directory loop")
+		return
+	}
+	v.visited[cluster] = true
+	entries, err := v.fs.readDirEntries(cluster, false)
+	if err != nil {
+		v.errorf("fat.directory", dir, "%v", err)
+		return
+	}
+	for _, entry := range entries {
+		imagePath := path.Join(dir, entry.name)
+		if entry.isDir() {
+			if entry.cluster == 0 {
+				v.errorf("fat.directory", imagePath, "directory has no cluster")
+				continue
+			}
+			if v.claimChain(imagePath, entry.cluster, -1) > 0 {
+				v.verifyDirectory(imagePath, entry.cluster)
+			}
+			continue
+		}
+		if entry.size > 0 && entry.cluster == 0 {
+			v.errorf("fat.file_size", imagePath, "file of %d bytes has no cluster", entry.size)
+			continue
+		}
+		v.claimChain(imagePath, entry.cluster, int64(entry.size))
+	}
+}
+
+// isoVerifier checks an ISO9660 image
+type isoVerifier struct {
+	report *VerifyReport
+	r      util.File
+	// size is the image file size
+	size int64
+	// blocks is the volume space size in logical blocks
+	blocks int64
+}
+
+func (v *isoVerifier) errorf(check, imagePath, format string, args ...any) {
+	v.report.add(SEVERITY_ERROR, "image", check, imagePath, format, args...)
+}
+
+func (v *isoVerifier) warnf(check, imagePath, format string, args ...any) {
+	v.report.add(SEVERITY_WARNING, "image", check, imagePath, format, args...)
+}
+
+// verifyISO checks the volume descriptors, directory tree and El Torito boot images of an ISO9660 image
+func verifyISO(report *VerifyReport, r util.File, size int64) {
+	report.Volumes = append(report.Volumes, "image")
+	v := isoVerifier{report: report, r: r, size: size}
+	if !v.verifyDescriptors() {
+		return
+	}
+	// locating boot images reads the directory tree again through go-diskfs, which trusts its records
+	if v.verifyDirectories() {
+		v.verifyBootCatalog()
+	}
+}
+
+// verifyDescriptors checks the volume descriptor set and the primary volume descriptor, returning
+// false if the directory tree cannot be checked
+func (v *isoVerifier) verifyDescriptors() bool {
+	descriptor := make([]byte, ISO_LOGICAL_BLOCK_SIZE)
+	var pvd []byte
+	terminated := false
+	for i := int64(0); i < ISO_MAX_DESCRIPTORS && !terminated; i++ {
+		sector := ISO_SYSTEM_AREA_SECTORS + i
+		_, err := v.r.ReadAt(descriptor, sector*ISO_LOGICAL_BLOCK_SIZE)
+		if err != nil {
+			v.errorf("iso.descriptors", "", "failed reading volume descriptor at sector %d: %v", sector, err)
+			break
+		}
+		if string(descriptor[1:6]) != "CD001" {
+			v.errorf("iso.descriptors", "", "invalid volume descriptor at sector %d", sector)
+			break
+		}
+		if descriptor[6] != 1 {
+			v.warnf("iso.descriptors", "", "volume descriptor at sector %d has version %d", sector, descriptor[6])
+		}
+		switch descriptor[0] {
+		case 1:
+			if pvd == nil {
+				pvd = bytes.Clone(descriptor)
+			}
+		case 0xff:
+			terminated = true
+		}
+	}
+	if !terminated {
+		v.errorf("iso.descriptors", "", "volume descriptor set terminator not found")
+	}
+	if pvd == nil {
+		v.errorf("iso.pvd", "", "primary volume descriptor not found")
+		return false
+	}
+
+	bothEndian := func(field string, offset int, width int) (uint32, bool) {
+		var le, be uint32
+		if width == 2 {
+			le = uint32(binary.LittleEndian.Uint16(pvd[offset : offset+2]))
+			be = uint32(binary.BigEndian.Uint16(pvd[offset+2 : offset+4]))
+		} else {
+			le = binary.LittleEndian.Uint32(pvd[offset : offset+4])
+			be = binary.BigEndian.Uint32(pvd[offset+4 : offset+8])
+		}
+		if le != be {
+			v.errorf("iso.pvd", "", "%s differs between byte orders: %d and %d", field, le, be)
+			return le, false
+		}
+		return le, true
+	}
+	blockSize, ok := bothEndian("logical block size", 128, 2)
+	if !ok {
+		return false
+	}
+	if blockSize != ISO_LOGICAL_BLOCK_SIZE {
+		v.errorf("iso.pvd", "", "unsupported logical block size %d", blockSize)
+		return false
+	}
+	blocks, _ := bothEndian("volume space size", 80, 4)
+	v.blocks = int64(blocks)
+	if v.blocks*ISO_LOGICAL_BLOCK_SIZE > v.size {
+		v.errorf("iso.pvd", "", "volume space of %d blocks exceeds the image size %d", v.blocks, v.size)
+	}
+	if pvd[156] != 34 {
+		v.errorf("iso.pvd", "", "invalid root directory record length %d", pvd[156])
+		return false
+	}
+	return true
+}
+
+// verifyExtent reports an extent that lies outside the volume or the image file
+func (v *isoVerifier) verifyExtent(check, imagePath string, location uint32, size int64) bool {
+	end := int64(location)*ISO_LOGICAL_BLOCK_SIZE + size
+	switch {
+	case end > v.size:
+		v.errorf(check, imagePath, "extent at block %d with %d bytes ends beyond the image size %d", location, size, v.size)
+	case v.blocks > 0 && end > v.blocks*ISO_LOGICAL_BLOCK_SIZE:
+		v.errorf(check, imagePath, "extent at block %d with %d bytes ends beyond the volume space", location, size)
+	default:
+		return true
+	}
+	return false
+}
+
+// verifyDirectories walks the directory tree, checking records and file extents, returning false if the
+// tree cannot be read
+func (v *isoVerifier) verifyDirectories() bool {
+	entries, err := readISOEntries(v.r)
+	if err != nil {
+		v.errorf("iso.directory", "", "%v", err)
+		return false
+	}
+	for _, entry := range entries {
+		v.verifyExtent("iso.extent", entry.path, entry.location, entry.size)
+	}
+	return true
+}
+
+// verifyBootCatalog checks the El Torito catalog and reads every boot image, verifying EFI boot images
+// as FAT filesystems
+func (v *isoVerifier) verifyBootCatalog() {
+	location, err := bootCatalogLocation(v.r)
+	if err != nil {
+		v.errorf("iso.catalog", "", "%v", err)
+		return
+	}
+	if location == 0 {
+		return
+	}
+	if !v.verifyExtent("iso.catalog", "", location, ISO_LOGICAL_BLOCK_SIZE) {
+		return
+	}
+	fs, err := iso9660.Read(v.r, v.size, 0, ISO_LOGICAL_BLOCK_SIZE)
+	if err != nil {
+		v.errorf("iso.catalog", "", "%v", err)
+		return
+	}
+	catalog, err := readBootCatalog(v.r, fs)
+	if err != nil {
+		v.errorf("iso.catalog", "", "%v", err)
+		return
+	}
+	for i, entry := range catalog.Entries {
+		check := "iso.boot_image"
+		volume := fmt.Sprintf("boot entry %d", i+1)
+		if entry.Size <= 0 {
+			v.errorf(check, entry.Path, "%s has an empty boot image", volume)
+			continue
+		}
+		if !v.verifyExtent(check, entry.Path, entry.LoadRBA, entry.Size) {
+			continue
+		}
+		_, err := io.Copy(io.Discard, io.NewSectionReader(v.r, int64(entry.LoadRBA)*ISO_LOGICAL_BLOCK_SIZE, entry.Size))
+		if err != nil {
+			v.errorf(check, entry.Path, "failed reading %s boot image: %v", volume, err)
+			continue
+		}
+		if entry.Platform == iso9660.EFI {
+			offset := int64(entry.LoadRBA) * ISO_LOGICAL_BLOCK_SIZE
+			section := io.NewSectionReader(v.r, offset, entry.Size)
+			if isFATBootSector(section, 0) {
+				verifyFAT(v.report, volume, section, 0, entry.Size)
+			} else {
+				v.errorf(check, entry.Path, "%s EFI boot image is not a FAT filesystem", volume)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package image
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// requireFinding asserts that report holds a finding of severity for check
+func requireFinding(t *testing.T, report *VerifyReport, severity, check string) {
+	for _, finding := range report.Findings {
+		if finding.Severity == severity && finding.Check == check {
+			return
+		}
+	}
+	require.Failf(t, "finding not reported", "%s %s not in %v", severity, check, report.Findings)
+}
+
+// patchFile overwrites len(data) bytes of filename at offset
+func patchFile(t *testing.T, filename string, offset int64, data []byte) {
+	fp, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.Nil(t, err)
+	defer fp.Close()
+	_, err = fp.WriteAt(data, offset)
+	require.Nil(t, err)
+}
+
+func TestVerifyFAT(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		mkTestFile(t, dir, "a.txt", "first file\n"),
+		mkTestFile(t, dir, "b.txt", "second file\n"),
+	}
+	mkImage := func(name string) (string, *fatLayout, []*fatDirEntry) {
+		imageFile := filepath.Join(dir, name)
+		err := BuildEFIImage(t.Context(), imageFile, EFIImageOptions{ExtraFiles: files})
+		require.Nil(t, err)
+		data, err := os.ReadFile(imageFile)
+		require.Nil(t, err)
+		layout, err := parseFATBootSector(data)
+		require.Nil(t, err)
+		root := data[layout.rootDirOffset():layout.dataOffset()]
+		return imageFile, layout, parseFATDirectory(root, false)
+	}
+
+	good, _, _ := mkImage("good.img")
+	report, err := VerifyImage(good)
+	require.Nil(t, err)
+	require.True(t, report.OK(), "%v", report.Findings)
+	require.Empty(t, report.Findings)
+	require.Equal(t, "FAT12", report.Format)
+
+	copies, layout, _ := mkImage("copies.img")
+	patchFile(t, copies, layout.fatOffset(1)+3, []byte{0x42})
+	report, err = VerifyImage(copies)
+	require.Nil(t, err)
+	require.False(t, report.OK())
+	requireFinding(t, report, SEVERITY_ERROR, "fat.copies")
+
+	crossed, layout, entries := mkImage("crossed.img")
+	require.Len(t, entries, 2)
+	cluster := make([]byte, 2)
+	binary.LittleEndian.PutUint16(cluster, uint16(entries[0].cluster))
+	patchFile(t, crossed, layout.rootDirOffset()+int64(entries[1].offset)+26, cluster)
+	report, err = VerifyImage(crossed)
+	require.Nil(t, err)
+	requireFinding(t, report, SEVERITY_ERROR, "fat.cross_link")
+	requireFinding(t, report, SEVERITY_WARNING, "fat.lost_clusters")
+
+	short, layout, entries := mkImage("short.img")
+	patchFile(t, short, layout.rootDirOffset()+int64(entries[0].offset)+28, []byte{0, 0, 1, 0})
+	report, err = VerifyImage(short)
+	require.Nil(t, err)
+	requireFinding(t, report, SEVERITY_ERROR, "fat.file_size")
+
+	bpb, _, _ := mkImage("bpb.img")
+	patchFile(t, bpb, 11, []byte{0, 0})
+	report, err = VerifyImage(bpb)
+	require.Nil(t, err)
+	requireFinding(t, report, SEVERITY_ERROR, "fat.bpb")
+}
+
+func TestVerifyISO(t *testing.T) {
+	sourceISO := mkTestISO(t, t.TempDir())
+	report, err := VerifyImage(sourceISO)
+	require.Nil(t, err)
+	require.True(t, report.OK(), "%v", report.Findings)
+	require.Equal(t, "iso9660", report.Format)
+	require.Equal(t, []string{"image", "boot entry 2"}, report.Volumes)
+
+	catalog, err := ReadBootCatalog(sourceISO)
+	require.Nil(t, err)
+	data, err := os.ReadFile(sourceISO)
+	require.Nil(t, err)
+
+	checksum := filepath.Join(t.TempDir(), "checksum.iso")
+	require.Nil(t, os.WriteFile(checksum, data, 0600))
+	patchFile(t, checksum, int64(catalog.Location)*ISO_LOGICAL_BLOCK_SIZE+4, []byte("X"))
+	report, err = VerifyImage(checksum)
+	require.Nil(t, err)
+	require.False(t, report.OK())
+	requireFinding(t, report, SEVERITY_ERROR, "iso.catalog")
+
+	// turn the terminator into an unknown descriptor type
+	unterminated := filepath.Join(t.TempDir(), "unterminated.iso")
+	require.Nil(t, os.WriteFile(unterminated, data, 0600))
+	for sector := int64(ISO_SYSTEM_AREA_SECTORS); ; sector++ {
+		if data[sector*ISO_LOGICAL_BLOCK_SIZE] == 0xff {
+			patchFile(t, unterminated, sector*ISO_LOGICAL_BLOCK_SIZE, []byte{0x7f})
+			break
+		}
+	}
+	report, err = VerifyImage(unterminated)
+	require.Nil(t, err)
+	requireFinding(t, report, SEVERITY_ERROR, "iso.descriptors")
+
+	truncated := filepath.Join(t.TempDir(), "truncated.iso")
+	require.Nil(t, os.WriteFile(truncated, data[:24*ISO_LOGICAL_BLOCK_SIZE], 0600))
+	report, err = VerifyImage(truncated)
+	require.Nil(t, err)
+	requireFinding(t, report, SEVERITY_ERROR, "iso.pvd")
+}
+
+func TestVerifyDisk(t *testing.T) {
+	report, err := VerifyImage(mkPartitionedImage(t, t.TempDir()))
+	require.Nil(t, err)
+	require.True(t, report.OK(), "%v", report.Findings)
+	require.Equal(t, "disk", report.Format)
+	require.Equal(t, []string{"partition 1", "partition 2"}, report.Volumes)
+
+	empty := mkTestFile(t, t.TempDir(), "empty.img", string(make([]byte, 4096)))
+	report, err = VerifyImage(empty)
+	require.Nil(t, err)
+	requireFinding(t, report, SEVERITY_ERROR, "image.format")
+}